@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -9,17 +12,47 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/iotmonitor/agent/internal/ami"
+	"github.com/iotmonitor/agent/internal/audit"
+	"github.com/iotmonitor/agent/internal/availability"
 	"github.com/iotmonitor/agent/internal/config"
-	"github.com/iotmonitor/agent/internal/monitor"
+	"github.com/iotmonitor/agent/internal/dependency"
+	"github.com/iotmonitor/agent/internal/desiredstate"
+	"github.com/iotmonitor/agent/internal/e2e"
+	"github.com/iotmonitor/agent/internal/fallback"
+	"github.com/iotmonitor/agent/internal/filesink"
+	"github.com/iotmonitor/agent/internal/gpio"
+	"github.com/iotmonitor/agent/internal/ha"
+	"github.com/iotmonitor/agent/internal/iotbridge"
+	"github.com/iotmonitor/agent/internal/localui"
 	"github.com/iotmonitor/agent/internal/mqtt"
+	"github.com/iotmonitor/agent/internal/opcua"
+	"github.com/iotmonitor/agent/internal/storage"
+	"github.com/iotmonitor/agent/pkg/collect"
 )
 
 func loadEnabledModules(raw string) map[string]bool {
 	enabled := map[string]bool{
-		"system":   true,
-		"docker":   true,
-		"asterisk": true,
-		"network":  true,
+		"system":    true,
+		"docker":    true,
+		"asterisk":  true,
+		"network":   true,
+		"gpio":      false,
+		"iotbridge": false,
+		"opcua":     false,
+		// availability derives SLA windows from the probe and service
+		// modules above.
+		"availability": false,
+		// fallback sends alerts directly while the broker is unreachable.
+		"fallback": false,
+		// audit follows the Linux audit subsystem for privileged actions.
+		"audit": false,
+		// desiredstate corrects drift from a declared state document.
+		"desiredstate": false,
+		// ha reports keepalived/Pacemaker cluster state and failovers.
+		"ha": false,
+		// storage writes to a test file on each probed disk.
+		"storage": false,
 	}
 
 	raw = strings.TrimSpace(raw)
@@ -48,9 +81,31 @@ func loadEnabledModules(raw string) map[string]bool {
 	return enabled
 }
 
+// waitForSetup keeps the process (and the local setup UI) alive when the
+// agent can't start, until a restart is requested or the agent is stopped.
+func waitForSetup(reason string, restartRequested <-chan struct{}, sigChan <-chan os.Signal) {
+	log.Printf("%s; waiting for configuration through the local setup UI", reason)
+	select {
+	case <-restartRequested:
+		log.Println("Restart requested from the local setup UI")
+	case sig := <-sigChan:
+		log.Printf("Received signal: %v. Shutting down...", sig)
+	}
+}
+
+// moduleTimeout bounds one module's collection. Each module gets its own
+// budget so a slow one can't leave the next with an expired context and
+// false probe failures.
+const moduleTimeout = 10 * time.Second
+
+func moduleContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), moduleTimeout)
+}
+
 func main() {
 	configPath := flag.String("config", "config.json", "Path to config file")
 	debug := flag.Bool("debug", false, "Enable debug logging")
+	rotateKeys := flag.Bool("rotate-keys", false, "Generate a new E2E device key pair and exit")
 	flag.Parse()
 
 	cfg, err := config.LoadConfig(*configPath)
@@ -62,29 +117,102 @@ func main() {
 		cfg.Debug = true
 	}
 
-	if cfg.DeviceID == "" || cfg.AgentToken == "" {
-		log.Fatal("DeviceID and AgentToken are required. Set via config file or env vars (IOT_DEVICE_ID, IOT_AGENT_TOKEN)")
+	if *rotateKeys {
+		kr, err := e2e.LoadOrCreateKeyring(cfg.E2EKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load keyring: %v", err)
+		}
+		if err := kr.Rotate(); err != nil {
+			log.Fatalf("Failed to rotate keys: %v", err)
+		}
+		log.Printf("Rotated E2E device key, new key id %s", kr.Current().KeyID)
+		return
+	}
+
+	// Graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	intervalSec := cfg.IntervalSec
+	if intervalSec <= 0 {
+		intervalSec = config.DefaultIntervalSec
+	}
+	interval := time.Duration(intervalSec) * time.Second
+	enabledModules := loadEnabledModules(cfg.EnabledModules)
+
+	// The local setup UI starts before the broker connection so technicians
+	// can fix a broken configuration on site.
+	var ui *localui.Server
+	var restartRequested <-chan struct{}
+	if cfg.LocalUI {
+		logBuffer := localui.NewLogBuffer(500)
+		log.SetOutput(io.MultiWriter(os.Stderr, logBuffer))
+		ui = localui.New(cfg, *configPath, enabledModules, interval, logBuffer)
+		if err := ui.Start(); err != nil {
+			log.Printf("Local setup UI unavailable: %v", err)
+			ui = nil
+		} else {
+			defer ui.Close()
+			restartRequested = ui.RestartRequested()
+		}
+	}
+
+	brokerless := cfg.FileSink.Enabled && cfg.FileSink.Only
+	if cfg.DeviceID == "" || (cfg.AgentToken == "" && !brokerless) {
+		msg := "DeviceID and AgentToken are required. Set via config file or env vars (IOT_DEVICE_ID, IOT_AGENT_TOKEN)"
+		if ui == nil {
+			log.Fatal(msg)
+		}
+		waitForSetup(msg, restartRequested, sigChan)
+		return
 	}
 
 	client, err := mqtt.NewClient(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to MQTT: %v", err)
+		if ui == nil {
+			log.Fatalf("Failed to connect to MQTT: %v", err)
+		}
+		waitForSetup(fmt.Sprintf("Failed to connect to MQTT: %v", err), restartRequested, sigChan)
+		return
+	}
+	if ui != nil {
+		ui.SetConnectionStatus(client.IsConnectionOpen)
+		client.SetMetricObserver(ui.RecordMetric)
+	}
+	if cfg.FileSink.Enabled {
+		sink, err := filesink.New(cfg.FileSink, cfg.DeviceID)
+		if err != nil {
+			if brokerless {
+				log.Fatalf("File sink unavailable: %v", err)
+			}
+			log.Printf("File sink unavailable: %v", err)
+		} else {
+			client.SetSink(sink)
+			defer sink.Close()
+		}
 	}
 
 	client.PublishStatus("online")
+	if err := client.PublishKeys(); err != nil {
+		log.Printf("Failed to publish E2E public keys: %v", err)
+	}
+
+	// Report which role profiles this device resolved to
+	if cfg.Profile != nil {
+		log.Printf("Roles %s: modules %s, interval %ds", strings.Join(cfg.Roles, ","), cfg.EnabledModules, intervalSec)
+		client.PublishEvent("profile", cfg.Profile)
+		client.RegisterHandler("agent.profile", func(context.Context, map[string]any) (any, error) {
+			return cfg.Profile, nil
+		})
+	}
 
 	// Start command handler
 	client.HandleCommands()
 
-	// Graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	log.Println("IoTMonitor Agent started successfully")
-	enabledModules := loadEnabledModules(cfg.EnabledModules)
 	asteriskContainer := strings.TrimSpace(cfg.AsteriskContainer)
 	if asteriskContainer == "" {
 		asteriskContainer = "asterisk"
@@ -94,41 +222,341 @@ func main() {
 		pingHost = "1.1.1.1"
 	}
 
+	var hostPaths collect.HostPaths
+	if cfg.HostMode {
+		hostPaths = cfg.HostPaths
+		for _, warning := range hostPaths.Validate() {
+			log.Printf("Host mode: %s", warning)
+		}
+	} else if containerized, runtime := collect.DetectContainer(); containerized {
+		log.Printf("Running inside a %s container without host_mode; system metrics describe the container, not the host", runtime)
+	}
+
+	systemCollector := collect.NewSystemCollector(
+		collect.WithDiskPath(cfg.DiskPath),
+		collect.WithHostPaths(hostPaths),
+	)
+	var dockerCollector *collect.DockerCollector
+	if enabledModules["docker"] {
+		dockerCollector, err = collect.NewDockerCollector()
+		if err != nil {
+			log.Printf("Docker collector unavailable: %v", err)
+		} else {
+			defer dockerCollector.Close()
+		}
+	}
+	// Services announced through iotmonitor.* container labels
+	var discovery *collect.ServiceDiscovery
+	if enabledModules["docker"] {
+		discovery, err = collect.NewServiceDiscovery()
+		if err != nil {
+			log.Printf("Service discovery unavailable: %v", err)
+		} else {
+			discoveryCtx, stopDiscovery := context.WithCancel(context.Background())
+			go discovery.Run(discoveryCtx)
+			defer discovery.Close()
+			defer stopDiscovery()
+		}
+	}
+	asteriskOpts := []collect.AsteriskOption{
+		collect.WithAsteriskContainer(asteriskContainer),
+		collect.WithAsteriskProcRoot(hostPaths.Proc),
+	}
+	if enabledModules["asterisk"] && cfg.AsteriskAMI.Username != "" {
+		amiClient, err := ami.New(cfg.AsteriskAMI)
+		if err != nil {
+			log.Printf("Asterisk AMI commands unavailable: %v", err)
+		} else {
+			for name, h := range amiClient.Handlers() {
+				client.RegisterHandler(name, h)
+			}
+			asteriskOpts = append(asteriskOpts, collect.WithAMIPing(amiClient.Ping))
+		}
+	}
+	asteriskCollector := collect.NewAsteriskCollector(asteriskOpts...)
+	networkOpts := []collect.NetworkOption{
+		collect.WithPingHosts(pingHost),
+		collect.WithPortTargets(cfg.PortChecks...),
+		collect.WithHTTPTargets(cfg.HTTPChecks...),
+		collect.WithUplinks(cfg.Uplinks...),
+		collect.WithContainerTargets(cfg.ContainerChecks...),
+		collect.WithProcRoot(hostPaths.Proc),
+		collect.WithProxy(cfg.Proxy),
+	}
+	if cfg.ConnectionMap {
+		networkOpts = append(networkOpts, collect.WithConnectionMap(cfg.ConnectionWatch...))
+	}
+	networkCollector := collect.NewNetworkCollector(networkOpts...)
+
+	var gpioMonitor *gpio.Monitor
+	if enabledModules["gpio"] {
+		gpioMonitor = gpio.New(cfg.GPIO, hostPaths, func(ev gpio.InputEvent) {
+			client.PublishEvent("gpio_input", ev)
+		})
+		defer gpioMonitor.Close()
+	}
+
+	var bridge *iotbridge.Bridge
+	if enabledModules["iotbridge"] {
+		bridge, err = iotbridge.New(cfg.IoTBridge, cfg.DeviceID)
+		if err != nil {
+			log.Printf("IoT bridge unavailable: %v", err)
+		} else {
+			client.RegisterHandler("iotbridge.command", bridge.HandleCommand)
+			defer bridge.Close()
+		}
+	}
+
+	var opcuaCollector *opcua.Collector
+	if enabledModules["opcua"] {
+		opcuaCollector, err = opcua.New(cfg.OPCUA)
+		if err != nil {
+			log.Printf("OPC UA collector unavailable: %v", err)
+		} else {
+			defer opcuaCollector.Close()
+		}
+	}
+
+	var haMonitor *ha.Monitor
+	if enabledModules["ha"] {
+		haMonitor = ha.New(cfg.HA, hostPaths, func(ev ha.Failover) {
+			log.Printf("HA failover: %s %s %s -> %s", ev.Source, ev.Name, ev.From, ev.To)
+			client.PublishEvent("ha_failover", ev)
+		})
+	}
+
+	if enabledModules["storage"] {
+		storageProbe := storage.New(cfg.Storage, hostPaths, func(m *collect.StorageMetrics) {
+			client.PublishMetric("storage", m)
+		}, func(ch storage.Change) {
+			if ch.State == "degraded" {
+				log.Printf("Storage degraded on %s: %s", ch.Path, strings.Join(ch.Reasons, "; "))
+			}
+			client.PublishEvent("storage_degraded", ch)
+		})
+		storageProbe.Start()
+		defer storageProbe.Close()
+	}
+
+	var auditMonitor *audit.Monitor
+	if enabledModules["audit"] {
+		auditMonitor, err = audit.New(cfg.Audit, hostPaths, func(ev audit.Event) {
+			client.PublishEvent("audit", ev)
+		})
+		if err != nil {
+			log.Printf("Audit monitor unavailable: %v", err)
+		} else {
+			defer auditMonitor.Close()
+		}
+	}
+
+	if enabledModules["desiredstate"] {
+		reconciler := desiredstate.New(cfg.DesiredState, hostPaths, func(report desiredstate.Report) {
+			client.PublishEvent("desired_state_report", report)
+		})
+		for name, h := range reconciler.Handlers() {
+			client.RegisterHandler(name, h)
+		}
+		reconciler.Start()
+		defer reconciler.Close()
+	}
+
+	var notifier *fallback.Notifier
+	if enabledModules["fallback"] {
+		notifier, err = fallback.New(cfg.Fallback, cfg.DeviceID, client.IsConnectionOpen)
+		if err != nil {
+			log.Printf("Fallback notifier unavailable: %v", err)
+		} else {
+			client.SetEventObserver(notifier.Event)
+			notifier.Start()
+			defer notifier.Close()
+		}
+	}
+
+	var deps *dependency.Graph
+	if len(cfg.Dependencies) > 0 {
+		deps, err = dependency.New(cfg.Dependencies)
+		if err != nil {
+			log.Printf("Dependency suppression disabled: %v", err)
+		}
+	}
+
+	var tracker *availability.Tracker
+	if enabledModules["availability"] {
+		tracker = availability.New(cfg.AvailabilityFile, interval)
+		defer tracker.Close()
+	}
+
+	// asteriskDeadlock is the last reported state, so the event is only
+	// published on changes.
+	asteriskDeadlock := false
+
 	for {
 		select {
 		case <-ticker.C:
 			// System Metrics
 			if enabledModules["system"] {
-				sysMetrics, err := monitor.GetSystemMetrics()
+				ctx, cancel := moduleContext()
+				sysMetrics, err := systemCollector.Collect(ctx)
+				cancel()
 				if err == nil {
 					client.PublishMetric("system", sysMetrics)
 				}
 			}
 
-			// Docker Metrics
-			if enabledModules["docker"] {
-				dockerMetrics, err := monitor.GetDockerMetrics()
+			// The probe and service modules are collected before any of
+			// them is published so dependency suppression sees every
+			// failure of this tick.
+			var snap dependency.Snapshot
+			dockerOK := false
+			if enabledModules["docker"] && dockerCollector != nil {
+				ctx, cancel := moduleContext()
+				containers, err := dockerCollector.Collect(ctx)
+				cancel()
 				if err == nil {
-					client.PublishMetric("docker", dockerMetrics)
+					snap.Containers = containers
+					dockerOK = true
 				}
 			}
-
-			// Asterisk Metrics
+			if discovery != nil {
+				snap.Services = discovery.Collect()
+			}
+			// Health runs alongside the other probes so a hung CLI
+			// doesn't delay them.
+			var asteriskHealth chan *collect.AsteriskHealth
 			if enabledModules["asterisk"] {
-				astMetrics, err := monitor.GetAsteriskPJSIPMetrics(asteriskContainer)
+				asteriskHealth = make(chan *collect.AsteriskHealth, 1)
+				go func() {
+					ctx, cancel := moduleContext()
+					defer cancel()
+					asteriskHealth <- asteriskCollector.Health(ctx)
+				}()
+				ctx, cancel := moduleContext()
+				snap.AsteriskChecked = true
+				snap.Asterisk, snap.AsteriskErr = asteriskCollector.Collect(ctx)
+				cancel()
+			}
+			if enabledModules["network"] {
+				ctx, cancel := moduleContext()
+				netMetrics, err := networkCollector.Collect(ctx)
+				cancel()
 				if err == nil {
-					client.PublishMetric("asterisk", astMetrics)
+					snap.Network = netMetrics
+				}
+			}
+			if deps != nil {
+				for _, ev := range deps.Annotate(&snap) {
+					client.PublishEvent("root_cause", ev)
+				}
+			}
+
+			// Docker Metrics
+			if dockerOK {
+				client.PublishMetric("docker", snap.Containers)
+				if tracker != nil {
+					tracker.ObserveContainers(snap.Containers)
+				}
+				if notifier != nil {
+					notifier.ObserveContainers(snap.Containers)
+				}
+			}
+
+			// Label-discovered container services
+			if len(snap.Services) > 0 {
+				client.PublishMetric("services", snap.Services)
+				if tracker != nil {
+					tracker.ObserveServices(snap.Services)
+				}
+				if notifier != nil {
+					notifier.ObserveServices(snap.Services)
+				}
+			}
+
+			// Asterisk Metrics
+			if snap.AsteriskChecked {
+				if tracker != nil {
+					tracker.ObserveAsterisk(snap.Asterisk, snap.AsteriskErr)
+				}
+				if notifier != nil {
+					notifier.ObserveAsterisk(snap.Asterisk, snap.AsteriskErr)
+				}
+				if snap.AsteriskErr == nil {
+					client.PublishMetric("asterisk", snap.Asterisk)
 				} else {
-					log.Printf("Asterisk metrics error: %v", err)
+					log.Printf("Asterisk metrics error: %v", snap.AsteriskErr)
+				}
+
+				health := <-asteriskHealth
+				client.PublishMetric("asterisk_health", health)
+				if health.SuspectedDeadlock != asteriskDeadlock {
+					asteriskDeadlock = health.SuspectedDeadlock
+					state := "cleared"
+					if asteriskDeadlock {
+						state = "suspected"
+						log.Printf("Asterisk deadlock suspected: %s", strings.Join(health.Reasons, "; "))
+					}
+					client.PublishEvent("asterisk_deadlock", map[string]any{
+						"state":     state,
+						"reasons":   health.Reasons,
+						"timestamp": health.Timestamp,
+					})
 				}
 			}
 
 			// Network Metrics
-			if enabledModules["network"] {
-				netMetrics := monitor.CheckNetwork([]string{pingHost}, nil)
-				client.PublishMetric("network", netMetrics)
+			if snap.Network != nil {
+				client.PublishMetric("network", snap.Network)
+				if tracker != nil {
+					tracker.ObserveNetwork(snap.Network)
+				}
+				if notifier != nil {
+					notifier.ObserveNetwork(snap.Network)
+				}
+				for _, ev := range snap.Network.NewRemoteEndpoints {
+					client.PublishEvent("new_remote_endpoint", ev)
+				}
+			}
+
+			// GPIO / environmental sensors
+			if gpioMonitor != nil {
+				client.PublishMetric("gpio", gpioMonitor.Collect())
+			}
+
+			// Bridged LAN IoT devices
+			if bridge != nil {
+				client.PublishMetric("iotbridge", bridge.Collect())
+			}
+
+			// OPC UA PLC values
+			if opcuaCollector != nil {
+				ctx, cancel := moduleContext()
+				client.PublishMetric("opcua", opcuaCollector.Collect(ctx))
+				cancel()
+			}
+
+			// Cluster state; failovers are published as events
+			if haMonitor != nil {
+				ctx, cancel := moduleContext()
+				client.PublishMetric("ha", haMonitor.Collect(ctx))
+				cancel()
 			}
 
+			// Audit event counters
+			if auditMonitor != nil {
+				client.PublishMetric("audit", auditMonitor.Collect())
+			}
+
+			// Availability / SLA windows, after all observations are in
+			if tracker != nil {
+				client.PublishMetric("availability", tracker.Collect())
+			}
+
+		case <-restartRequested:
+			log.Println("Restart requested from the local setup UI. Shutting down...")
+			client.PublishStatus("offline")
+			client.Disconnect(250)
+			return
+
 		case sig := <-sigChan:
 			log.Printf("Received signal: %v. Shutting down...", sig)
 			client.PublishStatus("offline")
@@ -0,0 +1,438 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+// Client runs typed Asterisk operations against one manager interface.
+type Client struct {
+	addr     string
+	username string
+	secret   string
+}
+
+// New returns a Client for cfg.
+func New(cfg config.AsteriskAMIConfig) (*Client, error) {
+	if cfg.Username == "" || cfg.Secret == "" {
+		return nil, errors.New("asterisk_ami needs username and secret")
+	}
+	addr := cfg.Address
+	if addr == "" {
+		addr = "127.0.0.1:5038"
+	}
+	return &Client{addr: addr, username: cfg.Username, secret: cfg.Secret}, nil
+}
+
+// Handlers returns the typed command handlers keyed by command name.
+func (c *Client) Handlers() map[string]func(context.Context, map[string]any) (any, error) {
+	return map[string]func(context.Context, map[string]any) (any, error){
+		"asterisk.send_register":  c.SendRegister,
+		"asterisk.qualify":        c.Qualify,
+		"asterisk.hangup_channel": c.HangupChannel,
+		"asterisk.show_endpoint":  c.ShowEndpoint,
+		"asterisk.originate":      c.Originate,
+	}
+}
+
+func (c *Client) session(ctx context.Context) (*conn, error) {
+	return dial(ctx, c.addr, c.username, c.secret)
+}
+
+// Ping logs in and sends a Ping action, checking that the manager
+// interface still answers.
+func (c *Client) Ping(ctx context.Context) error {
+	s, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	resp, err := s.action("Ping")
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+var (
+	objectNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@+\-]{0,79}$`)
+	channelRe    = regexp.MustCompile(`^[A-Za-z0-9]+/[A-Za-z0-9_.@+:;\-]{1,120}$`)
+	dialRe       = regexp.MustCompile(`^[A-Za-z0-9]+/[A-Za-z0-9_.@+:\-]{1,120}$`)
+	contextRe    = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,79}$`)
+	extenRe      = regexp.MustCompile(`^[A-Za-z0-9_+*#.\-]{1,79}$`)
+)
+
+// originateApplications are the dialplan applications Originate may
+// connect a call to, keyed by lower-case name (Asterisk matches them
+// case-insensitively). Applications that run shell commands or arbitrary
+// dialplan (System, TrySystem, Exec, Eval, ExecIf, ...) are never allowed.
+var originateApplications = map[string]string{
+	"playback":  "Playback",
+	"dial":      "Dial",
+	"echo":      "Echo",
+	"milliwatt": "Milliwatt",
+	"wait":      "Wait",
+}
+
+// safeDialOptions are the Dial options Originate passes through. Options
+// that run dialplan on either leg (U, M, G, F, e, ...) or take arguments
+// are refused.
+const safeDialOptions = "cHhIiKkrTtWwXx"
+
+// checkDialData validates Dial's data: dial strings joined by "&", then an
+// optional ring timeout in seconds and options from safeDialOptions.
+func checkDialData(data string) error {
+	args := strings.Split(data, ",")
+	if len(args) > 3 {
+		return errors.New("dial data takes at most a dial string, timeout and options")
+	}
+	for _, d := range strings.Split(args[0], "&") {
+		if !dialRe.MatchString(d) {
+			return fmt.Errorf("invalid dial string %q", d)
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+			return fmt.Errorf("invalid dial timeout %q", args[1])
+		}
+	}
+	if len(args) > 2 {
+		for _, o := range args[2] {
+			if !strings.ContainsRune(safeDialOptions, o) {
+				return fmt.Errorf("dial option %q is not allowed", o)
+			}
+		}
+	}
+	return nil
+}
+
+// stringParam returns params[key], checking it against re. Empty optional
+// values are returned as "".
+func stringParam(params map[string]any, key string, required bool, re *regexp.Regexp) (string, error) {
+	raw, ok := params[key]
+	if !ok || raw == nil {
+		if required {
+			return "", fmt.Errorf("%s is required", key)
+		}
+		return "", nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		if required {
+			return "", fmt.Errorf("%s is required", key)
+		}
+		return "", nil
+	}
+	if re != nil && !re.MatchString(s) {
+		return "", fmt.Errorf("invalid %s %q", key, s)
+	}
+	return s, nil
+}
+
+// textParam accepts free text without line breaks, up to max bytes.
+func textParam(params map[string]any, key string, max int) (string, error) {
+	s, err := stringParam(params, key, false, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(s) > max || strings.ContainsAny(s, "\r\n") {
+		return "", fmt.Errorf("invalid %s", key)
+	}
+	return s, nil
+}
+
+// intParam returns params[key] (a JSON number) within [min, max], or def
+// when absent.
+func intParam(params map[string]any, key string, def, min, max int) (int, error) {
+	raw, ok := params[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+	f, ok := raw.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	n := int(f)
+	if n < min || n > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", key, min, max)
+	}
+	return n, nil
+}
+
+// ActionResult is the response of a single-shot AMI action.
+type ActionResult struct {
+	Target  string `json:"target"`
+	Message string `json:"message"`
+}
+
+// SendRegister is "asterisk.send_register": forces an outbound PJSIP
+// registration to re-register now. Params: registration.
+func (c *Client) SendRegister(ctx context.Context, params map[string]any) (any, error) {
+	name, err := stringParam(params, "registration", true, objectNameRe)
+	if err != nil {
+		return nil, err
+	}
+	return c.simple(ctx, name, "PJSIPRegister", header{"Registration", name})
+}
+
+// Qualify is "asterisk.qualify": sends an OPTIONS qualify to every contact
+// of an endpoint. Results arrive asynchronously; use show_endpoint to read
+// the contact status afterwards. Params: endpoint.
+func (c *Client) Qualify(ctx context.Context, params map[string]any) (any, error) {
+	name, err := stringParam(params, "endpoint", true, objectNameRe)
+	if err != nil {
+		return nil, err
+	}
+	return c.simple(ctx, name, "PJSIPQualify", header{"Endpoint", name})
+}
+
+// HangupChannel is "asterisk.hangup_channel". Params: channel (the full
+// channel name, e.g. "PJSIP/trunk-0000002a"), optional cause (Q.850, default
+// 16). Channel patterns are not accepted, so one call hangs up one channel.
+func (c *Client) HangupChannel(ctx context.Context, params map[string]any) (any, error) {
+	channel, err := stringParam(params, "channel", true, channelRe)
+	if err != nil {
+		return nil, err
+	}
+	cause, err := intParam(params, "cause", 16, 0, 127)
+	if err != nil {
+		return nil, err
+	}
+	return c.simple(ctx, channel, "Hangup", header{"Channel", channel}, header{"Cause", strconv.Itoa(cause)})
+}
+
+func (c *Client) simple(ctx context.Context, target, action string, headers ...header) (*ActionResult, error) {
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	resp, err := s.action(action, headers...)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.err(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", action, target, err)
+	}
+	return &ActionResult{Target: target, Message: resp["Message"]}, nil
+}
+
+// EndpointContact is one registered or static contact of an endpoint.
+type EndpointContact struct {
+	AOR       string   `json:"aor"`
+	URI       string   `json:"uri"`
+	Status    string   `json:"status"`
+	RTTms     *float64 `json:"rtt_ms,omitempty"`
+	UserAgent string   `json:"user_agent,omitempty"`
+}
+
+// EndpointInfo is the response of "asterisk.show_endpoint".
+type EndpointInfo struct {
+	Endpoint       string            `json:"endpoint"`
+	DeviceState    string            `json:"device_state"`
+	ActiveChannels int               `json:"active_channels"`
+	Context        string            `json:"context"`
+	Transport      string            `json:"transport,omitempty"`
+	AORs           []string          `json:"aors"`
+	Auths          []string          `json:"auths"`
+	OutboundAuths  []string          `json:"outbound_auths,omitempty"`
+	Identify       []string          `json:"identify,omitempty"`
+	Contacts       []EndpointContact `json:"contacts"`
+	Settings       map[string]string `json:"settings"`
+}
+
+// Headers never copied into responses.
+var secretFields = map[string]bool{"Password": true, "Md5Cred": true, "Secret": true}
+
+// ShowEndpoint is "asterisk.show_endpoint". Params: endpoint.
+func (c *Client) ShowEndpoint(ctx context.Context, params map[string]any) (any, error) {
+	name, err := stringParam(params, "endpoint", true, objectNameRe)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	events, err := s.list("PJSIPShowEndpoint", header{"Endpoint", name})
+	if err != nil {
+		return nil, fmt.Errorf("PJSIPShowEndpoint %s: %w", name, err)
+	}
+
+	info := &EndpointInfo{Endpoint: name, AORs: []string{}, Auths: []string{}, Contacts: []EndpointContact{}, Settings: map[string]string{}}
+	for _, ev := range events {
+		switch ev["Event"] {
+		case "EndpointDetail":
+			info.DeviceState = ev["DeviceState"]
+			info.ActiveChannels, _ = strconv.Atoi(ev["ActiveChannels"])
+			info.Context = ev["Context"]
+			info.Transport = ev["Transport"]
+			info.AORs = splitList(ev["Aors"])
+			info.Auths = splitList(ev["Auth"])
+			info.OutboundAuths = splitList(ev["OutboundAuth"])
+			for k, v := range ev {
+				switch k {
+				case "Event", "ActionID", "EventList", "ObjectType", "ObjectName":
+					continue
+				}
+				if !secretFields[k] {
+					info.Settings[k] = v
+				}
+			}
+		case "IdentifyDetail":
+			info.Identify = append(info.Identify, splitList(ev["Match"])...)
+		case "ContactStatusDetail":
+			contact := EndpointContact{
+				AOR:       ev["AOR"],
+				URI:       ev["URI"],
+				Status:    ev["Status"],
+				UserAgent: ev["UserAgent"],
+			}
+			if usec, err := strconv.ParseFloat(ev["RoundtripUsec"], 64); err == nil && usec > 0 {
+				ms := usec / 1000
+				contact.RTTms = &ms
+			}
+			info.Contacts = append(info.Contacts, contact)
+		}
+	}
+	sort.Strings(info.Identify)
+	return info, nil
+}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// OriginateResult is the response of "asterisk.originate".
+type OriginateResult struct {
+	Channel     string `json:"channel"`
+	Destination string `json:"destination"`
+	Answered    bool   `json:"answered"`
+	Message     string `json:"message"`
+	DurationMs  int64  `json:"duration_ms"`
+}
+
+// Originate is "asterisk.originate": places a call from channel (e.g.
+// "PJSIP/100" or "PJSIP/5551234@trunk") and connects it either to
+// context/exten/priority or to application/data, where application is
+// one of Playback, Dial, Echo, Milliwatt or Wait. Optional params:
+// caller_id and timeout_ms (ring time, default 20000). The command waits
+// until the call is answered or fails; give the command a timeout longer
+// than timeout_ms.
+func (c *Client) Originate(ctx context.Context, params map[string]any) (any, error) {
+	channel, err := stringParam(params, "channel", true, dialRe)
+	if err != nil {
+		return nil, err
+	}
+	dialplanContext, err := stringParam(params, "context", false, contextRe)
+	if err != nil {
+		return nil, err
+	}
+	exten, err := stringParam(params, "exten", false, extenRe)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := intParam(params, "priority", 1, 1, 9999)
+	if err != nil {
+		return nil, err
+	}
+	application, err := stringParam(params, "application", false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if application != "" {
+		name, ok := originateApplications[strings.ToLower(application)]
+		if !ok {
+			return nil, fmt.Errorf("application %q is not allowed", application)
+		}
+		application = name
+	}
+	data, err := textParam(params, "data", 255)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the data literal: no variable or function expansion.
+	if strings.Contains(data, "$") {
+		return nil, errors.New("invalid data")
+	}
+	if application == "Dial" {
+		if err := checkDialData(data); err != nil {
+			return nil, err
+		}
+	}
+	callerID, err := textParam(params, "caller_id", 80)
+	if err != nil {
+		return nil, err
+	}
+	timeoutMs, err := intParam(params, "timeout_ms", 20000, 1000, 120000)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := []header{{"Channel", channel}, {"Timeout", strconv.Itoa(timeoutMs)}, {"Async", "false"}}
+	var destination string
+	switch {
+	case application != "" && (dialplanContext != "" || exten != ""):
+		return nil, errors.New("give either context/exten or application, not both")
+	case application != "":
+		headers = append(headers, header{"Application", application})
+		if data != "" {
+			headers = append(headers, header{"Data", data})
+		}
+		destination = application + "(" + data + ")"
+	case dialplanContext != "" && exten != "":
+		headers = append(headers,
+			header{"Context", dialplanContext},
+			header{"Exten", exten},
+			header{"Priority", strconv.Itoa(priority)})
+		destination = fmt.Sprintf("%s@%s:%d", exten, dialplanContext, priority)
+	default:
+		return nil, errors.New("context and exten, or application, are required")
+	}
+	if callerID != "" {
+		headers = append(headers, header{"CallerID", callerID})
+	}
+
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.c.SetDeadline(deadline)
+	} else {
+		s.extendDeadline(time.Duration(timeoutMs)*time.Millisecond + 10*time.Second)
+	}
+	start := time.Now()
+	resp, err := s.action("Originate", headers...)
+	if err != nil {
+		return nil, err
+	}
+	result := &OriginateResult{
+		Channel:     channel,
+		Destination: destination,
+		Answered:    !resp.isError(),
+		Message:     resp["Message"],
+		DurationMs:  time.Since(start).Milliseconds(),
+	}
+	return result, nil
+}
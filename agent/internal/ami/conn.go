@@ -0,0 +1,180 @@
+// Package ami runs typed Asterisk operations over the Asterisk Manager
+// Interface. Each operation opens its own short session (login, action,
+// logoff) so no long-lived manager connection has to be kept healthy.
+package ami
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// message is one AMI packet. Keys keep Asterisk's capitalisation; repeated
+// keys keep the last value.
+type message map[string]string
+
+func (m message) isError() bool {
+	return strings.EqualFold(m["Response"], "Error")
+}
+
+// err returns the AMI error of a response, if any.
+func (m message) err() error {
+	if m.isError() {
+		msg := m["Message"]
+		if msg == "" {
+			msg = "request failed"
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+type header struct{ key, value string }
+
+type conn struct {
+	c       net.Conn
+	r       *bufio.Reader
+	version string
+}
+
+var actionSeq atomic.Uint64
+
+func dial(ctx context.Context, addr, username, secret string) (*conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	ac := &conn{c: c, r: bufio.NewReader(c)}
+	banner, err := ac.r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("read AMI banner: %w", err)
+	}
+	banner = strings.TrimSpace(banner)
+	if !strings.HasPrefix(banner, "Asterisk Call Manager/") {
+		c.Close()
+		return nil, fmt.Errorf("%s is not an Asterisk manager port (got %q)", addr, banner)
+	}
+	ac.version = strings.TrimPrefix(banner, "Asterisk Call Manager/")
+
+	// Events off: only responses to our own actions are sent.
+	resp, err := ac.action("Login", header{"Username", username}, header{"Secret", secret}, header{"Events", "off"})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := resp.err(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("AMI login: %w", err)
+	}
+	return ac, nil
+}
+
+func (c *conn) close() {
+	c.send("Logoff", "")
+	c.c.Close()
+}
+
+// send writes an action and returns its ActionID. Values containing line
+// breaks are rejected since they would inject extra headers.
+func (c *conn) send(name, id string, headers ...header) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Action: %s\r\n", name)
+	if id != "" {
+		fmt.Fprintf(&b, "ActionID: %s\r\n", id)
+	}
+	for _, h := range headers {
+		if strings.ContainsAny(h.key+h.value, "\r\n") {
+			return fmt.Errorf("%s: line break in %s", name, h.key)
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.key, h.value)
+	}
+	b.WriteString("\r\n")
+	_, err := c.c.Write([]byte(b.String()))
+	return err
+}
+
+func (c *conn) read() (message, error) {
+	m := message{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(m) == 0 {
+				continue
+			}
+			return m, nil
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+}
+
+// readFor reads until a message carrying id arrives, skipping anything else.
+func (c *conn) readFor(id string) (message, error) {
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if m["ActionID"] == id {
+			return m, nil
+		}
+	}
+}
+
+// action sends an action and returns its response.
+func (c *conn) action(name string, headers ...header) (message, error) {
+	id := "iotmonitor-" + strconv.FormatUint(actionSeq.Add(1), 10)
+	if err := c.send(name, id, headers...); err != nil {
+		return nil, err
+	}
+	return c.readFor(id)
+}
+
+// list sends an action that answers with an event list and returns the
+// events up to (not including) the completion event.
+func (c *conn) list(name string, headers ...header) ([]message, error) {
+	id := "iotmonitor-" + strconv.FormatUint(actionSeq.Add(1), 10)
+	if err := c.send(name, id, headers...); err != nil {
+		return nil, err
+	}
+	resp, err := c.readFor(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.err(); err != nil {
+		return nil, err
+	}
+	var events []message
+	for {
+		m, err := c.readFor(id)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(m["EventList"], "Complete") {
+			return events, nil
+		}
+		events = append(events, m)
+	}
+}
+
+// extendDeadline gives a slow action (Originate) more time than the
+// session default.
+func (c *conn) extendDeadline(d time.Duration) {
+	c.c.SetDeadline(time.Now().Add(d))
+}
@@ -0,0 +1,579 @@
+// Package audit follows the Linux audit subsystem and publishes a summary
+// of each matching event: who (login and effective user), what (command,
+// syscall) and on what (target path, kernel module). Records are read from
+// the kernel's read-only audit multicast group or by tailing auditd's log,
+// and the several records of one event (SYSCALL, EXECVE, CWD, PATH,
+// PROCTITLE) are joined by their serial number.
+package audit
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+const (
+	defaultLogFile      = "/var/log/audit/audit.log"
+	defaultMaxPerMinute = 300
+
+	// Events whose records don't end with an EOE record (user-space
+	// records, for example) are complete once no record has arrived for
+	// them within eventTimeout.
+	eventTimeout = time.Second
+	maxPending   = 4096
+	maxCommand   = 1024
+
+	unsetID = "4294967295"
+)
+
+// Event is published as an "audit" event for every matching audit event.
+type Event struct {
+	Type    string `json:"type"` // SYSCALL, or the user-space record type (USER_CMD ...)
+	Key     string `json:"key,omitempty"`
+	Syscall string `json:"syscall,omitempty"`
+	Success *bool  `json:"success,omitempty"`
+	// User is the login user (auid), which sudo and su don't change;
+	// RunAs is the user the process ran as.
+	User     string   `json:"user,omitempty"`
+	RunAs    string   `json:"run_as,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Exe      string   `json:"exe,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Paths    []string `json:"paths,omitempty"` // when the event names several
+	Module   string   `json:"module,omitempty"`
+	Terminal string   `json:"terminal,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	PID      int      `json:"pid,omitempty"`
+	Records  []string `json:"records"`
+	Serial   uint64   `json:"serial"`
+	// Timestamp is when the kernel logged the event.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Metrics counts published and dropped events since the agent started.
+type Metrics struct {
+	Source  string            `json:"source"`
+	Error   string            `json:"error,omitempty"`
+	Events  uint64            `json:"events"`
+	ByKey   map[string]uint64 `json:"by_key"`
+	Dropped uint64            `json:"dropped"` // over max_per_minute
+	// Lost counts netlink receive buffer overflows, each of which lost
+	// one or more records.
+	Lost      uint64 `json:"lost"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// reader delivers raw records until done is closed.
+type reader func(done <-chan struct{}, emit func(*record)) error
+
+type pending struct {
+	records []*record
+	last    time.Time
+}
+
+// Monitor reads and correlates audit records.
+type Monitor struct {
+	cfg     config.AuditConfig
+	types   map[string]bool
+	onEvent func(Event)
+	users   *userTable
+
+	records chan *record
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	pending map[uint64]*pending
+
+	mu          sync.Mutex
+	source      string
+	err         error
+	events      uint64
+	byKey       map[string]uint64
+	dropped     uint64
+	lost        uint64
+	windowStart time.Time
+	windowCount int
+}
+
+// New opens the configured source and starts following it. hostPaths,
+// when set, locate the host's audit log and passwd file.
+func New(cfg config.AuditConfig, hostPaths collect.HostPaths, onEvent func(Event)) (*Monitor, error) {
+	if cfg.MaxPerMinute <= 0 {
+		cfg.MaxPerMinute = defaultMaxPerMinute
+	}
+	if cfg.LogFile == "" {
+		cfg.LogFile = filepath.Join(hostPaths.Root, defaultLogFile)
+	}
+	etc := hostPaths.Etc
+	if etc == "" {
+		etc = "/etc"
+	}
+	m := &Monitor{
+		cfg:     cfg,
+		types:   map[string]bool{},
+		onEvent: onEvent,
+		users:   &userTable{path: filepath.Join(etc, "passwd")},
+		records: make(chan *record, 1024),
+		done:    make(chan struct{}),
+		pending: map[uint64]*pending{},
+		byKey:   map[string]uint64{},
+	}
+	for _, t := range cfg.RecordTypes {
+		m.types[normalizeType(t)] = true
+	}
+
+	var read reader
+	switch cfg.Source {
+	case "netlink":
+		r, err := openNetlink(m.addLost)
+		if err != nil {
+			return nil, err
+		}
+		m.source, read = "netlink", r
+	case "file":
+		m.source, read = "file", m.tail
+	case "":
+		r, err := openNetlink(m.addLost)
+		if err != nil {
+			log.Printf("Audit netlink unavailable (%v), tailing %s", err, cfg.LogFile)
+			m.source, read = "file", m.tail
+		} else {
+			m.source, read = "netlink", r
+		}
+	default:
+		return nil, errors.New(`audit source must be "netlink" or "file"`)
+	}
+
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		if err := read(m.done, m.emit); err != nil {
+			log.Printf("Audit %s reader stopped: %v", m.source, err)
+			m.setErr(err)
+		}
+	}()
+	go m.correlate()
+	return m, nil
+}
+
+func (m *Monitor) emit(r *record) {
+	select {
+	case m.records <- r:
+	case <-m.done:
+	}
+}
+
+func (m *Monitor) setErr(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+func (m *Monitor) addLost(n uint64) {
+	m.mu.Lock()
+	m.lost += n
+	m.mu.Unlock()
+}
+
+// correlate groups records by serial. An event is complete at its EOE
+// record or after eventTimeout without further records.
+func (m *Monitor) correlate() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(eventTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case r := <-m.records:
+			if r.typ == "EOE" {
+				m.complete(r.serial)
+				continue
+			}
+			p := m.pending[r.serial]
+			if p == nil {
+				if len(m.pending) >= maxPending {
+					m.flush(time.Time{})
+				}
+				p = &pending{}
+				m.pending[r.serial] = p
+			}
+			p.records = append(p.records, r)
+			p.last = time.Now()
+		case now := <-ticker.C:
+			m.flush(now.Add(-eventTimeout))
+		}
+	}
+}
+
+// flush completes every pending event last seen before cutoff; the zero
+// cutoff completes them all.
+func (m *Monitor) flush(cutoff time.Time) {
+	var serials []uint64
+	for serial, p := range m.pending {
+		if cutoff.IsZero() || p.last.Before(cutoff) {
+			serials = append(serials, serial)
+		}
+	}
+	slices.Sort(serials)
+	for _, serial := range serials {
+		m.complete(serial)
+	}
+}
+
+func (m *Monitor) complete(serial uint64) {
+	p := m.pending[serial]
+	delete(m.pending, serial)
+	if p == nil || len(p.records) == 0 {
+		return
+	}
+	ev := m.summarize(p.records)
+	if !m.matches(ev) || !m.allow(ev) {
+		return
+	}
+	if m.onEvent != nil {
+		m.onEvent(ev)
+	}
+}
+
+// matches applies the key and record type filters.
+func (m *Monitor) matches(ev Event) bool {
+	if len(m.cfg.Keys) == 0 && len(m.types) == 0 {
+		return ev.Key != ""
+	}
+	for _, k := range strings.Split(ev.Key, ",") {
+		if k != "" && slices.Contains(m.cfg.Keys, k) {
+			return true
+		}
+	}
+	for _, t := range ev.Records {
+		if m.types[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// allow counts the event and enforces max_per_minute.
+func (m *Monitor) allow(ev Event) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.windowStart) >= time.Minute {
+		m.windowStart, m.windowCount = now, 0
+	}
+	if m.windowCount >= m.cfg.MaxPerMinute {
+		m.dropped++
+		return false
+	}
+	m.windowCount++
+	m.events++
+	if ev.Key != "" {
+		m.byKey[ev.Key]++
+	}
+	return true
+}
+
+// summarize reduces an event's records to one Event.
+func (m *Monitor) summarize(records []*record) Event {
+	first := records[0]
+	ev := Event{Serial: first.serial, Timestamp: first.time.Unix()}
+	for _, r := range records {
+		if !slices.Contains(ev.Records, r.typ) {
+			ev.Records = append(ev.Records, r.typ)
+		}
+	}
+
+	// The record describing the action: SYSCALL for kernel events, the
+	// user-space record otherwise. PATH, CWD and friends only add detail.
+	main := first
+	for _, r := range records {
+		if !detailRecord(r.typ) {
+			main = r
+			break
+		}
+	}
+	ev.Type = main.typ
+	f := main.fields
+
+	if k := f["key"]; k != "" && k != "(null)" {
+		ev.Key = k
+	}
+	if s := f["SYSCALL"]; s != "" {
+		ev.Syscall = s
+	} else if s := f["syscall"]; s != "" {
+		ev.Syscall = syscallName(f["arch"], s)
+	}
+	switch {
+	case f["success"] != "":
+		ok := f["success"] == "yes"
+		ev.Success = &ok
+	case f["res"] != "":
+		ok := f["res"] == "success" || f["res"] == "1"
+		ev.Success = &ok
+	}
+	ev.User = m.userName(f, "auid", "AUID")
+	ev.RunAs = m.userName(f, "uid", "UID")
+	if ev.User == "" {
+		ev.User = ev.RunAs
+	}
+	ev.Exe = f["exe"]
+	ev.PID, _ = strconv.Atoi(f["pid"])
+	if t := f["terminal"]; t != "" && t != "?" {
+		ev.Terminal = t
+	} else if t := f["tty"]; t != "" && t != "(none)" {
+		ev.Terminal = t
+	}
+	if a := f["addr"]; a != "" && a != "?" {
+		ev.Address = a
+	}
+
+	var cwd string
+	var normal, parents []string
+	for _, r := range records {
+		switch r.typ {
+		case "EXECVE":
+			ev.Command = execveCommand(r.fields)
+		case "PROCTITLE":
+			if ev.Command == "" {
+				ev.Command = r.fields["proctitle"]
+			}
+		case "CWD":
+			cwd = r.fields["cwd"]
+		case "KERN_MODULE":
+			ev.Module = r.fields["name"]
+		case "PATH":
+			name := r.fields["name"]
+			if name == "" || name == "(null)" {
+				continue
+			}
+			if r.fields["nametype"] == "PARENT" {
+				parents = append(parents, name)
+			} else {
+				normal = append(normal, name)
+			}
+		}
+	}
+	if ev.Command == "" {
+		ev.Command = f["cmd"] // USER_CMD (sudo)
+	}
+	if ev.Command == "" {
+		ev.Command = f["comm"]
+	}
+	if len(ev.Command) > maxCommand {
+		ev.Command = ev.Command[:maxCommand]
+	}
+
+	paths := normal
+	if len(paths) == 0 {
+		paths = parents
+	}
+	for i, p := range paths {
+		if !strings.HasPrefix(p, "/") && cwd != "" {
+			paths[i] = path.Join(cwd, p)
+		}
+	}
+	if len(paths) > 0 {
+		ev.Path = paths[0]
+	}
+	if len(paths) > 1 {
+		ev.Paths = paths
+	}
+	return ev
+}
+
+func detailRecord(typ string) bool {
+	switch typ {
+	case "PATH", "CWD", "EXECVE", "PROCTITLE", "SOCKADDR":
+		return true
+	}
+	return false
+}
+
+// execveCommand rebuilds the command line from an EXECVE record. Long
+// arguments are split into a<n>[0], a<n>[1], ...
+func execveCommand(f map[string]string) string {
+	argc, _ := strconv.Atoi(f["argc"])
+	var b strings.Builder
+	for i := 0; i < argc && b.Len() < maxCommand; i++ {
+		key := "a" + strconv.Itoa(i)
+		arg, ok := f[key]
+		if !ok {
+			for j := 0; ; j++ {
+				part, ok := f[key+"["+strconv.Itoa(j)+"]"]
+				if !ok {
+					break
+				}
+				arg += part
+			}
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(arg)
+	}
+	return b.String()
+}
+
+// userName resolves a uid field, preferring the name auditd enriched the
+// record with.
+func (m *Monitor) userName(f map[string]string, key, enriched string) string {
+	id := f[key]
+	if id == "" || id == unsetID || id == "-1" {
+		return ""
+	}
+	if name := f[enriched]; name != "" && name != "unset" {
+		return name
+	}
+	return m.users.lookup(id)
+}
+
+// Collect returns the event counters.
+func (m *Monitor) Collect() *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics := &Metrics{
+		Source:    m.source,
+		Events:    m.events,
+		ByKey:     make(map[string]uint64, len(m.byKey)),
+		Dropped:   m.dropped,
+		Lost:      m.lost,
+		Timestamp: time.Now().Unix(),
+	}
+	for k, v := range m.byKey {
+		metrics.ByKey[k] = v
+	}
+	if m.err != nil {
+		metrics.Error = m.err.Error()
+	}
+	return metrics
+}
+
+// Close stops reading.
+func (m *Monitor) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+// tail follows the audit log from its current end, reopening it when
+// auditd rotates or truncates it.
+func (m *Monitor) tail(done <-chan struct{}, emit func(*record)) error {
+	var (
+		f      *os.File
+		r      *bufio.Reader
+		offset int64
+		line   []byte
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	open := func(fromEnd bool) error {
+		nf, err := os.Open(m.cfg.LogFile)
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			f.Close()
+		}
+		f, r, offset, line = nf, bufio.NewReader(nf), 0, line[:0]
+		if fromEnd {
+			offset, err = f.Seek(0, 2)
+		}
+		return err
+	}
+	if err := open(true); err != nil {
+		m.setErr(err)
+	}
+
+	poll := time.NewTicker(500 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		if f != nil {
+			for {
+				chunk, err := r.ReadSlice('\n')
+				offset += int64(len(chunk))
+				line = append(line, chunk...)
+				if err == bufio.ErrBufferFull {
+					continue
+				}
+				if err != nil {
+					break // partial line stays in line until the rest arrives
+				}
+				if rec, err := parseLine(strings.TrimRight(string(line), "\n")); err == nil {
+					emit(rec)
+				}
+				line = line[:0]
+			}
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-poll.C:
+		}
+
+		st, err := os.Stat(m.cfg.LogFile)
+		switch {
+		case err != nil:
+			// Between rotation and auditd creating the new file.
+			continue
+		case f == nil:
+			if err := open(false); err == nil {
+				m.setErr(nil)
+			}
+		default:
+			cur, err := f.Stat()
+			if err != nil || !os.SameFile(cur, st) || st.Size() < offset {
+				if err := open(false); err != nil {
+					m.setErr(err)
+				}
+			}
+		}
+	}
+}
+
+// userTable maps uids to names from a passwd file, rereading it at most
+// once a minute when a uid is missing.
+type userTable struct {
+	path   string
+	mu     sync.Mutex
+	names  map[string]string
+	loaded time.Time
+}
+
+func (u *userTable) lookup(uid string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if name, ok := u.names[uid]; ok {
+		return name
+	}
+	if time.Since(u.loaded) >= time.Minute {
+		u.loaded = time.Now()
+		u.names = map[string]string{}
+		if data, err := os.ReadFile(u.path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				fields := strings.Split(line, ":")
+				if len(fields) > 2 {
+					u.names[fields[2]] = fields[0]
+				}
+			}
+		}
+		if name, ok := u.names[uid]; ok {
+			return name
+		}
+	}
+	return uid
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package audit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// auditNLGroupReadlog is the read-only multicast group (Linux 3.16+). It
+// receives every record without taking the audit daemon's place, so it
+// coexists with auditd.
+const auditNLGroupReadlog = 1
+
+// openNetlink joins the audit multicast group. lost is called with the
+// number of records dropped when the socket buffer overflows.
+func openNetlink(lost func(uint64)) (reader, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_AUDIT)
+	if err != nil {
+		return nil, fmt.Errorf("audit netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: auditNLGroupReadlog}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("join audit multicast group (needs CAP_AUDIT_READ): %w", err)
+	}
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 1<<20)
+	// Wake up every second to notice Close.
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1})
+
+	return func(done <-chan struct{}, emit func(*record)) error {
+		defer unix.Close(fd)
+		buf := make([]byte, 1<<16)
+		for {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				switch {
+				case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+				case errors.Is(err, unix.ENOBUFS):
+					lost(1)
+				default:
+					return err
+				}
+				continue
+			}
+			if n < syscall.NLMSG_HDRLEN {
+				continue
+			}
+			// One record per datagram. The kernel doesn't always set
+			// nlmsg_len correctly for audit records, so the header's
+			// length is ignored.
+			typ := binary.NativeEndian.Uint16(buf[4:6])
+			text := strings.TrimRight(string(buf[syscall.NLMSG_HDRLEN:n]), "\x00\n")
+			rec, err := parseRecord(typeName(typ), text)
+			if err != nil {
+				continue
+			}
+			emit(rec)
+		}
+	}, nil
+}
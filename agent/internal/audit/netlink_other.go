@@ -0,0 +1,9 @@
+//go:build !linux
+
+package audit
+
+import "errors"
+
+func openNetlink(func(uint64)) (reader, error) {
+	return nil, errors.New("audit netlink is only supported on Linux")
+}
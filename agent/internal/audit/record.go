@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record is one audit record. Records of the same event share serial.
+type record struct {
+	typ    string
+	time   time.Time
+	serial uint64
+	fields map[string]string
+}
+
+// recordTypes names the record types the module looks at; others are
+// reported as UNKNOWN[n] like ausearch does.
+var recordTypes = map[uint16]string{
+	1006: "LOGIN",
+	1100: "USER_AUTH",
+	1101: "USER_ACCT",
+	1103: "CRED_DISP",
+	1104: "CRED_ACQ",
+	1105: "USER_START",
+	1106: "USER_END",
+	1108: "USER_CHAUTHTOK",
+	1112: "USER_LOGIN",
+	1113: "USER_LOGOUT",
+	1114: "ADD_USER",
+	1115: "DEL_USER",
+	1116: "ADD_GROUP",
+	1117: "DEL_GROUP",
+	1123: "USER_CMD",
+	1130: "SERVICE_START",
+	1131: "SERVICE_STOP",
+	1300: "SYSCALL",
+	1302: "PATH",
+	1305: "CONFIG_CHANGE",
+	1306: "SOCKADDR",
+	1307: "CWD",
+	1309: "EXECVE",
+	1320: "EOE",
+	1327: "PROCTITLE",
+	1330: "KERN_MODULE",
+	1701: "ANOM_ABEND",
+	1702: "ANOM_LINK",
+}
+
+func typeName(t uint16) string {
+	if name, ok := recordTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN[%d]", t)
+}
+
+// normalizeType turns a configured record type ("user_cmd", "1123") into
+// the name records are matched by.
+func normalizeType(s string) string {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return typeName(uint16(n))
+	}
+	return strings.ToUpper(s)
+}
+
+// parseLine parses an audit.log line:
+//
+//	type=SYSCALL msg=audit(1700000000.123:456): arch=c000003e syscall=59 ...
+func parseLine(line string) (*record, error) {
+	_, rest, ok := strings.Cut(line, "type=")
+	if !ok {
+		return nil, fmt.Errorf("no record type in %q", line)
+	}
+	typ, rest, ok := strings.Cut(rest, " msg=")
+	if !ok {
+		return nil, fmt.Errorf("no msg in %q", line)
+	}
+	return parseRecord(typ, rest)
+}
+
+// parseRecord parses the "audit(<sec>.<ms>:<serial>): fields" text that
+// both netlink messages and log lines carry.
+func parseRecord(typ, text string) (*record, error) {
+	rest, ok := strings.CutPrefix(text, "audit(")
+	if !ok {
+		return nil, fmt.Errorf("%s record without audit header", typ)
+	}
+	header, body, ok := strings.Cut(rest, "):")
+	if !ok {
+		return nil, fmt.Errorf("%s record with malformed header", typ)
+	}
+	stamp, serial, ok := strings.Cut(header, ":")
+	if !ok {
+		return nil, fmt.Errorf("%s record with malformed header", typ)
+	}
+	secs, millis, _ := strings.Cut(stamp, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s record timestamp: %w", typ, err)
+	}
+	ms, _ := strconv.ParseInt(millis, 10, 64)
+	r := &record{typ: typ, time: time.Unix(sec, ms*int64(time.Millisecond)), fields: map[string]string{}}
+	if r.serial, err = strconv.ParseUint(serial, 10, 64); err != nil {
+		return nil, fmt.Errorf("%s record serial: %w", typ, err)
+	}
+	// auditd's ENRICHED format appends resolved values (AUID="alice")
+	// after a 0x1d separator; their upper-case keys don't collide.
+	raw, enriched, _ := strings.Cut(body, "\x1d")
+	parseFields(typ, raw, r.fields)
+	parseFields(typ, enriched, r.fields)
+	return r, nil
+}
+
+// parseFields parses key=value pairs. Values are double-quoted strings,
+// hex-encoded strings (for untrusted text with spaces or control
+// characters) or bare tokens. The msg='...' field of user-space records
+// holds nested pairs, which are merged in.
+func parseFields(typ, s string, into map[string]string) {
+	for {
+		s = strings.TrimLeft(s, " ")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return
+		}
+		key := s[:eq]
+		if i := strings.LastIndexByte(key, ' '); i >= 0 {
+			key = key[i+1:]
+		}
+		s = s[eq+1:]
+
+		var val string
+		switch {
+		case strings.HasPrefix(s, `"`), strings.HasPrefix(s, "'"):
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:1+end], s[end+2:]
+			}
+			if key == "msg" && strings.Contains(val, "=") {
+				parseFields(typ, val, into)
+				continue
+			}
+		default:
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+			val = decodeHex(typ, key, val)
+		}
+		into[key] = val
+	}
+}
+
+// decodeHex decodes the unquoted hex form the kernel uses for string
+// fields whose value isn't safe to print.
+func decodeHex(typ, key, val string) string {
+	if !hexField(typ, key) || len(val)%2 != 0 || val == "" {
+		return val
+	}
+	b, err := hex.DecodeString(val)
+	if err != nil {
+		return val
+	}
+	switch key {
+	case "proctitle":
+		return strings.TrimRight(strings.ReplaceAll(string(b), "\x00", " "), " ")
+	case "key":
+		// Several keys on one rule are separated by 0x01.
+		return strings.ReplaceAll(string(b), "\x01", ",")
+	}
+	return string(b)
+}
+
+func hexField(typ, key string) bool {
+	switch key {
+	case "comm", "exe", "name", "cwd", "proctitle", "key", "cmd", "acct", "data", "path":
+		return true
+	}
+	// EXECVE arguments: a0, a1, a1[0] ... (a0-a3 of SYSCALL records are
+	// raw syscall arguments).
+	if typ == "EXECVE" && len(key) > 1 && key[0] == 'a' && key[1] >= '0' && key[1] <= '9' {
+		return true
+	}
+	return false
+}
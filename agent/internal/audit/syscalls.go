@@ -0,0 +1,41 @@
+package audit
+
+import "strconv"
+
+// syscallNames covers the syscalls compliance rules usually watch, per
+// audit arch; other numbers are reported as-is. Logs written in auditd's
+// ENRICHED format carry the name in SYSCALL= and don't need the table.
+var syscallNames = map[string]map[int]string{
+	"c000003e": { // x86_64
+		2: "open", 59: "execve", 76: "truncate", 82: "rename", 85: "creat",
+		86: "link", 87: "unlink", 88: "symlink", 90: "chmod", 92: "chown",
+		105: "setuid", 165: "mount", 175: "init_module", 176: "delete_module",
+		257: "openat", 260: "fchownat", 263: "unlinkat", 264: "renameat",
+		268: "fchmodat", 313: "finit_module", 316: "renameat2", 322: "execveat",
+		437: "openat2",
+	},
+	"c00000b7": { // aarch64
+		35: "unlinkat", 36: "symlinkat", 37: "linkat", 38: "renameat",
+		40: "mount", 45: "truncate", 53: "fchmodat", 54: "fchownat",
+		56: "openat", 105: "init_module", 106: "delete_module", 146: "setuid",
+		221: "execve", 273: "finit_module", 276: "renameat2", 281: "execveat",
+		437: "openat2",
+	},
+	"40000028": { // arm
+		5: "open", 10: "unlink", 11: "execve", 15: "chmod", 21: "mount",
+		38: "rename", 128: "init_module", 129: "delete_module", 322: "openat",
+		328: "unlinkat", 329: "renameat", 333: "fchmodat", 379: "finit_module",
+		387: "execveat",
+	},
+}
+
+func syscallName(arch, nr string) string {
+	n, err := strconv.Atoi(nr)
+	if err != nil {
+		return nr
+	}
+	if name, ok := syscallNames[arch][n]; ok {
+		return name
+	}
+	return nr
+}
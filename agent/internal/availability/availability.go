@@ -0,0 +1,270 @@
+// Package availability computes rolling uptime, outage counts and MTTR for
+// probe targets and services from what the agent itself observed, so SLA
+// reports are not skewed by gaps in what reached the backend.
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// retention bounds how much history is kept per target.
+	retention = 31 * 24 * time.Hour
+	// Targets not observed for this long are forgotten.
+	forgetAfter = retention
+	saveEvery   = time.Minute
+)
+
+// Windows reported for every target.
+var windows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+}
+
+// span is a closed interval of unix seconds.
+type span struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type targetState struct {
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Up       bool   `json:"up"`
+	Since    int64  `json:"since"`
+	LastSeen int64  `json:"last_seen"`
+	// Coverage lists the periods the target was being observed; time outside
+	// it (agent stopped, module disabled) counts neither as up nor down.
+	Coverage []span `json:"coverage"`
+	Outages  []span `json:"outages"`
+	Ongoing  bool   `json:"ongoing"`
+}
+
+// WindowStats summarises one rolling window.
+type WindowStats struct {
+	// UptimePct is nil when the target was not observed in the window.
+	UptimePct   *float64 `json:"uptime_pct"`
+	ObservedSec int64    `json:"observed_sec"`
+	DowntimeSec int64    `json:"downtime_sec"`
+	Outages     int      `json:"outages"`
+	MTTRSec     *float64 `json:"mttr_sec,omitempty"`
+}
+
+type TargetAvailability struct {
+	Kind    string                 `json:"kind"`
+	Target  string                 `json:"target"`
+	Up      bool                   `json:"up"`
+	Since   int64                  `json:"since"`
+	Windows map[string]WindowStats `json:"windows"`
+}
+
+type Metrics struct {
+	Targets   []TargetAvailability `json:"targets"`
+	Timestamp int64                `json:"timestamp"`
+}
+
+// Tracker accumulates up/down observations and persists them to a state
+// file so windows survive agent restarts.
+type Tracker struct {
+	path   string
+	maxGap int64
+
+	mu       sync.Mutex
+	targets  map[string]*targetState
+	lastSave time.Time
+}
+
+// New loads previous state from path (if any). interval is how often
+// targets are observed; observations further apart than three intervals
+// are treated as a gap in coverage rather than continuous state.
+func New(path string, interval time.Duration) *Tracker {
+	t := &Tracker{
+		path:    path,
+		maxGap:  int64((3 * interval).Seconds()),
+		targets: map[string]*targetState{},
+	}
+	if path == "" {
+		return t
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("availability: read %s: %v", path, err)
+		}
+		return t
+	}
+	if err := json.Unmarshal(data, &t.targets); err != nil {
+		log.Printf("availability: ignoring corrupt state %s: %v", path, err)
+		t.targets = map[string]*targetState{}
+	}
+	return t
+}
+
+// Record adds one observation of a target.
+func (t *Tracker) Record(kind, target string, up bool, at time.Time) {
+	now := at.Unix()
+	key := kind + ":" + target
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.targets[key]
+	if st == nil {
+		st = &targetState{Kind: kind, Target: target, Up: up, Since: now}
+		t.targets[key] = st
+	}
+	if now < st.LastSeen {
+		return
+	}
+
+	contiguous := st.LastSeen > 0 && now-st.LastSeen <= t.maxGap
+	if contiguous {
+		st.Coverage[len(st.Coverage)-1].End = now
+		if st.Ongoing {
+			// The outage lasts until the first successful observation.
+			st.Outages[len(st.Outages)-1].End = now
+			st.Ongoing = !up
+		} else if !up {
+			st.Outages = append(st.Outages, span{now, now})
+			st.Ongoing = true
+		}
+	} else {
+		// After a gap the outage (if any) is closed at the last time it was
+		// actually seen; we don't know what happened in between.
+		st.Ongoing = false
+		st.Coverage = append(st.Coverage, span{now, now})
+		if !up {
+			st.Outages = append(st.Outages, span{now, now})
+			st.Ongoing = true
+		}
+	}
+	if up != st.Up {
+		st.Since = now
+	}
+	st.Up = up
+	st.LastSeen = now
+}
+
+func overlap(s span, from, to int64) int64 {
+	start, end := max(s.Start, from), min(s.End, to)
+	if end <= start {
+		return 0
+	}
+	return end - start
+}
+
+func (st *targetState) window(from, to int64) WindowStats {
+	var ws WindowStats
+	for _, c := range st.Coverage {
+		ws.ObservedSec += overlap(c, from, to)
+	}
+	var repaired, repairSec int64
+	for i, o := range st.Outages {
+		if o.End < from || o.Start > to {
+			continue
+		}
+		ws.Outages++
+		ws.DowntimeSec += overlap(o, from, to)
+		if ongoing := st.Ongoing && i == len(st.Outages)-1; !ongoing {
+			repaired++
+			repairSec += o.End - o.Start
+		}
+	}
+	if ws.ObservedSec > 0 {
+		pct := 100 * float64(ws.ObservedSec-ws.DowntimeSec) / float64(ws.ObservedSec)
+		ws.UptimePct = &pct
+	}
+	if repaired > 0 {
+		mttr := float64(repairSec) / float64(repaired)
+		ws.MTTRSec = &mttr
+	}
+	return ws
+}
+
+func prune(spans []span, cutoff int64) []span {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].End >= cutoff })
+	return spans[i:]
+}
+
+// Collect computes every window for every target, drops expired history
+// and persists the state at most once a minute.
+func (t *Tracker) Collect() *Metrics {
+	now := time.Now()
+	to := now.Unix()
+	cutoff := now.Add(-retention).Unix()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := &Metrics{Targets: []TargetAvailability{}, Timestamp: to}
+	for key, st := range t.targets {
+		if st.LastSeen < now.Add(-forgetAfter).Unix() {
+			delete(t.targets, key)
+			continue
+		}
+		st.Coverage = prune(st.Coverage, cutoff)
+		st.Outages = prune(st.Outages, cutoff)
+
+		ta := TargetAvailability{
+			Kind:    st.Kind,
+			Target:  st.Target,
+			Up:      st.Up,
+			Since:   st.Since,
+			Windows: make(map[string]WindowStats, len(windows)),
+		}
+		for _, w := range windows {
+			ta.Windows[w.name] = st.window(now.Add(-w.d).Unix(), to)
+		}
+		metrics.Targets = append(metrics.Targets, ta)
+	}
+	sort.Slice(metrics.Targets, func(i, j int) bool {
+		a, b := metrics.Targets[i], metrics.Targets[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Target < b.Target
+	})
+
+	if now.Sub(t.lastSave) >= saveEvery {
+		if err := t.saveLocked(); err != nil {
+			log.Printf("availability: save %s: %v", t.path, err)
+		}
+		t.lastSave = now
+	}
+	return metrics
+}
+
+func (t *Tracker) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(t.targets)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// Close persists the current state.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.saveLocked()
+}
@@ -0,0 +1,83 @@
+package availability
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// Target kinds recorded by the Observe helpers.
+const (
+	KindPing            = "ping"
+	KindPort            = "port"
+	KindHTTP            = "http"
+	KindUplink          = "uplink"
+	KindContainerProbe  = "container_probe"
+	KindContainer       = "container"
+	KindService         = "service"
+	KindAsterisk        = "asterisk"
+	KindSIPRegistration = "sip_registration"
+)
+
+// ObserveNetwork records every ping, port, HTTP, uplink and container probe
+// in a sample.
+func (t *Tracker) ObserveNetwork(m *collect.NetworkMetrics) {
+	now := time.Now()
+	for _, p := range m.PingResults {
+		t.Record(KindPing, p.Host, p.Success, now)
+	}
+	for _, p := range m.PortResults {
+		t.Record(KindPort, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), p.Open, now)
+	}
+	for _, h := range m.HTTPResults {
+		t.Record(KindHTTP, h.URL, h.Success, now)
+	}
+	for _, u := range m.Uplinks {
+		t.Record(KindUplink, u.Name, u.Up, now)
+	}
+	for _, cp := range m.ContainerProbes {
+		for _, p := range cp.PortResults {
+			t.Record(KindContainerProbe, cp.Container+"/"+net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), p.Open, now)
+		}
+		for _, h := range cp.HTTPResults {
+			t.Record(KindContainerProbe, cp.Container+"/"+h.URL, h.Success, now)
+		}
+	}
+}
+
+// ObserveContainers records each container as a service that is up while
+// running.
+func (t *Tracker) ObserveContainers(containers []collect.ContainerInfo) {
+	now := time.Now()
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		t.Record(KindContainer, name, c.State == "running", now)
+	}
+}
+
+// ObserveServices records each label-discovered container service.
+func (t *Tracker) ObserveServices(services []collect.ServiceResult) {
+	now := time.Now()
+	for _, s := range services {
+		t.Record(KindService, s.Container+"/"+s.Check, s.Up, now)
+	}
+}
+
+// ObserveAsterisk records Asterisk itself (up when its CLI answered) and
+// each outbound SIP registration.
+func (t *Tracker) ObserveAsterisk(m *collect.AsteriskPJSIPMetrics, err error) {
+	now := time.Now()
+	t.Record(KindAsterisk, "asterisk", err == nil, now)
+	if m == nil {
+		return
+	}
+	for _, r := range m.Registrations {
+		t.Record(KindSIPRegistration, r.Name, strings.EqualFold(r.Status, "Registered"), now)
+	}
+}
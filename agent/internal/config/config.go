@@ -2,15 +2,23 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+
+	"github.com/iotmonitor/agent/pkg/collect"
 )
 
 type Config struct {
 	DeviceID          string `json:"device_id"`
-	AgentToken        string `json:"agent_token"`
-	MQTTURL           string `json:"mqtt_url"`
+	AgentToken        string `json:"agent_token" secret:"true" secretdest:"mqtt_url,mqtt_port,use_tls,proxy"`
+	MQTTURL           string `json:"mqtt_url" secret:"userinfo"`
 	MQTTUsername      string `json:"mqtt_username"`
-	MQTTPassword      string `json:"mqtt_password"`
+	MQTTPassword      string `json:"mqtt_password" secret:"true" secretdest:"mqtt_url,mqtt_port,use_tls,proxy"`
 	MQTTPort          int    `json:"mqtt_port"`
 	UseTLS            bool   `json:"use_tls"`
 	MQTTPrefix        string `json:"mqtt_prefix"`
@@ -18,6 +26,402 @@ type Config struct {
 	EnabledModules    string `json:"enabled_modules"`
 	AsteriskContainer string `json:"asterisk_container"`
 	PingHost          string `json:"ping_host"`
+
+	// IntervalSec is the collection interval (default 10).
+	IntervalSec int `json:"interval_sec"`
+
+	// Roles name profiles (built-in, or <name>.json in ProfilesDir) whose
+	// modules, interval and settings this device takes; its own settings
+	// override them. Profile is what they resolved to.
+	Roles       []string         `json:"roles"`
+	ProfilesDir string           `json:"profiles_dir"`
+	Profile     *ResolvedProfile `json:"-"`
+
+	// DiskPath is the mount point reported as disk usage (default "/").
+	DiskPath string `json:"disk_path"`
+	// HostMode makes the collectors read the host's /proc, /sys, /etc and
+	// root filesystem from HostPaths when the agent runs in a container.
+	HostMode  bool              `json:"host_mode"`
+	HostPaths collect.HostPaths `json:"host_paths"`
+
+	// Proxy for broker connections, public IP discovery and HTTP checks.
+	// When unset, HTTP_PROXY/HTTPS_PROXY/ALL_PROXY/NO_PROXY apply.
+	Proxy collect.Proxy `json:"proxy"`
+
+	// Additional network module probes.
+	PortChecks []collect.PortTarget `json:"port_checks"`
+	HTTPChecks []collect.HTTPTarget `json:"http_checks"`
+	// Uplinks lists the WAN links of a multi-homed site; ping hosts and
+	// port checks are repeated over each of them.
+	Uplinks []collect.Uplink `json:"uplinks"`
+	// ContainerChecks run DNS/TCP/HTTP checks inside containers' network
+	// namespaces.
+	ContainerChecks []collect.ContainerTarget `json:"container_checks"`
+
+	// Dependencies attribute downstream failures to a failing upstream
+	// target so the backend can alert once on the root cause.
+	Dependencies []Dependency `json:"dependencies"`
+
+	// Per-process connection map; ConnectionWatch lists process names that
+	// raise an event when they contact a new remote endpoint.
+	ConnectionMap   bool     `json:"connection_map"`
+	ConnectionWatch []string `json:"connection_watch"`
+
+	// AsteriskAMI enables the typed asterisk.* commands over the manager
+	// interface.
+	AsteriskAMI AsteriskAMIConfig `json:"asterisk_ami"`
+
+	// CommandPolicy restricts which typed commands the backend may run.
+	CommandPolicy CommandPolicy `json:"command_policy"`
+
+	// Sparkplug publishes metrics as Sparkplug B instead of JSON.
+	Sparkplug SparkplugConfig `json:"sparkplug"`
+
+	// FileSink keeps a copy of everything published in local files, or
+	// replaces the broker entirely at air-gapped sites.
+	FileSink FileSinkConfig `json:"file_sink"`
+
+	// Optional payload encryption so the broker operator can't read
+	// telemetry or commands.
+	E2EEnabled           bool   `json:"e2e_enabled"`
+	E2EKeyFile           string `json:"e2e_key_file"`
+	E2EBackendPublicKey  string `json:"e2e_backend_public_key"`
+	E2EBackendSigningKey string `json:"e2e_backend_signing_key"`
+
+	// Local setup/status web UI for on-site technicians. The setup code
+	// is required to log in; a random one is generated and logged when
+	// unset.
+	LocalUI          bool   `json:"local_ui"`
+	LocalUIAddr      string `json:"local_ui_addr"`
+	LocalUISetupCode string `json:"local_ui_setup_code" secret:"true"`
+
+	// AvailabilityFile persists the availability module's outage history.
+	AvailabilityFile string `json:"availability_file"`
+
+	GPIO      GPIOConfig      `json:"gpio"`
+	IoTBridge IoTBridgeConfig `json:"iotbridge"`
+	OPCUA     []OPCUAServer   `json:"opcua"`
+
+	// Fallback delivers critical alerts directly while the broker is
+	// unreachable.
+	Fallback FallbackConfig `json:"fallback"`
+
+	Audit AuditConfig `json:"audit"`
+
+	// DesiredState enforces a declared state of containers, systemd
+	// units and files.
+	DesiredState DesiredStateConfig `json:"desired_state"`
+
+	// HA reports keepalived and Pacemaker cluster state.
+	HA HAConfig `json:"ha"`
+
+	// Storage probes fsync and small random I/O latency.
+	Storage StorageConfig `json:"storage"`
+}
+
+// Dependency declares that the targets matching Target depend on every
+// target in DependsOn. Targets are "<kind>:<name>" keys in which "*"
+// matches any text:
+//
+//	ping:<host>                 port:<host>:<port>        http:<url>
+//	uplink:<name>               container:<name>          service:<container>/<check>
+//	container_probe:<container>/<host>:<port> or /<url>
+//	asterisk                    sip_registration:<name>   sip_contact:<aor>/<uri>
+type Dependency struct {
+	Target    string   `json:"target"`
+	DependsOn []string `json:"depends_on"`
+}
+
+// AsteriskAMIConfig is an Asterisk manager.conf user. It needs the
+// "system", "call" and "originate" write classes for the typed commands;
+// asterisk.originate only connects calls to a fixed set of applications,
+// never to ones that run shell commands.
+type AsteriskAMIConfig struct {
+	Address  string `json:"address"` // host:port, default 127.0.0.1:5038
+	Username string `json:"username"`
+	Secret   string `json:"secret" secret:"true" secretdest:"address"`
+}
+
+// CommandPolicy gates typed commands by name. Entries are exact names
+// ("asterisk.hangup_channel") or prefixes ending in ".*" ("asterisk.*").
+// Deny wins over Allow; an empty Allow permits every command not denied,
+// except the opt-in commands, which run only when Allow names them exactly.
+type CommandPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// optInCommands act on live calls and are never permitted by default or
+// by a wildcard.
+var optInCommands = []string{"asterisk.originate", "asterisk.hangup_channel"}
+
+func policyMatch(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == "*" || p == name {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasSuffix(prefix, ".") && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether the typed command name may run.
+func (p CommandPolicy) Permits(name string) bool {
+	if policyMatch(p.Deny, name) {
+		return false
+	}
+	if slices.Contains(optInCommands, name) {
+		return slices.Contains(p.Allow, name)
+	}
+	return len(p.Allow) == 0 || policyMatch(p.Allow, name)
+}
+
+// GPIOInput is a dry-contact input (door switch, flood sensor) read through
+// the GPIO character device.
+type GPIOInput struct {
+	Name       string `json:"name"`
+	Chip       string `json:"chip"` // e.g. "gpiochip0"
+	Line       int    `json:"line"`
+	ActiveLow  bool   `json:"active_low"`
+	Bias       string `json:"bias"` // "pull_up", "pull_down" or "disabled"
+	DebounceMs int    `json:"debounce_ms"`
+}
+
+// BME280Sensor is a temperature/humidity/pressure sensor on an I2C bus.
+type BME280Sensor struct {
+	Name    string `json:"name"`
+	Bus     int    `json:"bus"`     // /dev/i2c-<bus>
+	Address int    `json:"address"` // usually 0x76 or 0x77
+}
+
+// GPIOConfig configures the gpio module for single-board agents.
+type GPIOConfig struct {
+	Inputs []GPIOInput `json:"inputs"`
+	// OneWire enables DS18B20 discovery under /sys/bus/w1/devices;
+	// OneWireNames optionally maps sensor IDs (28-xxxx) to friendly names.
+	OneWire      bool              `json:"one_wire"`
+	OneWireNames map[string]string `json:"one_wire_names"`
+	BME280       []BME280Sensor    `json:"bme280"`
+}
+
+// BridgeCommand maps a backend command onto a LAN MQTT publish. "{device}"
+// in Topic is replaced by the device name and "{value}" in Payload by the
+// value's JSON encoding; a Payload of just "{value}" takes a string value
+// unquoted.
+type BridgeCommand struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// BridgeTemplate maps messages from a family of LAN devices to metrics.
+// Topic is an MQTT filter where "{device}" marks the level that identifies
+// the device; Fields maps metric names to dot-separated JSON paths ("" maps
+// the whole payload). Preset fills unset parts from a built-in template
+// ("tasmota", "zigbee2mqtt", "shelly").
+type BridgeTemplate struct {
+	Name           string                   `json:"name"`
+	Preset         string                   `json:"preset"`
+	Topic          string                   `json:"topic"`
+	Fields         map[string]string        `json:"fields"`
+	Commands       map[string]BridgeCommand `json:"commands"`
+	ExcludeDevices []string                 `json:"exclude_devices"`
+}
+
+// IoTBridgeConfig connects the iotbridge module to a site's local broker.
+type IoTBridgeConfig struct {
+	BrokerURL string           `json:"broker_url" secret:"userinfo"`
+	Username  string           `json:"username"`
+	Password  string           `json:"password" secret:"true" secretdest:"broker_url"`
+	ClientID  string           `json:"client_id"`
+	Templates []BridgeTemplate `json:"templates"`
+}
+
+// OPCUANode is a PLC value read by the opcua module. Numeric values are
+// reported as raw*Scale + Offset.
+type OPCUANode struct {
+	Name   string  `json:"name"`
+	NodeID string  `json:"node_id"` // e.g. "ns=2;s=Line1.Temperature"
+	Unit   string  `json:"unit"`
+	Scale  float64 `json:"scale"` // 0 means 1
+	Offset float64 `json:"offset"`
+}
+
+// OPCUAServer is one OPC UA endpoint polled (or subscribed to) by the opcua
+// module.
+type OPCUAServer struct {
+	Name           string `json:"name"`
+	Endpoint       string `json:"endpoint"`        // opc.tcp://host:4840
+	SecurityPolicy string `json:"security_policy"` // None, Basic256Sha256, ...
+	SecurityMode   string `json:"security_mode"`   // None, Sign, SignAndEncrypt
+	CertFile       string `json:"cert_file"`
+	KeyFile        string `json:"key_file"`
+	// AuthMode is "anonymous" (default), "username" or "certificate";
+	// certificate auth uses CertFile/KeyFile.
+	AuthMode   string      `json:"auth_mode"`
+	Username   string      `json:"username"`
+	Password   string      `json:"password" secret:"true" secretdest:"endpoint"`
+	Subscribe  bool        `json:"subscribe"`
+	IntervalMs int         `json:"interval_ms"`
+	Nodes      []OPCUANode `json:"nodes"`
+}
+
+// FallbackSMTP sends fallback alerts by email. TLS selects implicit TLS
+// (usually port 465); otherwise STARTTLS is used when the relay offers it.
+type FallbackSMTP struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // default 25, or 465 with TLS
+	TLS      bool     `json:"tls"`
+	Username string   `json:"username"`
+	Password string   `json:"password" secret:"true" secretdest:"host,port,tls"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// FallbackWebhook posts fallback alerts to a URL. Format "slack" sends a
+// Slack-compatible {"text": ...} body; "json" (default) sends the alerts.
+type FallbackWebhook struct {
+	URL     string            `json:"url" secret:"true"`
+	Format  string            `json:"format"`
+	Headers map[string]string `json:"headers" secret:"true" secretdest:"url"`
+}
+
+// FallbackSMS sends fallback alerts as text messages through a modem's AT
+// command port.
+type FallbackSMS struct {
+	Device  string   `json:"device"` // e.g. /dev/ttyUSB2
+	Baud    int      `json:"baud"`   // default 115200
+	PIN     string   `json:"pin" secret:"true" secretdest:"device"`
+	Numbers []string `json:"numbers"`
+}
+
+// FallbackConfig configures the fallback module. Alerts are only sent once
+// the broker has been unreachable for DelaySec; the embedded binding can pin
+// SMTP and webhook delivery to a secondary uplink.
+type FallbackConfig struct {
+	DelaySec     int `json:"delay_sec"`     // default 120
+	DedupMinutes int `json:"dedup_minutes"` // default 60
+	MaxPerHour   int `json:"max_per_hour"`  // per channel, default 10
+	// Events lists agent event types (e.g. "gpio_input") that are
+	// forwarded as alerts in addition to probe and service failures.
+	Events []string `json:"events"`
+	collect.Binding
+
+	SMTP     *FallbackSMTP     `json:"smtp"`
+	Webhooks []FallbackWebhook `json:"webhooks"`
+	SMS      *FallbackSMS      `json:"sms"`
+}
+
+// SparkplugConfig configures Sparkplug B publishing. The agent is an edge
+// node and each module (system, docker, network, ...) one of its devices;
+// events, status and commands keep their JSON topics.
+type SparkplugConfig struct {
+	Enabled    bool   `json:"enabled"`
+	GroupID    string `json:"group_id"`     // default "iotmonitor"
+	EdgeNodeID string `json:"edge_node_id"` // default device_id
+}
+
+// FileSinkConfig configures the file sink. Files are partitioned by UTC
+// date, rotated by size and age, compressed once closed, and the oldest
+// are deleted to stay within the retention limits.
+type FileSinkConfig struct {
+	Enabled bool `json:"enabled"`
+	// Only makes the sink the agent's sole output: no broker connection
+	// is attempted and mqtt_url and agent_token aren't needed.
+	Only   bool   `json:"only"`
+	Dir    string `json:"dir"`    // default /var/lib/iotmonitor/export
+	Format string `json:"format"` // "ndjson" (default) or "csv"
+
+	MaxFileMB     int   `json:"max_file_mb"`    // default 16
+	RotateMinutes int   `json:"rotate_minutes"` // default 60
+	Compress      *bool `json:"compress"`       // gzip closed files, default true
+	MaxTotalMB    int   `json:"max_total_mb"`   // default 1024
+	// RetentionDays also deletes files older than this; 0 keeps them
+	// until MaxTotalMB is reached.
+	RetentionDays int `json:"retention_days"`
+}
+
+// AuditConfig configures the audit module. The agent doesn't load audit
+// rules itself; auditd or auditctl must install them.
+type AuditConfig struct {
+	// Source is "netlink" (the kernel's read-only audit multicast group,
+	// needs CAP_AUDIT_READ), "file" (tail LogFile) or empty to try netlink
+	// and fall back to the file.
+	Source  string `json:"source"`
+	LogFile string `json:"log_file"` // default /var/log/audit/audit.log
+
+	// Keys selects events by rule key (auditctl -k). RecordTypes selects
+	// them by record type name or number ("USER_CMD", "1330"), which is
+	// the closest thing to a rule ID audit records carry. An event
+	// matching either list is published; with both empty every keyed
+	// event is.
+	Keys        []string `json:"keys"`
+	RecordTypes []string `json:"record_types"`
+
+	MaxPerMinute int `json:"max_per_minute"` // default 300
+}
+
+// DesiredStateConfig configures the desiredstate module. The document at
+// File is reread before every run, so it can be managed locally; a document
+// pushed with the desired_state.apply command replaces it.
+type DesiredStateConfig struct {
+	File        string `json:"file"`         // default /var/lib/iotmonitor/desired-state.json
+	IntervalSec int    `json:"interval_sec"` // default 300
+	// DryRun reports drift without correcting it.
+	DryRun bool `json:"dry_run"`
+	// Corrective actions are capped per run (default 3) and per item per
+	// hour (default 3), so a change that never sticks isn't retried in a
+	// loop.
+	MaxActionsPerRun   int `json:"max_actions_per_run"`
+	MaxAttemptsPerHour int `json:"max_attempts_per_hour"`
+}
+
+// HAVIP is a virtual IP whose holder the ha module reports. Resource names
+// the Pacemaker resource that manages it, so the holder is known even when
+// it is another node.
+type HAVIP struct {
+	Address  string `json:"address"`
+	Resource string `json:"resource,omitempty"`
+}
+
+// HAConfig configures the ha module. keepalived instances are read over
+// D-Bus (enable_dbus in keepalived.conf) and from StateFiles; Pacemaker
+// is read with crm_mon when it is installed.
+type HAConfig struct {
+	// StateFiles are globs of files a keepalived notify script writes an
+	// instance's state to, either the bare state ("MASTER") or a
+	// notify_fifo line (INSTANCE "VI_1" MASTER 100). The file name
+	// without extension names the instance unless the line does.
+	StateFiles []string `json:"state_files"`
+	// DBus reads keepalived's org.keepalived.Vrrp1 interface with busctl
+	// (default true).
+	DBus *bool `json:"dbus"`
+	// Pacemaker runs crm_mon (default true).
+	Pacemaker *bool   `json:"pacemaker"`
+	VIPs      []HAVIP `json:"vips"`
+}
+
+// StorageConfig configures the storage module, which times fsync and 4k
+// random reads and writes on a small test file in each path and flags
+// paths that have become much slower than their baseline.
+type StorageConfig struct {
+	// Paths are writable directories on the disks to probe (default
+	// /var/lib/iotmonitor).
+	Paths []string `json:"paths"`
+	// IntervalSec is the time between probes (default 300).
+	IntervalSec int `json:"interval_sec"`
+	// FileSizeMB bounds the test file (default 8).
+	FileSizeMB int `json:"file_size_mb"`
+	// Samples is the number of operations of each kind per probe
+	// (default 32).
+	Samples int `json:"samples"`
+	// DegradationFactor is how many times its baseline a latency
+	// percentile must reach to count as degraded (default 3).
+	DegradationFactor float64 `json:"degradation_factor"`
+	// BaselineFile keeps baselines across restarts (default
+	// /var/lib/iotmonitor/storage-baseline.json).
+	BaselineFile string `json:"baseline_file"`
 }
 
 var (
@@ -29,8 +433,55 @@ var (
 	DefaultEnabledModules    = "system,docker,asterisk,network"
 	DefaultAsteriskContainer = "asterisk"
 	DefaultPingHost          = "1.1.1.1"
+	DefaultE2EKeyFile        = "/etc/iotmonitor/device-keys.json"
+	DefaultAvailabilityFile  = "/var/lib/iotmonitor/availability.json"
+	DefaultLocalUIAddr       = ":8090"
+	DefaultIntervalSec       = 10
+	DefaultProfilesDir       = "/etc/iotmonitor/profiles"
+	DefaultStoragePath       = "/var/lib/iotmonitor"
+	DefaultStorageBaseline   = "/var/lib/iotmonitor/storage-baseline.json"
+
+	// Where the host filesystems are mounted in host mode.
+	DefaultHostPaths = collect.HostPaths{
+		Proc: "/host/proc",
+		Sys:  "/host/sys",
+		Etc:  "/host/etc",
+		Root: "/host/root",
+	}
 )
 
+// applyHostMode fills host mode settings from the environment and unset
+// host paths from DefaultHostPaths.
+func applyHostMode(cfg *Config) {
+	if cfg.DiskPath == "" {
+		cfg.DiskPath = os.Getenv("IOT_DISK_PATH")
+	}
+	if !cfg.HostMode {
+		cfg.HostMode = os.Getenv("IOT_HOST_MODE") == "true"
+	}
+	if !cfg.HostMode {
+		return
+	}
+	paths := []struct {
+		field *string
+		env   string
+		def   string
+	}{
+		{&cfg.HostPaths.Proc, "IOT_HOST_PROC", DefaultHostPaths.Proc},
+		{&cfg.HostPaths.Sys, "IOT_HOST_SYS", DefaultHostPaths.Sys},
+		{&cfg.HostPaths.Etc, "IOT_HOST_ETC", DefaultHostPaths.Etc},
+		{&cfg.HostPaths.Root, "IOT_HOST_ROOT", DefaultHostPaths.Root},
+	}
+	for _, p := range paths {
+		if *p.field == "" {
+			*p.field = os.Getenv(p.env)
+		}
+		if *p.field == "" {
+			*p.field = p.def
+		}
+	}
+}
+
 func LoadConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -45,6 +496,17 @@ func LoadConfig(path string) (*Config, error) {
 			EnabledModules:    os.Getenv("IOT_ENABLED_MODULES"),
 			AsteriskContainer: os.Getenv("IOT_ASTERISK_CONTAINER"),
 			PingHost:          os.Getenv("IOT_PING_HOST"),
+
+			E2EEnabled:           os.Getenv("IOT_E2E_ENABLED") == "true",
+			E2EKeyFile:           os.Getenv("IOT_E2E_KEY_FILE"),
+			E2EBackendPublicKey:  os.Getenv("IOT_E2E_BACKEND_PUBLIC_KEY"),
+			E2EBackendSigningKey: os.Getenv("IOT_E2E_BACKEND_SIGNING_KEY"),
+
+			AvailabilityFile: os.Getenv("IOT_AVAILABILITY_FILE"),
+
+			LocalUI:          os.Getenv("IOT_LOCAL_UI") == "true",
+			LocalUIAddr:      os.Getenv("IOT_LOCAL_UI_ADDR"),
+			LocalUISetupCode: os.Getenv("IOT_LOCAL_UI_SETUP_CODE"),
 		}
 
 		if cfg.DeviceID == "" {
@@ -71,16 +533,40 @@ func LoadConfig(path string) (*Config, error) {
 		if cfg.PingHost == "" {
 			cfg.PingHost = DefaultPingHost
 		}
+		if cfg.E2EKeyFile == "" {
+			cfg.E2EKeyFile = DefaultE2EKeyFile
+		}
+		if cfg.AvailabilityFile == "" {
+			cfg.AvailabilityFile = DefaultAvailabilityFile
+		}
+		if cfg.LocalUIAddr == "" {
+			cfg.LocalUIAddr = DefaultLocalUIAddr
+		}
+		applyHostMode(cfg)
 
 		return cfg, nil
 	}
 	defer file.Close()
 
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
 	var cfg Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&cfg); err != nil {
+	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if len(cfg.Roles) > 0 {
+		merged, profile, err := applyRoles(data, cfg.Roles, cfg.ProfilesDir)
+		if err != nil {
+			return nil, fmt.Errorf("roles: %w", err)
+		}
+		cfg = Config{}
+		if err := json.Unmarshal(merged, &cfg); err != nil {
+			return nil, fmt.Errorf("roles: %w", err)
+		}
+		cfg.Profile = profile
+	}
 
 	if cfg.MQTTPrefix == "" {
 		cfg.MQTTPrefix = "iotmonitor/device"
@@ -115,6 +601,110 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.PingHost == "" {
 		cfg.PingHost = DefaultPingHost
 	}
+	if cfg.E2EKeyFile == "" {
+		cfg.E2EKeyFile = DefaultE2EKeyFile
+	}
+	if cfg.AvailabilityFile == "" {
+		cfg.AvailabilityFile = os.Getenv("IOT_AVAILABILITY_FILE")
+	}
+	if cfg.AvailabilityFile == "" {
+		cfg.AvailabilityFile = DefaultAvailabilityFile
+	}
+	if !cfg.LocalUI {
+		cfg.LocalUI = os.Getenv("IOT_LOCAL_UI") == "true"
+	}
+	if cfg.LocalUIAddr == "" {
+		cfg.LocalUIAddr = os.Getenv("IOT_LOCAL_UI_ADDR")
+	}
+	if cfg.LocalUIAddr == "" {
+		cfg.LocalUIAddr = DefaultLocalUIAddr
+	}
+	if cfg.LocalUISetupCode == "" {
+		cfg.LocalUISetupCode = os.Getenv("IOT_LOCAL_UI_SETUP_CODE")
+	}
+	applyHostMode(&cfg)
 
 	return &cfg, nil
 }
+
+// Validate reports settings the agent cannot run with. All problems are
+// returned together, joined.
+func (c *Config) Validate() error {
+	var errs []error
+	if strings.TrimSpace(c.DeviceID) == "" {
+		errs = append(errs, errors.New("device_id is required"))
+	}
+	brokerless := c.FileSink.Enabled && c.FileSink.Only
+	if strings.TrimSpace(c.AgentToken) == "" && !brokerless {
+		errs = append(errs, errors.New("agent_token is required"))
+	}
+	// Without a broker its settings are unused.
+	if !brokerless {
+		if strings.TrimSpace(c.MQTTURL) == "" {
+			errs = append(errs, errors.New("mqtt_url is required"))
+		} else if u, err := url.Parse(c.MQTTURL); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt_url: %w", err))
+		} else if u.Scheme != "" && u.Host != "" {
+			switch u.Scheme {
+			case "tcp", "mqtt":
+				if c.UseTLS {
+					errs = append(errs, fmt.Errorf("use_tls is set but mqtt_url uses %s://; use ssl:// or mqtts://", u.Scheme))
+				}
+			case "ssl", "tls", "mqtts", "ws", "wss":
+			default:
+				errs = append(errs, fmt.Errorf("mqtt_url: unsupported scheme %q", u.Scheme))
+			}
+		}
+		if c.MQTTPort < 0 || c.MQTTPort > 65535 {
+			errs = append(errs, fmt.Errorf("mqtt_port %d is out of range", c.MQTTPort))
+		}
+	}
+	if c.IntervalSec < 0 {
+		errs = append(errs, errors.New("interval_sec must not be negative"))
+	}
+	for _, role := range c.Roles {
+		if _, _, err := LoadProfile(c.ProfilesDir, role); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Proxy.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.E2EEnabled && (c.E2EBackendPublicKey == "" || c.E2EBackendSigningKey == "") {
+		errs = append(errs, errors.New("e2e_enabled needs e2e_backend_public_key and e2e_backend_signing_key"))
+	}
+	switch c.FileSink.Format {
+	case "", "ndjson", "csv":
+	default:
+		errs = append(errs, fmt.Errorf("file_sink format %q must be ndjson or csv", c.FileSink.Format))
+	}
+	if c.FileSink.Only && !c.FileSink.Enabled {
+		errs = append(errs, errors.New("file_sink only is set but the file sink isn't enabled"))
+	}
+	if c.Storage.IntervalSec < 0 || c.Storage.FileSizeMB < 0 || c.Storage.Samples < 0 {
+		errs = append(errs, errors.New("storage interval_sec, file_size_mb and samples must not be negative"))
+	}
+	if f := c.Storage.DegradationFactor; f != 0 && f <= 1 {
+		errs = append(errs, fmt.Errorf("storage degradation_factor %g must be greater than 1", f))
+	}
+	if err := c.Sparkplug.Validate(c.E2EEnabled); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks an enabled Sparkplug configuration. Sparkplug payloads
+// can't be sealed, since Sparkplug hosts must read them.
+func (s SparkplugConfig) Validate(e2eEnabled bool) error {
+	if !s.Enabled {
+		return nil
+	}
+	var errs []error
+	if e2eEnabled {
+		errs = append(errs, errors.New("sparkplug can't be combined with e2e_enabled; Sparkplug hosts must read the payloads"))
+	}
+	if strings.ContainsAny(s.GroupID+s.EdgeNodeID, "/+#") {
+		errs = append(errs, errors.New("sparkplug group_id and edge_node_id must not contain /, + or #"))
+	}
+	return errors.Join(errs...)
+}
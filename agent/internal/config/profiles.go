@@ -0,0 +1,238 @@
+package config
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+//go:embed profiles/*.json
+var builtinProfiles embed.FS
+
+var roleNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Profile is a device role: the modules, collection interval and settings
+// (probe targets, dependency rules, module configuration) that devices of
+// that kind share. Built-in profiles can be replaced by a file of the same
+// name in the profiles directory.
+type Profile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Modules     []string `json:"modules,omitempty"`
+	IntervalSec int      `json:"interval_sec,omitempty"`
+	// Settings is a partial agent configuration, e.g. port_checks,
+	// http_checks, dependencies or fallback.
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+// profileOnlyKeys may not be set by a profile: they identify the device or
+// are derived from the profile's own fields.
+var profileOnlyKeys = []string{
+	"device_id", "agent_token", "mqtt_url", "mqtt_username", "mqtt_password",
+	"mqtt_port", "mqtt_prefix", "roles", "profiles_dir", "enabled_modules", "interval_sec",
+}
+
+// RoleSource says where a role's profile was loaded from.
+type RoleSource struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // "builtin" or the profile file
+}
+
+// ResolvedProfile is what a device's roles resolve to once combined with
+// its own configuration. It is reported so the backend can see which
+// settings a device runs with and where they came from.
+type ResolvedProfile struct {
+	Roles       []RoleSource `json:"roles"`
+	Modules     []string     `json:"modules"`
+	IntervalSec int          `json:"interval_sec"`
+	// Settings holds the resolved value of every key a profile sets,
+	// secrets masked.
+	Settings map[string]any `json:"settings"`
+	// Overrides lists the keys the device's own configuration overrides.
+	Overrides []string `json:"overrides,omitempty"`
+}
+
+// LoadProfile returns the named profile from dir, or the built-in one.
+func LoadProfile(dir, name string) (*Profile, string, error) {
+	if !roleNameRe.MatchString(name) {
+		return nil, "", fmt.Errorf("invalid role name %q", name)
+	}
+	if dir == "" {
+		dir = DefaultProfilesDir
+	}
+	path := filepath.Join(dir, name+".json")
+	data, err := os.ReadFile(path)
+	source := path
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = builtinProfiles.ReadFile("profiles/" + name + ".json")
+		source = "builtin"
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("unknown role %q: no %s and no built-in profile", name, path)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var p Profile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, "", fmt.Errorf("profile %s: %w", source, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, "", fmt.Errorf("profile %s: %w", source, err)
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	return &p, source, nil
+}
+
+func (p *Profile) validate() error {
+	var errs []error
+	for _, key := range profileOnlyKeys {
+		if _, ok := p.Settings[key]; ok {
+			errs = append(errs, fmt.Errorf("settings can't set %s", key))
+		}
+	}
+	if p.IntervalSec < 0 {
+		errs = append(errs, errors.New("interval_sec must not be negative"))
+	}
+	// The settings must be valid configuration keys and values.
+	data, err := json.Marshal(p.Settings)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&Config{})
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("settings: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// applyRoles merges the profiles of roles under the device's own config
+// file and returns the resulting config JSON. Across roles, modules are
+// combined, the shortest interval wins, objects are merged and lists are
+// concatenated; later roles win for other values. The device's settings
+// then override: objects are merged, everything else is replaced.
+func applyRoles(device []byte, roles []string, dir string) ([]byte, *ResolvedProfile, error) {
+	var own map[string]any
+	if err := json.Unmarshal(device, &own); err != nil {
+		return nil, nil, err
+	}
+	resolved := &ResolvedProfile{Roles: []RoleSource{}, Modules: []string{}}
+	settings := map[string]any{}
+	for _, role := range roles {
+		p, source, err := LoadProfile(dir, role)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved.Roles = append(resolved.Roles, RoleSource{Name: role, Source: source})
+		for _, m := range p.Modules {
+			m = strings.ToLower(strings.TrimSpace(m))
+			if !slices.Contains(resolved.Modules, m) {
+				resolved.Modules = append(resolved.Modules, m)
+			}
+		}
+		if p.IntervalSec > 0 && (resolved.IntervalSec == 0 || p.IntervalSec < resolved.IntervalSec) {
+			resolved.IntervalSec = p.IntervalSec
+		}
+		mergeInto(settings, p.Settings, true)
+	}
+
+	merged := map[string]any{}
+	mergeInto(merged, settings, true)
+	if len(resolved.Modules) > 0 {
+		merged["enabled_modules"] = strings.Join(resolved.Modules, ",")
+	}
+	if resolved.IntervalSec > 0 {
+		merged["interval_sec"] = resolved.IntervalSec
+	}
+	for key := range own {
+		if _, ok := settings[key]; ok {
+			resolved.Overrides = append(resolved.Overrides, key)
+		}
+	}
+	mergeInto(merged, own, false)
+
+	// Report the device's effective modules and interval when it
+	// overrides them.
+	if v, ok := own["enabled_modules"].(string); ok && v != "" {
+		resolved.Modules = strings.Split(v, ",")
+		resolved.Overrides = append(resolved.Overrides, "enabled_modules")
+	}
+	if v, ok := own["interval_sec"].(float64); ok && v > 0 {
+		resolved.IntervalSec = int(v)
+		resolved.Overrides = append(resolved.Overrides, "interval_sec")
+	}
+	sort.Strings(resolved.Overrides)
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, resolved, err
+	}
+
+	// Settings are decoded from data so masking doesn't touch merged.
+	var reported map[string]any
+	if err := json.Unmarshal(data, &reported); err != nil {
+		return nil, resolved, err
+	}
+	MaskSecrets(reported)
+	resolved.Settings = map[string]any{}
+	for key := range settings {
+		resolved.Settings[key] = reported[key]
+	}
+	return data, resolved, nil
+}
+
+// mergeInto merges src into dst. Nested objects are merged; lists are
+// concatenated (skipping duplicates) when appendLists is set and replaced
+// otherwise.
+func mergeInto(dst, src map[string]any, appendLists bool) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case map[string]any:
+			if existing, ok := dst[k].(map[string]any); ok {
+				mergeInto(existing, v, appendLists)
+				continue
+			}
+			copied := map[string]any{}
+			mergeInto(copied, v, appendLists)
+			dst[k] = copied
+		case []any:
+			existing, ok := dst[k].([]any)
+			if !appendLists || !ok {
+				dst[k] = slices.Clone(v)
+				continue
+			}
+			for _, item := range v {
+				if !containsJSON(existing, item) {
+					existing = append(existing, item)
+				}
+			}
+			dst[k] = existing
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+func containsJSON(list []any, item any) bool {
+	want, _ := json.Marshal(item)
+	for _, e := range list {
+		got, _ := json.Marshal(e)
+		if bytes.Equal(got, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SecretMask replaces secrets in configuration shown to people.
+const SecretMask = "********"
+
+// Secret-bearing fields are tagged secret:"true", masking the whole value
+// (each value of a map), or secret:"userinfo", masking only the password
+// in a URL. secretdest names the sibling fields that say where a secret is
+// sent; a masked secret is only restored while they are unchanged.
+var configType = reflect.TypeOf(Config{})
+
+// MaskSecrets replaces every secret in m, a config file decoded as a
+// generic object or a part of one such as profile settings, with
+// SecretMask.
+func MaskSecrets(m map[string]any) {
+	w := &secretWalker{}
+	w.walk(configType, "", m, nil)
+}
+
+// RestoreSecrets replaces the secrets in m that are still SecretMask with
+// their values in current, so a masked config can be edited and saved.
+// List elements are matched by position. A secret whose destination (a
+// host, URL or broker) was changed isn't restored: otherwise the edited
+// config could send it somewhere else. Those are reported in the error and
+// must be entered again.
+func RestoreSecrets(m, current map[string]any) error {
+	w := &secretWalker{restore: true}
+	w.walk(configType, "", m, current)
+	if len(w.refused) > 0 {
+		return fmt.Errorf("enter %s again: where it is sent has changed", strings.Join(w.refused, ", "))
+	}
+	return nil
+}
+
+type secretWalker struct {
+	restore bool
+	// refused lists the paths of masked secrets that weren't restored.
+	refused []string
+}
+
+// walk masks or restores the secrets in v, a generic JSON value holding a
+// t at path, and returns the result. cur is the current value when
+// restoring.
+func (w *secretWalker) walk(t reflect.Type, path string, v, cur any) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+		curMap, _ := cur.(map[string]any)
+		w.fields(t, path, m, curMap)
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]any)
+		if !ok {
+			return v
+		}
+		curList, _ := cur.([]any)
+		for i := range list {
+			var c any
+			if i < len(curList) {
+				c = curList[i]
+			}
+			list[i] = w.walk(t.Elem(), path+"["+strconv.Itoa(i)+"]", list[i], c)
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+		curMap, _ := cur.(map[string]any)
+		for k, item := range m {
+			m[k] = w.walk(t.Elem(), joinPath(path, k), item, curMap[k])
+		}
+	}
+	return v
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (w *secretWalker) fields(t reflect.Type, path string, m, cur map[string]any) {
+	// Secrets are restored only after every field is, so a masked
+	// destination (a secret webhook URL) compares equal when unchanged.
+	var deferred []func()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" && f.Anonymous {
+			// Embedded structs are flattened into the parent object.
+			et := f.Type
+			if et.Kind() == reflect.Pointer {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				w.fields(et, path, m, cur)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		fieldPath := joinPath(path, name)
+		switch f.Tag.Get("secret") {
+		case "true":
+			var dests []string
+			if tag := f.Tag.Get("secretdest"); tag != "" {
+				dests = strings.Split(tag, ",")
+			}
+			if !w.restore {
+				m[name] = maskValue(v)
+				continue
+			}
+			deferred = append(deferred, func() {
+				if sameDestination(m, cur, dests) {
+					m[name] = restoreValue(m[name], cur[name])
+				} else if hasMask(m[name]) {
+					w.refused = append(w.refused, fieldPath)
+				}
+			})
+		case "userinfo":
+			if !w.restore {
+				m[name] = maskUserinfo(v)
+				continue
+			}
+			restored, ok := restoreUserinfo(v, cur[name])
+			if !ok {
+				w.refused = append(w.refused, fieldPath)
+			}
+			m[name] = restored
+		default:
+			m[name] = w.walk(f.Type, fieldPath, v, cur[name])
+		}
+	}
+	for _, restore := range deferred {
+		restore()
+	}
+}
+
+// maskValue masks a secret string, or each value of a map of them.
+func maskValue(v any) any {
+	if values, ok := v.(map[string]any); ok {
+		for k, item := range values {
+			values[k] = maskValue(item)
+		}
+		return values
+	}
+	if s, ok := v.(string); ok && s != "" {
+		return SecretMask
+	}
+	return v
+}
+
+// restoreValue replaces a masked string, or each masked value of a map,
+// with its current value.
+func restoreValue(v, cur any) any {
+	if values, ok := v.(map[string]any); ok {
+		curMap, _ := cur.(map[string]any)
+		for k, item := range values {
+			values[k] = restoreValue(item, curMap[k])
+		}
+		return values
+	}
+	if s, ok := v.(string); ok && s == SecretMask {
+		return cur
+	}
+	return v
+}
+
+func hasMask(v any) bool {
+	if values, ok := v.(map[string]any); ok {
+		for _, item := range values {
+			if hasMask(item) {
+				return true
+			}
+		}
+		return false
+	}
+	return v == SecretMask
+}
+
+// sameDestination reports whether the dests fields of m are what they are
+// in cur, ignoring URL passwords (changing one doesn't redirect anything).
+func sameDestination(m, cur map[string]any, dests []string) bool {
+	for _, d := range dests {
+		if !reflect.DeepEqual(withoutPasswords(m[d]), withoutPasswords(cur[d])) {
+			return false
+		}
+	}
+	return true
+}
+
+func withoutPasswords(v any) any {
+	switch v := v.(type) {
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			u.User = url.User(u.User.Username())
+			return u.String()
+		}
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = withoutPasswords(item)
+		}
+		return out
+	}
+	return v
+}
+
+// maskUserinfo masks the password of a URL, keeping the rest readable.
+func maskUserinfo(v any) any {
+	s, _ := v.(string)
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return v
+	}
+	if _, set := u.User.Password(); !set {
+		return v
+	}
+	// url escapes the mask's asterisks in userinfo; keep it readable.
+	u.User = url.UserPassword(u.User.Username(), SecretMask)
+	return strings.Replace(u.String(), url.PathEscape(SecretMask), SecretMask, 1)
+}
+
+// restoreUserinfo restores a masked URL password from cur. It refuses
+// (returning false, with the password dropped) when the rest of the URL
+// changed.
+func restoreUserinfo(v, cur any) (any, bool) {
+	s, _ := v.(string)
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return v, true
+	}
+	if password, set := u.User.Password(); !set || password != SecretMask {
+		return v, true
+	}
+	u.User = url.User(u.User.Username())
+	c, _ := cur.(string)
+	cu, err := url.Parse(c)
+	if err != nil || cu.User == nil || withoutPasswords(c) != u.String() {
+		return u.String(), false
+	}
+	if p, ok := cu.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), p)
+	}
+	return u.String(), true
+}
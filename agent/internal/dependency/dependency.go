@@ -0,0 +1,246 @@
+// Package dependency attributes failures to failing upstream targets using
+// the dependency graph from config. When the WAN drops, the ping, port and
+// SIP registration failures behind it are marked suppressed_by the WAN probe
+// so the backend alerts once on the root cause.
+package dependency
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// RootCause is published as a "root_cause" event when a failing target
+// starts or stops suppressing downstream failures.
+type RootCause struct {
+	Target     string   `json:"target"`
+	State      string   `json:"state"` // "failing" or "cleared"
+	Suppressed []string `json:"suppressed,omitempty"`
+	Since      int64    `json:"since"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
+// Snapshot holds one tick's results. Annotate sets SuppressedBy on them in
+// place.
+type Snapshot struct {
+	Network    *collect.NetworkMetrics
+	Containers []collect.ContainerInfo
+	Services   []collect.ServiceResult
+	// AsteriskChecked is set when the asterisk module ran this tick;
+	// AsteriskErr is its error.
+	AsteriskChecked bool
+	Asterisk        *collect.AsteriskPJSIPMetrics
+	AsteriskErr     error
+}
+
+// Graph evaluates the configured dependencies.
+type Graph struct {
+	rules []config.Dependency
+	roots map[string]time.Time // root causes reported as failing, with start
+}
+
+// New validates the dependency rules.
+func New(rules []config.Dependency) (*Graph, error) {
+	for i, r := range rules {
+		if strings.TrimSpace(r.Target) == "" || len(r.DependsOn) == 0 {
+			return nil, fmt.Errorf("dependencies[%d]: target and depends_on are required", i)
+		}
+		for _, d := range r.DependsOn {
+			if strings.TrimSpace(d) == "" {
+				return nil, errors.New("dependencies: empty depends_on entry")
+			}
+		}
+	}
+	return &Graph{rules: rules, roots: map[string]time.Time{}}, nil
+}
+
+// target is one result in a snapshot.
+type target struct {
+	failing  bool
+	suppress func(root string) // nil for results without a SuppressedBy field
+}
+
+func collectTargets(s *Snapshot) map[string]*target {
+	targets := map[string]*target{}
+	add := func(key string, failing bool, suppress func(string)) {
+		targets[key] = &target{failing: failing, suppress: suppress}
+	}
+
+	if m := s.Network; m != nil {
+		for i := range m.PingResults {
+			p := &m.PingResults[i]
+			add("ping:"+p.Host, !p.Success, func(r string) { p.SuppressedBy = r })
+		}
+		for i := range m.PortResults {
+			p := &m.PortResults[i]
+			add("port:"+net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), !p.Open, func(r string) { p.SuppressedBy = r })
+		}
+		for i := range m.HTTPResults {
+			h := &m.HTTPResults[i]
+			add("http:"+h.URL, !h.Success, func(r string) { h.SuppressedBy = r })
+		}
+		for i := range m.Uplinks {
+			u := &m.Uplinks[i]
+			add("uplink:"+u.Name, !u.Up, func(r string) { u.SuppressedBy = r })
+		}
+		for i := range m.ContainerProbes {
+			cp := &m.ContainerProbes[i]
+			for j := range cp.PortResults {
+				p := &cp.PortResults[j]
+				add("container_probe:"+cp.Container+"/"+net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), !p.Open, func(r string) { p.SuppressedBy = r })
+			}
+			for j := range cp.HTTPResults {
+				h := &cp.HTTPResults[j]
+				add("container_probe:"+cp.Container+"/"+h.URL, !h.Success, func(r string) { h.SuppressedBy = r })
+			}
+		}
+	}
+	for _, c := range s.Containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		add("container:"+name, c.State != "running", nil)
+	}
+	for i := range s.Services {
+		svc := &s.Services[i]
+		add("service:"+svc.Container+"/"+svc.Check, !svc.Up, func(r string) { svc.SuppressedBy = r })
+	}
+	if s.AsteriskChecked {
+		add("asterisk", s.AsteriskErr != nil, nil)
+	}
+	if m := s.Asterisk; m != nil {
+		for i := range m.Registrations {
+			reg := &m.Registrations[i]
+			add("sip_registration:"+reg.Name, !strings.EqualFold(reg.Status, "Registered"), func(r string) { reg.SuppressedBy = r })
+		}
+		for i := range m.Contacts {
+			c := &m.Contacts[i]
+			add("sip_contact:"+c.AOR+"/"+c.ContactURI, strings.EqualFold(c.Status, "Unavail"), func(r string) { c.SuppressedBy = r })
+		}
+	}
+	return targets
+}
+
+// Annotate marks every failing result whose dependency is also failing as
+// suppressed by the furthest-upstream failing target, and returns root
+// cause events for roots that appeared or cleared since the last call.
+func (g *Graph) Annotate(s *Snapshot) []RootCause {
+	targets := collectTargets(s)
+	keys := make([]string, 0, len(targets))
+	for k := range targets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parents := map[string][]string{}
+	parentsOf := func(key string) []string {
+		if p, ok := parents[key]; ok {
+			return p
+		}
+		var out []string
+		seen := map[string]bool{}
+		for _, rule := range g.rules {
+			if !match(rule.Target, key) {
+				continue
+			}
+			for _, pattern := range rule.DependsOn {
+				for _, k := range keys {
+					if k != key && !seen[k] && match(pattern, k) {
+						seen[k] = true
+						out = append(out, k)
+					}
+				}
+			}
+		}
+		// Parents keep config order, so when several are failing the
+		// first-listed one is named as the cause.
+		parents[key] = out
+		return out
+	}
+	var rootOf func(key string, visiting map[string]bool) string
+	rootOf = func(key string, visiting map[string]bool) string {
+		visiting[key] = true
+		for _, p := range parentsOf(key) {
+			if targets[p].failing && !visiting[p] {
+				return rootOf(p, visiting)
+			}
+		}
+		return key
+	}
+
+	suppressed := map[string][]string{}
+	for _, key := range keys {
+		t := targets[key]
+		if !t.failing {
+			continue
+		}
+		root := rootOf(key, map[string]bool{})
+		if root == key {
+			continue
+		}
+		if t.suppress != nil {
+			t.suppress(root)
+		}
+		suppressed[root] = append(suppressed[root], key)
+	}
+
+	now := time.Now()
+	var events []RootCause
+	for root, list := range suppressed {
+		if _, ok := g.roots[root]; ok {
+			continue
+		}
+		g.roots[root] = now
+		events = append(events, RootCause{
+			Target:     root,
+			State:      "failing",
+			Suppressed: list,
+			Since:      now.Unix(),
+			Timestamp:  now.Unix(),
+		})
+	}
+	for root, since := range g.roots {
+		if _, ok := suppressed[root]; ok {
+			continue
+		}
+		delete(g.roots, root)
+		events = append(events, RootCause{
+			Target:    root,
+			State:     "cleared",
+			Since:     since.Unix(),
+			Timestamp: now.Unix(),
+		})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Target < events[j].Target })
+	return events
+}
+
+// match reports whether s matches pattern, where "*" matches any run of
+// characters (including "/", unlike path.Match).
+func match(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
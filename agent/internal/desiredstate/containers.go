@@ -0,0 +1,200 @@
+package desiredstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+func (r *Reconciler) dockerClient() (*client.Client, error) {
+	if r.docker == nil {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, err
+		}
+		r.docker = cli
+	}
+	return r.docker, nil
+}
+
+func (rn *run) containers(ctx context.Context, want []Container) {
+	if len(want) == 0 {
+		return
+	}
+	cli, err := rn.r.dockerClient()
+	if err != nil {
+		rn.report.Error = fmt.Sprintf("docker: %v", err)
+		return
+	}
+	for _, c := range want {
+		rn.report.Checked++
+		info, err := cli.ContainerInspect(ctx, c.Name)
+		if client.IsErrNotFound(err) {
+			// Without a full container spec there is nothing to create it
+			// from.
+			rn.correct("container", c.Name, "missing", "", nil)
+			continue
+		}
+		if err != nil {
+			rn.correct("container", c.Name, "inspect failed: "+err.Error(), "", nil)
+			continue
+		}
+		running := info.State != nil && info.State.Running
+		if c.Image != "" && normalizeImage(info.Config.Image) != normalizeImage(c.Image) {
+			drift := fmt.Sprintf("image %s, want %s", info.Config.Image, c.Image)
+			rn.correct("container", c.Name, drift, "recreate", func() error {
+				return recreate(ctx, cli, info, c.Image, c.Running == nil || *c.Running)
+			})
+			continue
+		}
+		switch wantRunning := c.Running == nil || *c.Running; {
+		case wantRunning && !running:
+			rn.correct("container", c.Name, "not running ("+info.State.Status+")", "start", func() error {
+				return cli.ContainerStart(ctx, info.ID, container.StartOptions{})
+			})
+		case !wantRunning && running:
+			rn.correct("container", c.Name, "running", "stop", func() error {
+				return cli.ContainerStop(ctx, info.ID, container.StopOptions{})
+			})
+		}
+	}
+}
+
+// normalizeImage reduces the forms Docker accepts for one image ("nginx",
+// "docker.io/library/nginx:latest") to a single one.
+func normalizeImage(ref string) string {
+	ref = strings.TrimPrefix(ref, "docker.io/")
+	ref = strings.TrimPrefix(ref, "library/")
+	name := ref
+	if i := strings.LastIndexByte(ref, '/'); i >= 0 {
+		name = ref[i+1:]
+	}
+	if !strings.ContainsAny(name, ":@") {
+		ref += ":latest"
+	}
+	return ref
+}
+
+// recreate replaces the container with one using the same configuration
+// and a new image. The old container is kept, renamed, until the new one
+// has started, and is restored if anything fails.
+func recreate(ctx context.Context, cli *client.Client, old container.InspectResponse, img string, start bool) error {
+	pull, err := cli.ImagePull(ctx, img, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", img, err)
+	}
+	// The pull runs until its progress stream is drained.
+	_, err = io.Copy(io.Discard, pull)
+	pull.Close()
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", img, err)
+	}
+
+	name := strings.TrimPrefix(old.Name, "/")
+	backup := name + "-iotmonitor-old"
+	wasRunning := old.State != nil && old.State.Running
+	if wasRunning {
+		if err := cli.ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+			return fmt.Errorf("stop: %w", err)
+		}
+	}
+	if err := cli.ContainerRename(ctx, old.ID, backup); err != nil {
+		return errors.Join(fmt.Errorf("rename: %w", err), restore(cli, old.ID, "", "", wasRunning))
+	}
+
+	cfg := newConfig(ctx, cli, old, img)
+	endpoints := map[string]*network.EndpointSettings{}
+	if old.NetworkSettings != nil {
+		for name, ep := range old.NetworkSettings.Networks {
+			endpoints[name] = &network.EndpointSettings{
+				IPAMConfig: ep.IPAMConfig,
+				Aliases:    ep.Aliases,
+				Links:      ep.Links,
+			}
+		}
+	}
+	created, err := cli.ContainerCreate(ctx, cfg, old.HostConfig, &network.NetworkingConfig{EndpointsConfig: endpoints}, nil, name)
+	if err != nil {
+		return errors.Join(fmt.Errorf("create: %w", err), restore(cli, old.ID, name, "", wasRunning))
+	}
+	if start {
+		if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			return errors.Join(fmt.Errorf("start: %w", err), restore(cli, old.ID, name, created.ID, wasRunning))
+		}
+	}
+	return cli.ContainerRemove(ctx, old.ID, container.RemoveOptions{})
+}
+
+// newConfig copies the old container's configuration for img. Inspect
+// merges the image's defaults into the container's settings, so values
+// equal to the old image's (its ENV, labels, command) are dropped to let
+// the new image supply its own.
+func newConfig(ctx context.Context, cli *client.Client, old container.InspectResponse, img string) *container.Config {
+	cfg := *old.Config
+	cfg.Image = img
+	if len(old.ID) >= 12 && cfg.Hostname == old.ID[:12] {
+		cfg.Hostname = ""
+	}
+	oldImage, err := cli.ImageInspect(ctx, old.Image)
+	if err != nil || oldImage.Config == nil {
+		return &cfg
+	}
+	defaults := oldImage.Config
+	cfg.Env = slices.DeleteFunc(slices.Clone(cfg.Env), func(e string) bool {
+		return slices.Contains(defaults.Env, e)
+	})
+	cfg.Labels = maps.Clone(cfg.Labels)
+	for k, v := range defaults.Labels {
+		if cfg.Labels[k] == v {
+			delete(cfg.Labels, k)
+		}
+	}
+	if slices.Equal(cfg.Cmd, defaults.Cmd) {
+		cfg.Cmd = nil
+	}
+	if slices.Equal(cfg.Entrypoint, defaults.Entrypoint) {
+		cfg.Entrypoint = nil
+	}
+	if cfg.WorkingDir == defaults.WorkingDir {
+		cfg.WorkingDir = ""
+	}
+	if cfg.User == defaults.User {
+		cfg.User = ""
+	}
+	return &cfg
+}
+
+// restore undoes a failed recreate: the new container (replacement, if
+// any) is removed, and the old one gets its name back and is restarted if
+// it was running. It has its own deadline:
+// the run's context may be what expired, and rolling back with it would
+// leave the renamed container behind.
+func restore(cli *client.Client, id, name, replacement string, start bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+	defer cancel()
+	if replacement != "" {
+		if err := cli.ContainerRemove(ctx, replacement, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("remove new container: %w", err)
+		}
+	}
+	if name != "" {
+		if err := cli.ContainerRename(ctx, id, name); err != nil {
+			return fmt.Errorf("restore name: %w", err)
+		}
+	}
+	if start {
+		if err := cli.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+			return fmt.Errorf("restart old container: %w", err)
+		}
+	}
+	return nil
+}
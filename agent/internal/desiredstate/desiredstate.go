@@ -0,0 +1,359 @@
+// Package desiredstate enforces a declared state: containers running with
+// given images, systemd units enabled and active, files present with given
+// hashes. Each run compares the host with the document, corrects drift
+// within the configured limits and reports what it found and did.
+package desiredstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+const (
+	defaultFile               = "/var/lib/iotmonitor/desired-state.json"
+	defaultInterval           = 5 * time.Minute
+	defaultMaxActionsPerRun   = 3
+	defaultMaxAttemptsPerHour = 3
+	runTimeout                = 5 * time.Minute
+	restoreTimeout            = 2 * time.Minute
+)
+
+// Document is the desired state.
+type Document struct {
+	// Version identifies the document in reports.
+	Version    string      `json:"version"`
+	Containers []Container `json:"containers,omitempty"`
+	Units      []Unit      `json:"units,omitempty"`
+	Files      []File      `json:"files,omitempty"`
+}
+
+// Container must exist, be running (unless Running is false) and, when
+// Image is set, run that image. A container on another image is recreated
+// from its current configuration with the new image.
+type Container struct {
+	Name    string `json:"name"`
+	Image   string `json:"image,omitempty"`
+	Running *bool  `json:"running,omitempty"` // default true
+}
+
+// Unit is a systemd unit whose enablement and activity are enforced; nil
+// fields are not checked.
+type Unit struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled,omitempty"`
+	Active  *bool  `json:"active,omitempty"`
+}
+
+// File must exist with the given SHA-256 and, when set, octal Mode. It
+// can only be restored when Content (base64) is included.
+type File struct {
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Mode    string `json:"mode,omitempty"` // e.g. "0644"
+	Content []byte `json:"content,omitempty"`
+}
+
+func (d *Document) validate() error {
+	var errs []error
+	for i, c := range d.Containers {
+		if c.Name == "" {
+			errs = append(errs, fmt.Errorf("containers[%d]: name is required", i))
+		}
+	}
+	for i, u := range d.Units {
+		if !unitNameRe.MatchString(u.Name) {
+			errs = append(errs, fmt.Errorf("units[%d]: invalid unit name %q", i, u.Name))
+		}
+	}
+	for i, f := range d.Files {
+		if err := f.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("files[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Finding is one difference between the document and the host.
+type Finding struct {
+	Kind   string `json:"kind"` // "container", "unit" or "file"
+	Name   string `json:"name"`
+	Drift  string `json:"drift"`
+	Action string `json:"action,omitempty"`
+	// Result is "corrected", "failed" or "skipped" when an action was
+	// called for, and "uncorrectable" when none exists.
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is published as a "desired_state_report" event after every run.
+type Report struct {
+	Version   string    `json:"version,omitempty"`
+	Compliant bool      `json:"compliant"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	Checked   int       `json:"checked"`
+	Findings  []Finding `json:"findings"`
+	Error     string    `json:"error,omitempty"`
+	// DurationMs is how long the run took.
+	DurationMs int64 `json:"duration_ms"`
+	Timestamp  int64 `json:"timestamp"`
+}
+
+// Reconciler periodically enforces the document.
+type Reconciler struct {
+	cfg      config.DesiredStateConfig
+	root     string
+	onReport func(Report)
+
+	// mu serialises runs and guards the fields below.
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+	docker   *client.Client
+	last     *Report
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// New returns a Reconciler. hostPaths.Root, when set, prefixes file paths
+// so a containerised agent in host mode checks the host's files.
+func New(cfg config.DesiredStateConfig, hostPaths collect.HostPaths, onReport func(Report)) *Reconciler {
+	if cfg.File == "" {
+		cfg.File = defaultFile
+	}
+	if cfg.MaxActionsPerRun <= 0 {
+		cfg.MaxActionsPerRun = defaultMaxActionsPerRun
+	}
+	if cfg.MaxAttemptsPerHour <= 0 {
+		cfg.MaxAttemptsPerHour = defaultMaxAttemptsPerHour
+	}
+	r := &Reconciler{
+		cfg:      cfg,
+		root:     hostPaths.Root,
+		onReport: onReport,
+		attempts: map[string][]time.Time{},
+	}
+	r.ctx, r.stop = context.WithCancel(context.Background())
+	return r
+}
+
+// Start runs the reconcile loop.
+func (r *Reconciler) Start() {
+	interval := time.Duration(r.cfg.IntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			r.run()
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the loop, cancelling a reconcile in progress.
+func (r *Reconciler) Close() {
+	r.stop()
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.docker != nil {
+		r.docker.Close()
+	}
+}
+
+func (r *Reconciler) run() {
+	ctx, cancel := context.WithTimeout(r.ctx, runTimeout)
+	defer cancel()
+	r.Reconcile(ctx)
+}
+
+// Handlers returns the typed command handlers keyed by command name.
+func (r *Reconciler) Handlers() map[string]func(context.Context, map[string]any) (any, error) {
+	return map[string]func(context.Context, map[string]any) (any, error){
+		"desired_state.apply":     r.handleApply,
+		"desired_state.reconcile": r.handleReconcile,
+		"desired_state.report":    r.handleReport,
+	}
+}
+
+// handleApply stores the pushed document and reconciles against it.
+// params: {"document": {...}}.
+func (r *Reconciler) handleApply(ctx context.Context, params map[string]any) (any, error) {
+	raw, ok := params["document"]
+	if !ok {
+		return nil, errors.New("document is required")
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("document: %w", err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	if err := r.store(&doc); err != nil {
+		return nil, err
+	}
+	log.Printf("Desired state %q applied", doc.Version)
+	return r.Reconcile(ctx), nil
+}
+
+func (r *Reconciler) handleReconcile(ctx context.Context, _ map[string]any) (any, error) {
+	return r.Reconcile(ctx), nil
+}
+
+func (r *Reconciler) handleReport(context.Context, map[string]any) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return nil, errors.New("no reconcile has run yet")
+	}
+	return r.last, nil
+}
+
+func (r *Reconciler) store(doc *Document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.cfg.File), 0o755); err != nil {
+		return err
+	}
+	tmp := r.cfg.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.cfg.File)
+}
+
+func (r *Reconciler) load() (*Document, error) {
+	data, err := os.ReadFile(r.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.cfg.File, err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.cfg.File, err)
+	}
+	return &doc, nil
+}
+
+// run tracks one reconcile's findings and action budget.
+type run struct {
+	r       *Reconciler
+	report  *Report
+	actions int
+}
+
+// Reconcile compares the host with the current document, corrects drift
+// and publishes the report. Without a document there is nothing to
+// enforce and no report is published.
+func (r *Reconciler) Reconcile(ctx context.Context) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := time.Now()
+	report := &Report{DryRun: r.cfg.DryRun, Findings: []Finding{}}
+	doc, err := r.load()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return report
+	case err != nil:
+		report.Error = err.Error()
+	default:
+		report.Version = doc.Version
+		rn := &run{r: r, report: report}
+		rn.containers(ctx, doc.Containers)
+		rn.units(ctx, doc.Units)
+		rn.files(doc.Files)
+	}
+	report.Compliant = report.Error == "" && compliant(report.Findings)
+	report.DurationMs = time.Since(start).Milliseconds()
+	report.Timestamp = time.Now().Unix()
+	r.last = report
+	if r.onReport != nil {
+		r.onReport(*report)
+	}
+	return report
+}
+
+// compliant reports whether every drift was corrected.
+func compliant(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Result != "corrected" {
+			return false
+		}
+	}
+	return true
+}
+
+// correct records drift and, within the limits, runs fix for it. fix is
+// nil when the drift can't be corrected.
+func (rn *run) correct(kind, name, drift, action string, fix func() error) {
+	f := Finding{Kind: kind, Name: name, Drift: drift, Action: action}
+	key := kind + ":" + name
+	switch {
+	case fix == nil:
+		f.Action, f.Result = "", "uncorrectable"
+	case rn.r.cfg.DryRun:
+		f.Result, f.Detail = "skipped", "dry run"
+	case rn.actions >= rn.r.cfg.MaxActionsPerRun:
+		f.Result, f.Detail = "skipped", "max_actions_per_run reached"
+	case !rn.r.attempt(key):
+		f.Result, f.Detail = "skipped", "max_attempts_per_hour reached"
+	default:
+		rn.actions++
+		if err := fix(); err != nil {
+			f.Result, f.Detail = "failed", err.Error()
+			log.Printf("Desired state: %s %s failed: %v", action, key, err)
+		} else {
+			f.Result = "corrected"
+			log.Printf("Desired state: %s %s (%s)", action, key, drift)
+		}
+	}
+	rn.report.Findings = append(rn.report.Findings, f)
+}
+
+// attempt records a corrective attempt on key unless the hourly limit is
+// reached.
+func (r *Reconciler) attempt(key string) bool {
+	cutoff := time.Now().Add(-time.Hour)
+	recent := r.attempts[key][:0]
+	for _, t := range r.attempts[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= r.cfg.MaxAttemptsPerHour {
+		r.attempts[key] = recent
+		return false
+	}
+	r.attempts[key] = append(recent, time.Now())
+	return true
+}
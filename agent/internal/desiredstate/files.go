@@ -0,0 +1,150 @@
+package desiredstate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func (f File) validate() error {
+	if !filepath.IsAbs(f.Path) {
+		return fmt.Errorf("path %q must be absolute", f.Path)
+	}
+	if slices.Contains(strings.Split(filepath.ToSlash(f.Path), "/"), "..") {
+		return fmt.Errorf("path %q must not contain ..", f.Path)
+	}
+	if b, err := hex.DecodeString(f.SHA256); err != nil || len(b) != sha256.Size {
+		return errors.New("sha256 must be 64 hex digits")
+	}
+	if _, err := f.mode(); err != nil {
+		return err
+	}
+	if f.Content != nil {
+		if sum := sha256.Sum256(f.Content); !strings.EqualFold(hex.EncodeToString(sum[:]), f.SHA256) {
+			return fmt.Errorf("content of %s doesn't match its sha256", f.Path)
+		}
+	}
+	return nil
+}
+
+// mode returns the declared permission bits, or 0 when none are declared.
+// setuid, setgid and sticky bits are refused rather than dropped.
+func (f File) mode() (fs.FileMode, error) {
+	if f.Mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || m > 0o7777 {
+		return 0, fmt.Errorf("mode %q is not an octal permission", f.Mode)
+	}
+	if m > 0o777 {
+		return 0, fmt.Errorf("mode %q: setuid, setgid and sticky bits can't be set", f.Mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// hostPath maps an absolute document path under root, refusing paths that
+// would leave it.
+func hostPath(root, path string) (string, error) {
+	full := filepath.Join(root, filepath.Clean(path))
+	if root != "" {
+		rel, err := filepath.Rel(root, full)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("path %q is outside %s", path, root)
+		}
+	}
+	return full, nil
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (rn *run) files(want []File) {
+	for _, f := range want {
+		rn.report.Checked++
+		path, err := hostPath(rn.r.root, f.Path)
+		if err != nil {
+			rn.correct("file", f.Path, err.Error(), "", nil)
+			continue
+		}
+		mode, _ := f.mode()
+		var write func() error
+		if f.Content != nil {
+			write = func() error { return writeFile(path, f.Content, mode) }
+		}
+
+		st, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			rn.correct("file", f.Path, "missing", "write", write)
+			continue
+		}
+		if err != nil {
+			rn.correct("file", f.Path, "stat failed: "+err.Error(), "", nil)
+			continue
+		}
+		sum, err := fileHash(path)
+		if err != nil {
+			rn.correct("file", f.Path, "read failed: "+err.Error(), "", nil)
+			continue
+		}
+		if !strings.EqualFold(sum, f.SHA256) {
+			rn.correct("file", f.Path, "sha256 "+sum, "write", write)
+			continue
+		}
+		if mode != 0 && st.Mode().Perm() != mode.Perm() {
+			drift := fmt.Sprintf("mode %04o, want %04o", st.Mode().Perm(), mode.Perm())
+			rn.correct("file", f.Path, drift, "chmod", func() error {
+				return os.Chmod(path, mode)
+			})
+		}
+	}
+}
+
+// writeFile replaces path atomically, keeping the current permissions
+// unless mode is set.
+func writeFile(path string, content []byte, mode fs.FileMode) error {
+	if mode == 0 {
+		mode = 0o644
+		if st, err := os.Stat(path); err == nil {
+			mode = st.Mode().Perm()
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
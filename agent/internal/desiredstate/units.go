@@ -0,0 +1,83 @@
+package desiredstate
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// unitNameRe requires an alphanumeric first character, so a name can't
+// be taken for a systemctl option.
+var unitNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:_.@\-]{0,254}$`)
+
+// systemctl runs systemctl and returns its trimmed output. is-enabled and
+// is-active exit non-zero for "disabled" and "inactive", so their output
+// is returned even then. Arguments after the verb are unit names and are
+// passed after "--".
+func systemctl(ctx context.Context, verb string, units ...string) (string, error) {
+	args := append([]string{verb, "--"}, units...)
+	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (rn *run) units(ctx context.Context, want []Unit) {
+	for _, u := range want {
+		rn.report.Checked++
+		if u.Enabled != nil {
+			state, err := systemctl(ctx, "is-enabled", u.Name)
+			if state == "" && err != nil {
+				rn.correct("unit", u.Name, "is-enabled failed: "+err.Error(), "", nil)
+				continue
+			}
+			switch state {
+			case "enabled", "enabled-runtime", "disabled":
+				if enabled := state != "disabled"; *u.Enabled != enabled {
+					verb := "disable"
+					if *u.Enabled {
+						verb = "enable"
+					}
+					rn.correct("unit", u.Name, "is "+state, verb, func() error {
+						return systemctlAction(ctx, verb, u.Name)
+					})
+				}
+			case "static", "indirect", "alias", "generated":
+				// Pulled in by other units; there is nothing to toggle.
+			default:
+				// masked, not-found, ...
+				if *u.Enabled {
+					rn.correct("unit", u.Name, "is "+state, "", nil)
+				}
+			}
+		}
+		if u.Active != nil {
+			state, err := systemctl(ctx, "is-active", u.Name)
+			if state == "" && err != nil {
+				rn.correct("unit", u.Name, "is-active failed: "+err.Error(), "", nil)
+				continue
+			}
+			if active := state == "active"; *u.Active != active {
+				verb := "stop"
+				if *u.Active {
+					// restart also recovers a unit stuck in "failed".
+					verb = "restart"
+				}
+				rn.correct("unit", u.Name, "is "+state, verb, func() error {
+					return systemctlAction(ctx, verb, u.Name)
+				})
+			}
+		}
+	}
+}
+
+func systemctlAction(ctx context.Context, verb, unit string) error {
+	out, err := systemctl(ctx, verb, unit)
+	if err != nil {
+		if out != "" {
+			return fmt.Errorf("systemctl %s: %s", verb, out)
+		}
+		return fmt.Errorf("systemctl %s: %w", verb, err)
+	}
+	return nil
+}
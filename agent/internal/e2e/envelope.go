@@ -0,0 +1,232 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	envelopeVersion = 1
+	hkdfInfo        = "iotmonitor-e2e-v1"
+	// Commands older (or further in the future) than this are rejected to
+	// limit replay by whoever operates the broker.
+	maxCommandSkew = 5 * time.Minute
+	// maxSeenCommands bounds the replay cache. Signed commands are only
+	// remembered while their timestamp is inside the skew window.
+	maxSeenCommands = 10000
+)
+
+// Envelope is the wire format for encrypted payloads in both directions.
+// KeyID names the recipient key the payload was sealed to, SenderKeyID the
+// signing key, which lets either side rotate keys without a flag day.
+type Envelope struct {
+	Version     int    `json:"v"`
+	KeyID       string `json:"kid"`
+	SenderKeyID string `json:"skid"`
+	Ephemeral   string `json:"epk"`
+	Nonce       string `json:"nonce"`
+	Ciphertext  string `json:"ct"`
+	Timestamp   int64  `json:"ts"`
+	Signature   string `json:"sig"`
+}
+
+// IsEnvelope reports whether raw looks like a sealed payload rather than
+// plaintext JSON.
+func IsEnvelope(raw []byte) bool {
+	var probe struct {
+		Version    int    `json:"v"`
+		Ciphertext string `json:"ct"`
+	}
+	return json.Unmarshal(raw, &probe) == nil && probe.Version > 0 && probe.Ciphertext != ""
+}
+
+func (e *Envelope) signedBytes() []byte {
+	s := strconv.Itoa(e.Version) + "|" + e.KeyID + "|" + e.SenderKeyID + "|" +
+		e.Ephemeral + "|" + e.Nonce + "|" + e.Ciphertext + "|" + strconv.FormatInt(e.Timestamp, 10)
+	return []byte(s)
+}
+
+func (e *Envelope) aad() []byte {
+	return []byte(e.KeyID + "|" + e.SenderKeyID + "|" + strconv.FormatInt(e.Timestamp, 10))
+}
+
+func deriveAEAD(shared, ephPub, recipientPub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephPub...), recipientPub...)
+	key, err := hkdf.Key(sha256.New, shared, salt, hkdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Session seals outgoing payloads to the backend and opens commands sealed
+// to this device.
+type Session struct {
+	keyring        *Keyring
+	backendPub     *ecdh.PublicKey
+	backendKeyID   string
+	backendSigning ed25519.PublicKey
+
+	mu sync.Mutex
+	// seen maps the signatures of opened envelopes to their timestamps,
+	// so a captured command can't be replayed inside the skew window.
+	seen map[string]int64
+}
+
+// NewSession builds a session from the device keyring and the backend's
+// base64 encoded X25519 encryption key and Ed25519 signing key.
+func NewSession(kr *Keyring, backendPublicKey, backendSigningKey string) (*Session, error) {
+	raw, err := base64.StdEncoding.DecodeString(backendPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend public key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend public key: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(backendSigningKey)
+	if err != nil || len(sig) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid backend signing key")
+	}
+	return &Session{
+		keyring:        kr,
+		backendPub:     pub,
+		backendKeyID:   KeyID(raw),
+		backendSigning: ed25519.PublicKey(sig),
+		seen:           map[string]int64{},
+	}, nil
+}
+
+// Keyring exposes the device keyring, e.g. to announce public keys.
+func (s *Session) Keyring() *Keyring {
+	return s.keyring
+}
+
+// Seal encrypts plaintext to the backend key and signs it with the current
+// device key.
+func (s *Session) Seal(plaintext []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(s.backendPub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveAEAD(shared, eph.PublicKey().Bytes(), s.backendPub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	signer := s.keyring.Current()
+	env := Envelope{
+		Version:     envelopeVersion,
+		KeyID:       s.backendKeyID,
+		SenderKeyID: signer.KeyID,
+		Ephemeral:   base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()),
+		Nonce:       base64.StdEncoding.EncodeToString(nonce),
+		Timestamp:   time.Now().Unix(),
+	}
+	env.Ciphertext = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, env.aad()))
+	env.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signer.Ed25519, env.signedBytes()))
+	return json.Marshal(env)
+}
+
+// Open verifies a backend-signed envelope and decrypts it with the device key
+// it names.
+func (s *Session) Open(raw []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil || !ed25519.Verify(s.backendSigning, env.signedBytes(), sig) {
+		return nil, errors.New("envelope signature verification failed")
+	}
+	if skew := time.Since(time.Unix(env.Timestamp, 0)); skew > maxCommandSkew || skew < -maxCommandSkew {
+		return nil, fmt.Errorf("envelope timestamp outside allowed window (%s)", skew.Round(time.Second))
+	}
+
+	key := s.keyring.Lookup(env.KeyID)
+	if key == nil {
+		return nil, fmt.Errorf("unknown device key id %q", env.KeyID)
+	}
+	ephRaw, err := base64.StdEncoding.DecodeString(env.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	eph, err := ecdh.X25519().NewPublicKey(ephRaw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	shared, err := key.X25519.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveAEAD(shared, ephRaw, key.X25519.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	ct, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	plaintext, err := aead.Open(nil, nonce, ct, env.aad())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.remember(string(sig), env.Timestamp); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// remember records an opened envelope by its decoded signature (the base64
+// text has several spellings), rejecting one that was already opened.
+// Entries outside the skew window are dropped, since the timestamp check
+// rejects those envelopes anyway.
+func (s *Session) remember(sig string, ts int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[sig]; ok {
+		return errors.New("envelope was already received (replay)")
+	}
+	for seen, seenTS := range s.seen {
+		if time.Since(time.Unix(seenTS, 0)) > maxCommandSkew {
+			delete(s.seen, seen)
+		}
+	}
+	if len(s.seen) >= maxSeenCommands {
+		return errors.New("too many commands inside the replay window")
+	}
+	s.seen[sig] = ts
+	return nil
+}
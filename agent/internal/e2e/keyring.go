@@ -0,0 +1,197 @@
+package e2e
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Number of device keys kept after a rotation so commands sealed to a
+// previous key can still be opened while the backend catches up.
+const maxRetainedKeys = 3
+
+// DeviceKey is one generation of the device's key material: an X25519 key
+// for decrypting commands and an Ed25519 key for signing outgoing payloads.
+type DeviceKey struct {
+	KeyID      string             `json:"kid"`
+	CreatedAt  int64              `json:"created_at"`
+	X25519     *ecdh.PrivateKey   `json:"-"`
+	Ed25519    ed25519.PrivateKey `json:"-"`
+	X25519Raw  string             `json:"x25519_private"`
+	Ed25519Raw string             `json:"ed25519_private"`
+}
+
+// PublicKeys is what the device announces so the backend can seal commands
+// to it and verify its signatures. Signature, by the announced key, proves
+// the device holds it; Endorsement, by the previous key after a rotation,
+// lets the backend accept the new key without another approval.
+type PublicKeys struct {
+	KeyID         string   `json:"kid"`
+	X25519Public  string   `json:"x25519_public"`
+	Ed25519Public string   `json:"ed25519_public"`
+	Previous      []string `json:"previous,omitempty"`
+	Signature     string   `json:"sig"`
+	EndorsedBy    string   `json:"endorsed_by,omitempty"`
+	Endorsement   string   `json:"endorsement,omitempty"`
+}
+
+func (p *PublicKeys) signedBytes() []byte {
+	return []byte(p.KeyID + "|" + p.X25519Public + "|" + p.Ed25519Public)
+}
+
+// Keyring holds the device's current key (first entry) and a few retired ones.
+type Keyring struct {
+	Keys []*DeviceKey `json:"keys"`
+	path string
+}
+
+// KeyID derives the short identifier carried in envelopes for a public key.
+func KeyID(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newDeviceKey() (*DeviceKey, error) {
+	xk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, ek, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceKey{
+		KeyID:      KeyID(xk.PublicKey().Bytes()),
+		CreatedAt:  time.Now().Unix(),
+		X25519:     xk,
+		Ed25519:    ek,
+		X25519Raw:  base64.StdEncoding.EncodeToString(xk.Bytes()),
+		Ed25519Raw: base64.StdEncoding.EncodeToString(ek.Seed()),
+	}, nil
+}
+
+func (k *DeviceKey) decode() error {
+	xraw, err := base64.StdEncoding.DecodeString(k.X25519Raw)
+	if err != nil {
+		return fmt.Errorf("key %s: invalid x25519 key: %w", k.KeyID, err)
+	}
+	xk, err := ecdh.X25519().NewPrivateKey(xraw)
+	if err != nil {
+		return fmt.Errorf("key %s: invalid x25519 key: %w", k.KeyID, err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(k.Ed25519Raw)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("key %s: invalid ed25519 seed", k.KeyID)
+	}
+	k.X25519 = xk
+	k.Ed25519 = ed25519.NewKeyFromSeed(seed)
+	if k.KeyID == "" {
+		k.KeyID = KeyID(xk.PublicKey().Bytes())
+	}
+	return nil
+}
+
+// LoadOrCreateKeyring reads the keyring at path, generating a fresh device
+// key pair (and the file) when none exists yet.
+func LoadOrCreateKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		kr := &Keyring{path: path}
+		if err := kr.Rotate(); err != nil {
+			return nil, err
+		}
+		return kr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &Keyring{path: path}
+	if err := json.Unmarshal(data, kr); err != nil {
+		return nil, fmt.Errorf("parse keyring %s: %w", path, err)
+	}
+	if len(kr.Keys) == 0 {
+		return nil, fmt.Errorf("keyring %s has no keys", path)
+	}
+	for _, k := range kr.Keys {
+		if err := k.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// Rotate generates a new current key, retires the oldest ones beyond
+// maxRetainedKeys and persists the keyring.
+func (kr *Keyring) Rotate() error {
+	k, err := newDeviceKey()
+	if err != nil {
+		return err
+	}
+	kr.Keys = append([]*DeviceKey{k}, kr.Keys...)
+	if len(kr.Keys) > maxRetainedKeys {
+		kr.Keys = kr.Keys[:maxRetainedKeys]
+	}
+	return kr.save()
+}
+
+func (kr *Keyring) save() error {
+	data, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(kr.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := kr.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kr.path)
+}
+
+// Current returns the key used for signing and advertised to the backend.
+func (kr *Keyring) Current() *DeviceKey {
+	return kr.Keys[0]
+}
+
+// Lookup finds a (possibly retired) key by its identifier.
+func (kr *Keyring) Lookup(kid string) *DeviceKey {
+	for _, k := range kr.Keys {
+		if k.KeyID == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// PublicKeys returns the announcement payload for the current key.
+func (kr *Keyring) PublicKeys() PublicKeys {
+	cur := kr.Current()
+	pub := PublicKeys{
+		KeyID:         cur.KeyID,
+		X25519Public:  base64.StdEncoding.EncodeToString(cur.X25519.PublicKey().Bytes()),
+		Ed25519Public: base64.StdEncoding.EncodeToString(cur.Ed25519.Public().(ed25519.PublicKey)),
+	}
+	for _, k := range kr.Keys[1:] {
+		pub.Previous = append(pub.Previous, k.KeyID)
+	}
+	pub.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(cur.Ed25519, pub.signedBytes()))
+	if len(kr.Keys) > 1 {
+		prev := kr.Keys[1]
+		pub.EndorsedBy = prev.KeyID
+		pub.Endorsement = base64.StdEncoding.EncodeToString(ed25519.Sign(prev.Ed25519, pub.signedBytes()))
+	}
+	return pub
+}
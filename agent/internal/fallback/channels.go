@@ -0,0 +1,183 @@
+package fallback
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+type smtpChannel struct {
+	cfg     config.FallbackSMTP
+	binding collect.Binding
+}
+
+func newSMTPChannel(cfg config.FallbackSMTP, binding collect.Binding) (*smtpChannel, error) {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, errors.New("fallback smtp needs host, from and to")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 25
+		if cfg.TLS {
+			cfg.Port = 465
+		}
+	}
+	return &smtpChannel{cfg: cfg, binding: binding}, nil
+}
+
+func (c *smtpChannel) name() string { return "smtp " + c.cfg.Host }
+
+func (c *smtpChannel) send(ctx context.Context, subject, body string, _ []Alert) error {
+	d, err := c.binding.Dialer(15 * time.Second)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConfig := &tls.Config{ServerName: c.cfg.Host}
+	if c.cfg.TLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !c.cfg.TLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if c.cfg.Username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted
+		// connection to anything but localhost.
+		if err := client.Auth(smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range c.cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		c.cfg.From, strings.Join(c.cfg.To, ", "), headerText(subject), time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := io.WriteString(w, msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// headerText makes text built from alert titles safe for a mail header:
+// line breaks, which would start new headers, become spaces and anything
+// beyond ASCII is RFC 2047 encoded.
+func headerText(s string) string {
+	s = strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+type webhookChannel struct {
+	cfg      config.FallbackWebhook
+	deviceID string
+	client   *http.Client
+}
+
+func newWebhookChannel(cfg config.FallbackWebhook, binding collect.Binding, deviceID string) (*webhookChannel, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("fallback webhook: invalid url %q", cfg.URL)
+	}
+	switch cfg.Format {
+	case "", "json", "slack":
+	default:
+		return nil, fmt.Errorf("fallback webhook: unknown format %q", cfg.Format)
+	}
+	d, err := binding.Dialer(15 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = d.DialContext
+	return &webhookChannel{
+		cfg:      cfg,
+		deviceID: deviceID,
+		client:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c *webhookChannel) name() string {
+	if u, err := url.Parse(c.cfg.URL); err == nil {
+		return "webhook " + u.Host
+	}
+	return "webhook"
+}
+
+func (c *webhookChannel) send(ctx context.Context, subject, body string, alerts []Alert) error {
+	var payload any
+	if c.cfg.Format == "slack" {
+		payload = map[string]string{"text": "*" + subject + "*\n" + body}
+	} else {
+		payload = map[string]any{
+			"device_id": c.deviceID,
+			"subject":   subject,
+			"alerts":    alerts,
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
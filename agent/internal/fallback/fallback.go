@@ -0,0 +1,338 @@
+// Package fallback delivers critical alerts directly (SMTP, webhook, SMS)
+// while the agent cannot reach its MQTT broker. It stays silent while the
+// broker is connected, since the backend raises alerts itself then, and
+// stands down with a final notice once the broker is back.
+package fallback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+// Alert severities.
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityOK       = "ok"
+)
+
+// Alert is one notification. Alerts with the same Key are de-duplicated.
+type Alert struct {
+	Key      string    `json:"key"`
+	Severity string    `json:"severity"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// channel is one delivery method.
+type channel interface {
+	name() string
+	send(ctx context.Context, subject, body string, alerts []Alert) error
+}
+
+type channelState struct {
+	channel
+	sent []time.Time // send times within the last hour
+}
+
+// Notifier watches broker connectivity and sends alerts through its
+// channels while the broker is down.
+type Notifier struct {
+	deviceID  string
+	connected func() bool
+	channels  []*channelState
+	events    map[string]bool
+	delay     time.Duration
+	dedup     time.Duration
+	perHour   int
+
+	mu        sync.Mutex
+	pending   []Alert
+	state     map[string]bool // key -> currently failing
+	lastSent  map[string]time.Time
+	delivered map[string]bool // failure alerts sent during this outage
+	downSince time.Time
+	active    bool
+	dropped   int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New builds a Notifier from cfg. connected reports whether the broker is
+// currently reachable.
+func New(cfg config.FallbackConfig, deviceID string, connected func() bool) (*Notifier, error) {
+	n := &Notifier{
+		deviceID:  deviceID,
+		connected: connected,
+		events:    map[string]bool{},
+		delay:     time.Duration(cfg.DelaySec) * time.Second,
+		dedup:     time.Duration(cfg.DedupMinutes) * time.Minute,
+		perHour:   cfg.MaxPerHour,
+		state:     map[string]bool{},
+		lastSent:  map[string]time.Time{},
+		delivered: map[string]bool{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if n.delay <= 0 {
+		n.delay = 2 * time.Minute
+	}
+	if n.dedup <= 0 {
+		n.dedup = time.Hour
+	}
+	if n.perHour <= 0 {
+		n.perHour = 10
+	}
+	for _, e := range cfg.Events {
+		n.events[e] = true
+	}
+
+	if cfg.SMTP != nil {
+		ch, err := newSMTPChannel(*cfg.SMTP, cfg.Binding)
+		if err != nil {
+			return nil, err
+		}
+		n.channels = append(n.channels, &channelState{channel: ch})
+	}
+	for _, w := range cfg.Webhooks {
+		ch, err := newWebhookChannel(w, cfg.Binding, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		n.channels = append(n.channels, &channelState{channel: ch})
+	}
+	if cfg.SMS != nil {
+		ch, err := newSMSChannel(*cfg.SMS)
+		if err != nil {
+			return nil, err
+		}
+		n.channels = append(n.channels, &channelState{channel: ch})
+	}
+	if len(n.channels) == 0 {
+		return nil, errors.New("fallback needs at least one of smtp, webhooks or sms")
+	}
+	return n, nil
+}
+
+// Start runs the connectivity watch in the background until Close.
+func (n *Notifier) Start() {
+	go func() {
+		defer close(n.done)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.stop:
+				return
+			case <-ticker.C:
+				n.check(time.Now())
+			}
+		}
+	}()
+}
+
+// Close stops the background watch.
+func (n *Notifier) Close() {
+	close(n.stop)
+	<-n.done
+}
+
+// Notify queues an alert. Alerts raised while the broker is connected are
+// kept for the delay period, so failures that show up just before the link
+// is declared down (often the same outage) are still delivered.
+func (n *Notifier) Notify(a Alert) {
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	if a.Severity == "" {
+		a.Severity = SeverityCritical
+	}
+	n.mu.Lock()
+	n.pending = append(n.pending, a)
+	n.mu.Unlock()
+}
+
+// Event forwards an agent event as an alert when its type is listed in the
+// fallback events config.
+func (n *Notifier) Event(eventType string, payload any) {
+	if !n.events[eventType] {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	var fields map[string]any
+	if json.Unmarshal(data, &fields) != nil {
+		fields = nil
+	}
+	title := eventType
+	if name, ok := fields["name"].(string); ok && name != "" {
+		title += " " + name
+	}
+	// Timestamps would make every occurrence unique; leave them out of the
+	// de-duplication key.
+	for _, k := range []string{"timestamp", "time", "first_seen"} {
+		delete(fields, k)
+	}
+	key, _ := json.Marshal(fields)
+	n.Notify(Alert{
+		Key:      eventType + ":" + string(key),
+		Severity: SeverityWarning,
+		Title:    title,
+		Message:  string(data),
+	})
+}
+
+// transition records the state of a monitored target and raises an alert
+// when it starts failing, and a recovery notice when a target whose failure
+// was delivered comes back. Failures suppressed by a failing dependency are
+// recorded without an alert; the root cause raises its own.
+func (n *Notifier) transition(key, title string, failing bool, suppressedBy, detail string) {
+	n.mu.Lock()
+	was := n.state[key]
+	n.state[key] = failing
+	delivered := n.delivered[key]
+	n.mu.Unlock()
+
+	switch {
+	case failing && !was && suppressedBy == "":
+		n.Notify(Alert{Key: key, Severity: SeverityCritical, Title: title + " is down", Message: detail})
+	case !failing && was && delivered:
+		n.Notify(Alert{Key: key + ":recovered", Severity: SeverityOK, Title: title + " recovered"})
+	}
+}
+
+func (n *Notifier) check(now time.Time) {
+	if n.connected() {
+		n.mu.Lock()
+		wasActive := n.active
+		n.active = false
+		n.downSince = time.Time{}
+		n.delivered = map[string]bool{}
+		n.lastSent = map[string]time.Time{}
+		n.dropped = 0
+		n.prune(now)
+		n.mu.Unlock()
+		if wasActive {
+			log.Println("Fallback notifier: broker reachable again, standing down")
+			n.deliver([]Alert{{
+				Key:      "broker:recovered",
+				Severity: SeverityOK,
+				Title:    "Broker connection restored; alerts resume through the backend",
+				Time:     now,
+			}})
+		}
+		return
+	}
+
+	n.mu.Lock()
+	if n.downSince.IsZero() {
+		n.downSince = now
+	}
+	if !n.active {
+		if now.Sub(n.downSince) < n.delay {
+			n.mu.Unlock()
+			return
+		}
+		n.active = true
+		log.Printf("Fallback notifier: broker unreachable for %s, sending alerts directly", n.delay)
+		n.pending = append([]Alert{{
+			Key:      "broker",
+			Severity: SeverityCritical,
+			Title:    "Agent cannot reach the monitoring broker",
+			Message:  fmt.Sprintf("No broker connection since %s.", n.downSince.Format(time.RFC3339)),
+			Time:     n.downSince,
+		}}, n.pending...)
+	}
+
+	var batch []Alert
+	for _, a := range n.pending {
+		if last, ok := n.lastSent[a.Key]; ok && now.Sub(last) < n.dedup {
+			continue
+		}
+		n.lastSent[a.Key] = now
+		if a.Severity == SeverityCritical {
+			n.delivered[a.Key] = true
+		}
+		batch = append(batch, a)
+	}
+	n.pending = nil
+	n.mu.Unlock()
+
+	if len(batch) > 0 {
+		n.deliver(batch)
+	}
+}
+
+// prune drops queued alerts older than the delay; called with mu held.
+func (n *Notifier) prune(now time.Time) {
+	kept := n.pending[:0]
+	for _, a := range n.pending {
+		if now.Sub(a.Time) < n.delay {
+			kept = append(kept, a)
+		}
+	}
+	n.pending = kept
+}
+
+// deliver sends one message per channel, subject to the hourly cap.
+func (n *Notifier) deliver(alerts []Alert) {
+	subject, body := n.format(alerts)
+	now := time.Now()
+	for _, ch := range n.channels {
+		kept := ch.sent[:0]
+		for _, t := range ch.sent {
+			if now.Sub(t) < time.Hour {
+				kept = append(kept, t)
+			}
+		}
+		ch.sent = kept
+		if len(ch.sent) >= n.perHour {
+			n.mu.Lock()
+			n.dropped += len(alerts)
+			n.mu.Unlock()
+			log.Printf("Fallback notifier: %s hourly limit reached, dropping %d alert(s)", ch.name(), len(alerts))
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+		err := ch.send(ctx, subject, body, alerts)
+		cancel()
+		if err != nil {
+			log.Printf("Fallback notifier: %s: %v", ch.name(), err)
+			continue
+		}
+		ch.sent = append(ch.sent, now)
+	}
+}
+
+func (n *Notifier) format(alerts []Alert) (string, string) {
+	subject := fmt.Sprintf("[iotmonitor] %s: %s", n.deviceID, alerts[0].Title)
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("[iotmonitor] %s: %d alerts", n.deviceID, len(alerts))
+	}
+	var b strings.Builder
+	for _, a := range alerts {
+		fmt.Fprintf(&b, "%s %s: %s\n", a.Time.Format("2006-01-02 15:04:05"), strings.ToUpper(a.Severity), a.Title)
+		if a.Message != "" {
+			fmt.Fprintf(&b, "  %s\n", a.Message)
+		}
+	}
+	n.mu.Lock()
+	if n.dropped > 0 {
+		fmt.Fprintf(&b, "(%d earlier alert(s) not sent: hourly limit)\n", n.dropped)
+		n.dropped = 0
+	}
+	n.mu.Unlock()
+	return subject, b.String()
+}
@@ -0,0 +1,70 @@
+package fallback
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// ObserveNetwork raises alerts for ping, port, HTTP, uplink and container
+// probes that start failing.
+func (n *Notifier) ObserveNetwork(m *collect.NetworkMetrics) {
+	for _, p := range m.PingResults {
+		n.transition("ping:"+p.Host, "Ping "+p.Host, !p.Success, p.SuppressedBy, p.Error)
+	}
+	for _, p := range m.PortResults {
+		addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+		n.transition("port:"+addr, "Port "+addr, !p.Open, p.SuppressedBy, p.Error)
+	}
+	for _, h := range m.HTTPResults {
+		n.transition("http:"+h.URL, h.URL, !h.Success, h.SuppressedBy, h.Error)
+	}
+	for _, u := range m.Uplinks {
+		n.transition("uplink:"+u.Name, "Uplink "+u.Name, !u.Up, u.SuppressedBy, "")
+	}
+	for _, cp := range m.ContainerProbes {
+		for _, p := range cp.PortResults {
+			addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+			n.transition("container_probe:"+cp.Container+"/"+addr, cp.Container+" port "+addr, !p.Open, p.SuppressedBy, p.Error)
+		}
+		for _, h := range cp.HTTPResults {
+			n.transition("container_probe:"+cp.Container+"/"+h.URL, cp.Container+" "+h.URL, !h.Success, h.SuppressedBy, h.Error)
+		}
+	}
+}
+
+// ObserveContainers raises an alert when a container stops running.
+func (n *Notifier) ObserveContainers(containers []collect.ContainerInfo) {
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		n.transition("container:"+name, "Container "+name, c.State != "running", "", c.Status)
+	}
+}
+
+// ObserveServices raises alerts for label-discovered services going down.
+func (n *Notifier) ObserveServices(services []collect.ServiceResult) {
+	for _, s := range services {
+		n.transition("service:"+s.Container+"/"+s.Check, s.Container+" "+s.Check, !s.Up, s.SuppressedBy, s.Error)
+	}
+}
+
+// ObserveAsterisk raises alerts when Asterisk stops answering or an
+// outbound SIP registration is lost.
+func (n *Notifier) ObserveAsterisk(m *collect.AsteriskPJSIPMetrics, err error) {
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+	}
+	n.transition("asterisk", "Asterisk", err != nil, "", detail)
+	if m == nil {
+		return
+	}
+	for _, r := range m.Registrations {
+		n.transition("sip_registration:"+r.Name, "SIP registration "+r.Name, !strings.EqualFold(r.Status, "Registered"), r.SuppressedBy, r.Status)
+	}
+}
@@ -0,0 +1,198 @@
+package fallback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+// A single GSM 7-bit text message.
+const smsMaxLen = 160
+
+// modemPort is an open serial port to the modem's AT interface.
+type modemPort interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+type smsChannel struct {
+	cfg config.FallbackSMS
+}
+
+func newSMSChannel(cfg config.FallbackSMS) (*smsChannel, error) {
+	if cfg.Device == "" || len(cfg.Numbers) == 0 {
+		return nil, errors.New("fallback sms needs device and numbers")
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 115200
+	}
+	return &smsChannel{cfg: cfg}, nil
+}
+
+func (c *smsChannel) name() string { return "sms " + c.cfg.Device }
+
+func (c *smsChannel) send(ctx context.Context, _, _ string, alerts []Alert) error {
+	port, err := openModem(c.cfg.Device, c.cfg.Baud)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	m := &modem{port: port}
+
+	if _, err := m.command(ctx, "ATE0", 5*time.Second); err != nil {
+		return err
+	}
+	if c.cfg.PIN != "" {
+		resp, err := m.command(ctx, "AT+CPIN?", 5*time.Second)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(resp, "SIM PIN") {
+			if _, err := m.command(ctx, `AT+CPIN="`+c.cfg.PIN+`"`, 10*time.Second); err != nil {
+				return fmt.Errorf("unlock SIM: %w", err)
+			}
+			// Let the modem register.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	if _, err := m.command(ctx, "AT+CMGF=1", 5*time.Second); err != nil {
+		return err
+	}
+
+	text := smsText(alerts)
+	var errs []error
+	for _, number := range c.cfg.Numbers {
+		if err := m.sendText(ctx, number, text); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", number, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// smsText squeezes the alerts into one message: the titles, most severe
+// first, then a count of what did not fit.
+func smsText(alerts []Alert) string {
+	var titles []string
+	for _, sev := range []string{SeverityCritical, SeverityWarning, SeverityOK} {
+		for _, a := range alerts {
+			if a.Severity == sev {
+				titles = append(titles, gsmSafe(a.Title))
+			}
+		}
+	}
+	text := ""
+	for i, t := range titles {
+		candidate := t
+		if text != "" {
+			candidate = text + "; " + t
+		}
+		more := ""
+		if remaining := len(titles) - 1 - i; remaining > 0 {
+			more = fmt.Sprintf(" (+%d more)", remaining)
+		}
+		if len(candidate+more) > smsMaxLen {
+			if text == "" {
+				return candidate[:min(len(candidate), smsMaxLen)]
+			}
+			return text + fmt.Sprintf(" (+%d more)", len(titles)-i)
+		}
+		text = candidate
+	}
+	return text
+}
+
+// gsmSafe replaces characters that text mode may not carry intact.
+func gsmSafe(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteByte(' ')
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+type modem struct {
+	port modemPort
+	buf  bytes.Buffer
+}
+
+// readUntil reads until one of the markers appears and returns everything
+// read so far.
+func (m *modem) readUntil(ctx context.Context, timeout time.Duration, markers ...string) (string, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	m.port.SetReadDeadline(deadline)
+	chunk := make([]byte, 256)
+	for {
+		s := m.buf.String()
+		for _, marker := range markers {
+			if i := strings.Index(s, marker); i >= 0 {
+				m.buf.Next(i + len(marker))
+				return s[:i+len(marker)], nil
+			}
+		}
+		n, err := m.port.Read(chunk)
+		m.buf.Write(chunk[:n])
+		if err != nil {
+			return m.buf.String(), fmt.Errorf("modem: %w (got %q)", err, strings.TrimSpace(m.buf.String()))
+		}
+	}
+}
+
+// command sends an AT command and waits for its final result code.
+func (m *modem) command(ctx context.Context, cmd string, timeout time.Duration) (string, error) {
+	m.buf.Reset()
+	if _, err := io.WriteString(m.port, cmd+"\r"); err != nil {
+		return "", err
+	}
+	resp, err := m.readUntil(ctx, timeout, "OK\r\n", "ERROR")
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(resp, "ERROR") {
+		// Include the rest of an extended error line (+CME ERROR: 10).
+		rest, _ := m.readUntil(ctx, 500*time.Millisecond, "\r\n")
+		return "", fmt.Errorf("%s: %s", cmd, strings.TrimSpace(resp+rest))
+	}
+	return resp, nil
+}
+
+func (m *modem) sendText(ctx context.Context, number, text string) error {
+	m.buf.Reset()
+	if _, err := io.WriteString(m.port, `AT+CMGS="`+number+`"`+"\r"); err != nil {
+		return err
+	}
+	if _, err := m.readUntil(ctx, 10*time.Second, "> "); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(m.port, text+"\x1a"); err != nil {
+		return err
+	}
+	resp, err := m.readUntil(ctx, 60*time.Second, "OK\r\n", "ERROR")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, "+CMGS:") {
+		rest, _ := m.readUntil(ctx, 500*time.Millisecond, "\r\n")
+		return fmt.Errorf("send failed: %s", strings.TrimSpace(resp+rest))
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fallback
+
+import "errors"
+
+func openModem(device string, baud int) (modemPort, error) {
+	return nil, errors.New("sms fallback is only supported on Linux")
+}
@@ -0,0 +1,383 @@
+// Package filesink writes everything the agent publishes to local files,
+// for sites whose data leaves on removable media instead of over the
+// network.
+//
+// Each line (NDJSON) or row (CSV) is one Record: the time it was published,
+// the device, whether it was a metric, event or status, its type and the
+// JSON payload. That is the import format: the backend can ingest the
+// files later with the original timestamps. Files live in one directory
+// per UTC date:
+//
+//	<dir>/2026-10-17/<device>_20261017T093000Z.ndjson.gz
+//
+// The file being written is plain text; it is compressed once rotated, so
+// a power cut loses at most a partial line.
+package filesink
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+const (
+	defaultDir           = "/var/lib/iotmonitor/export"
+	defaultMaxFileMB     = 16
+	defaultRotateMinutes = 60
+	defaultMaxTotalMB    = 1024
+
+	dayLayout       = "2006-01-02"
+	fileTimeLayout  = "20060102T150405Z"
+	timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// csvHeader names the CSV columns, which match the Record fields.
+var csvHeader = []string{"timestamp", "device_id", "kind", "type", "payload"}
+
+// Record is one published metric, event or status.
+type Record struct {
+	// Timestamp is when the agent published it, RFC 3339 in UTC with
+	// milliseconds.
+	Timestamp string          `json:"timestamp"`
+	DeviceID  string          `json:"device_id"`
+	Kind      string          `json:"kind"` // "metric", "event" or "status"
+	Type      string          `json:"type"` // e.g. "system", "audit"
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Sink appends records to the current file.
+type Sink struct {
+	cfg      config.FileSinkConfig
+	compress bool
+	deviceID string
+	ext      string
+
+	mu     sync.Mutex
+	f      *os.File
+	path   string
+	size   int64
+	opened time.Time
+	day    string
+	failed bool // a write error was logged and not yet recovered from
+
+	// wg tracks compression of rotated files; retention serialises the
+	// clean-ups that follow it.
+	wg        sync.WaitGroup
+	retention sync.Mutex
+}
+
+// New returns a Sink writing under cfg.Dir. Files left uncompressed by an
+// earlier run are compressed in the background.
+func New(cfg config.FileSinkConfig, deviceID string) (*Sink, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = defaultDir
+	}
+	if cfg.Format == "" {
+		cfg.Format = "ndjson"
+	}
+	if cfg.MaxFileMB <= 0 {
+		cfg.MaxFileMB = defaultMaxFileMB
+	}
+	if cfg.RotateMinutes <= 0 {
+		cfg.RotateMinutes = defaultRotateMinutes
+	}
+	if cfg.MaxTotalMB <= 0 {
+		cfg.MaxTotalMB = defaultMaxTotalMB
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	s := &Sink{
+		cfg:      cfg,
+		compress: cfg.Compress == nil || *cfg.Compress,
+		deviceID: deviceID,
+		ext:      "." + cfg.Format,
+	}
+
+	var leftover []string
+	filepath.WalkDir(cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil || d.IsDir():
+		case strings.HasSuffix(path, ".tmp"):
+			os.Remove(path) // interrupted compression
+		case strings.HasSuffix(path, ".ndjson") || strings.HasSuffix(path, ".csv"):
+			leftover = append(leftover, path)
+		}
+		return nil
+	})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for _, path := range leftover {
+			s.finish(path)
+		}
+		s.enforceRetention()
+	}()
+	return s, nil
+}
+
+// Write appends a record. kind is "metric", "event" or "status".
+func (s *Sink) Write(kind, name string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("File sink: %s %s: %v", kind, name, err)
+		return
+	}
+	now := time.Now().UTC()
+	rec := Record{
+		Timestamp: now.Format(timestampLayout),
+		DeviceID:  s.deviceID,
+		Kind:      kind,
+		Type:      name,
+		Payload:   data,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rotateIfNeeded(now); err != nil {
+		s.writeFailed(err)
+		return
+	}
+	n, err := s.encode(rec)
+	s.size += n
+	if err != nil {
+		s.writeFailed(err)
+		return
+	}
+	if s.failed {
+		log.Printf("File sink: writing to %s again", s.path)
+		s.failed = false
+	}
+}
+
+// writeFailed logs the first of a run of write errors; the next record
+// retries, e.g. once space has been freed.
+func (s *Sink) writeFailed(err error) {
+	if !s.failed {
+		log.Printf("File sink: %v", err)
+		s.failed = true
+	}
+}
+
+func (s *Sink) encode(rec Record) (int64, error) {
+	if s.cfg.Format == "csv" {
+		cw := &countingWriter{w: s.f}
+		w := csv.NewWriter(cw)
+		w.Write([]string{rec.Timestamp, rec.DeviceID, rec.Kind, rec.Type, string(rec.Payload)})
+		w.Flush()
+		return cw.n, w.Error()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	return int64(n), err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rotateIfNeeded starts a new file at the first write, on a new UTC day,
+// and when the current one reaches its size or age limit.
+func (s *Sink) rotateIfNeeded(now time.Time) error {
+	day := now.Format(dayLayout)
+	if s.f != nil &&
+		day == s.day &&
+		s.size < int64(s.cfg.MaxFileMB)<<20 &&
+		now.Sub(s.opened) < time.Duration(s.cfg.RotateMinutes)*time.Minute {
+		return nil
+	}
+	s.closeCurrent()
+
+	dir := filepath.Join(s.cfg.Dir, day)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, safeName(s.deviceID)+"_"+now.Format(fileTimeLayout))
+	var f *os.File
+	var path string
+	var err error
+	// A second file within the same second gets a suffix.
+	for i := 0; i < 100; i++ {
+		path = base + s.ext
+		if i > 0 {
+			path = fmt.Sprintf("%s-%d%s", base, i, s.ext)
+		}
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.f, s.path, s.size, s.opened, s.day = f, path, 0, now, day
+	if s.cfg.Format == "csv" {
+		w := csv.NewWriter(f)
+		w.Write(csvHeader)
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// closeCurrent closes the current file and hands it to compression and
+// retention.
+func (s *Sink) closeCurrent() {
+	if s.f == nil {
+		return
+	}
+	s.f.Close()
+	path := s.path
+	s.f, s.path = nil, ""
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.finish(path)
+		s.enforceRetention()
+	}()
+}
+
+// finish compresses a closed file, replacing it with path.gz.
+func (s *Sink) finish(path string) {
+	if !s.compress {
+		return
+	}
+	if err := gzipFile(path); err != nil {
+		log.Printf("File sink: compress %s: %v", path, err)
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// enforceRetention deletes the oldest closed files until the directory is
+// within MaxTotalMB, and any older than RetentionDays. Emptied date
+// directories are removed.
+func (s *Sink) enforceRetention() {
+	s.retention.Lock()
+	defer s.retention.Unlock()
+	s.mu.Lock()
+	current := s.path
+	s.mu.Unlock()
+
+	type file struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var files []file
+	var total int64
+	filepath.WalkDir(s.cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case path == current:
+			total += info.Size()
+		case s.compress && !strings.HasSuffix(path, ".gz"):
+			// Still awaiting compression; counted once compressed.
+		default:
+			total += info.Size()
+			files = append(files, file{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+
+	limit := int64(s.cfg.MaxTotalMB) << 20
+	var cutoff time.Time
+	if s.cfg.RetentionDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -s.cfg.RetentionDays)
+	}
+	for _, f := range files {
+		if total <= limit && !f.mod.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("File sink: retention: %v", err)
+			continue
+		}
+		total -= f.size
+		// Fails while the directory still holds other files.
+		os.Remove(filepath.Dir(f.path))
+	}
+}
+
+// Close closes the current file and waits for pending compression. The
+// last file is compressed too, so the directory is ready to be copied.
+func (s *Sink) Close() {
+	s.mu.Lock()
+	s.closeCurrent()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// safeName keeps a device ID usable as a file name.
+func safeName(id string) string {
+	if id == "" {
+		return "device"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, id)
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package gpio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	i2cSlave        = 0x0703
+	bme280ChipID    = 0x60
+	bme280RegID     = 0xD0
+	bme280RegCalib1 = 0x88
+	bme280RegCalib2 = 0xE1
+	bme280RegHum    = 0xF2
+	bme280RegMeas   = 0xF4
+	bme280RegData   = 0xF7
+)
+
+type bme280Calibration struct {
+	T1             uint16
+	T2, T3         int16
+	P1             uint16
+	P2, P3, P4, P5 int16
+	P6, P7, P8, P9 int16
+	H1             uint8
+	H2             int16
+	H3             uint8
+	H4, H5         int16
+	H6             int8
+}
+
+func i2cReadReg(f *os.File, reg byte, n int) ([]byte, error) {
+	if _, err := f.Write([]byte{reg}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := f.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readBME280 triggers a forced-mode measurement and returns temperature (°C),
+// relative humidity (%) and pressure (hPa) using the datasheet's floating
+// point compensation formulas.
+func readBME280(bus, addr int) (float64, float64, float64, error) {
+	if addr == 0 {
+		addr = 0x76
+	}
+	f, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	if err := unix.IoctlSetInt(int(f.Fd()), i2cSlave, addr); err != nil {
+		return 0, 0, 0, fmt.Errorf("select i2c address 0x%x: %w", addr, err)
+	}
+
+	id, err := i2cReadReg(f, bme280RegID, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if id[0] != bme280ChipID {
+		return 0, 0, 0, fmt.Errorf("unexpected chip id 0x%x at 0x%x", id[0], addr)
+	}
+
+	c1, err := i2cReadReg(f, bme280RegCalib1, 26)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	c2, err := i2cReadReg(f, bme280RegCalib2, 7)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	le := binary.LittleEndian
+	cal := bme280Calibration{
+		T1: le.Uint16(c1[0:]), T2: int16(le.Uint16(c1[2:])), T3: int16(le.Uint16(c1[4:])),
+		P1: le.Uint16(c1[6:]), P2: int16(le.Uint16(c1[8:])), P3: int16(le.Uint16(c1[10:])),
+		P4: int16(le.Uint16(c1[12:])), P5: int16(le.Uint16(c1[14:])), P6: int16(le.Uint16(c1[16:])),
+		P7: int16(le.Uint16(c1[18:])), P8: int16(le.Uint16(c1[20:])), P9: int16(le.Uint16(c1[22:])),
+		H1: c1[25],
+		H2: int16(le.Uint16(c2[0:])),
+		H3: c2[2],
+		H4: int16(int8(c2[3]))<<4 | int16(c2[4]&0x0F),
+		H5: int16(int8(c2[5]))<<4 | int16(c2[4]>>4),
+		H6: int8(c2[6]),
+	}
+
+	// Humidity x1, then temperature x1 / pressure x1 in forced mode.
+	if _, err := f.Write([]byte{bme280RegHum, 0x01}); err != nil {
+		return 0, 0, 0, err
+	}
+	if _, err := f.Write([]byte{bme280RegMeas, 0x25}); err != nil {
+		return 0, 0, 0, err
+	}
+	time.Sleep(15 * time.Millisecond)
+
+	d, err := i2cReadReg(f, bme280RegData, 8)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	adcP := float64(int32(d[0])<<12 | int32(d[1])<<4 | int32(d[2])>>4)
+	adcT := float64(int32(d[3])<<12 | int32(d[4])<<4 | int32(d[5])>>4)
+	adcH := float64(int32(d[6])<<8 | int32(d[7]))
+
+	v1 := (adcT/16384 - float64(cal.T1)/1024) * float64(cal.T2)
+	v2 := (adcT/131072 - float64(cal.T1)/8192) * (adcT/131072 - float64(cal.T1)/8192) * float64(cal.T3)
+	tFine := v1 + v2
+	temp := tFine / 5120
+
+	var press float64
+	p1 := tFine/2 - 64000
+	p2 := p1 * p1 * float64(cal.P6) / 32768
+	p2 += p1 * float64(cal.P5) * 2
+	p2 = p2/4 + float64(cal.P4)*65536
+	p1 = (float64(cal.P3)*p1*p1/524288 + float64(cal.P2)*p1) / 524288
+	p1 = (1 + p1/32768) * float64(cal.P1)
+	if p1 != 0 {
+		press = 1048576 - adcP
+		press = (press - p2/4096) * 6250 / p1
+		p1 = float64(cal.P9) * press * press / 2147483648
+		p2 = press * float64(cal.P8) / 32768
+		press += (p1 + p2 + float64(cal.P7)) / 16
+	}
+
+	h := tFine - 76800
+	h = (adcH - (float64(cal.H4)*64 + float64(cal.H5)/16384*h)) *
+		(float64(cal.H2) / 65536 * (1 + float64(cal.H6)/67108864*h*(1+float64(cal.H3)/67108864*h)))
+	h = h * (1 - float64(cal.H1)*h/524288)
+	if h > 100 {
+		h = 100
+	} else if h < 0 {
+		h = 0
+	}
+
+	return temp, h, press / 100, nil
+}
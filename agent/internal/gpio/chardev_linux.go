@@ -0,0 +1,169 @@
+//go:build linux
+
+package gpio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// GPIO character device uAPI v2 (linux/gpio.h).
+const (
+	gpioV2LinesMax        = 64
+	gpioV2NumAttrsMax     = 10
+	gpioMaxNameSize       = 32
+	gpioV2GetLineIoctl    = 0xC250B407 // _IOWR(0xB4, 0x07, struct gpio_v2_line_request)
+	gpioV2GetValuesIoctl  = 0xC010B40E // _IOWR(0xB4, 0x0E, struct gpio_v2_line_values)
+	gpioV2FlagActiveLow   = 1 << 1
+	gpioV2FlagInput       = 1 << 2
+	gpioV2FlagEdgeRising  = 1 << 4
+	gpioV2FlagEdgeFalling = 1 << 5
+	gpioV2FlagPullUp      = 1 << 8
+	gpioV2FlagPullDown    = 1 << 9
+	gpioV2FlagBiasOff     = 1 << 10
+	gpioV2AttrDebounce    = 3
+	gpioV2EventRising     = 1
+	gpioV2LineEventSize   = 48
+)
+
+// All 64-bit fields below sit at 8-byte offsets, so the layout matches the
+// kernel's __aligned_u64 structs on both 32- and 64-bit ARM.
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [gpioV2NumAttrsMax]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [gpioV2LinesMax]uint32
+	Consumer        [gpioMaxNameSize]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+type chardevLine struct {
+	// fd is kept separately: calling file.Fd() would switch the descriptor
+	// back to blocking mode.
+	fd   uintptr
+	file *os.File
+}
+
+func ioctlPtr(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// watchLine requests a single input line with edge detection and starts a
+// goroutine that reports every edge through emit.
+func watchLine(in config.GPIOInput, emit func(config.GPIOInput, bool)) (lineWatcher, error) {
+	chipPath := in.Chip
+	if !strings.HasPrefix(chipPath, "/") {
+		chipPath = filepath.Join("/dev", chipPath)
+	}
+	chip, err := os.OpenFile(chipPath, os.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer chip.Close()
+
+	var req gpioV2LineRequest
+	req.Offsets[0] = uint32(in.Line)
+	copy(req.Consumer[:gpioMaxNameSize-1], "iotmonitor-"+in.Name)
+	req.NumLines = 1
+	req.Config.Flags = gpioV2FlagInput | gpioV2FlagEdgeRising | gpioV2FlagEdgeFalling
+	if in.ActiveLow {
+		req.Config.Flags |= gpioV2FlagActiveLow
+	}
+	switch in.Bias {
+	case "pull_up":
+		req.Config.Flags |= gpioV2FlagPullUp
+	case "pull_down":
+		req.Config.Flags |= gpioV2FlagPullDown
+	case "disabled":
+		req.Config.Flags |= gpioV2FlagBiasOff
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown bias %q", in.Bias)
+	}
+	if in.DebounceMs > 0 {
+		req.Config.NumAttrs = 1
+		req.Config.Attrs[0] = gpioV2LineConfigAttribute{
+			Attr: gpioV2LineAttribute{ID: gpioV2AttrDebounce, Value: uint64(in.DebounceMs) * 1000},
+			Mask: 1,
+		}
+	}
+
+	if err := ioctlPtr(chip.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("request line %d on %s: %w", in.Line, in.Chip, err)
+	}
+
+	// Non-blocking so reads go through the runtime poller and Close
+	// interrupts a pending read.
+	if err := unix.SetNonblock(int(req.Fd), true); err != nil {
+		unix.Close(int(req.Fd))
+		return nil, err
+	}
+	line := &chardevLine{
+		fd:   uintptr(req.Fd),
+		file: os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s-line%d", in.Chip, in.Line)),
+	}
+	go line.readEvents(in, emit)
+	return line, nil
+}
+
+func (l *chardevLine) readEvents(in config.GPIOInput, emit func(config.GPIOInput, bool)) {
+	buf := make([]byte, gpioV2LineEventSize*16)
+	for {
+		n, err := l.file.Read(buf)
+		if err != nil {
+			// The file is closed on shutdown; anything else ends the watch too.
+			return
+		}
+		for off := 0; off+gpioV2LineEventSize <= n; off += gpioV2LineEventSize {
+			id := binary.NativeEndian.Uint32(buf[off+8:])
+			// Rising means the line became active (active_low already applied).
+			emit(in, id == gpioV2EventRising)
+		}
+	}
+}
+
+func (l *chardevLine) Value() (bool, error) {
+	vals := gpioV2LineValues{Mask: 1}
+	if err := ioctlPtr(l.fd, gpioV2GetValuesIoctl, unsafe.Pointer(&vals)); err != nil {
+		return false, err
+	}
+	return vals.Bits&1 == 1, nil
+}
+
+func (l *chardevLine) Close() error {
+	return l.file.Close()
+}
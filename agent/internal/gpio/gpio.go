@@ -0,0 +1,210 @@
+// Package gpio reads environmental inputs on single-board agents: dry-contact
+// inputs via the GPIO character device, DS18B20 1-Wire temperature sensors via
+// sysfs and BME280 sensors over I2C.
+package gpio
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// InputState is the current level of a dry-contact input.
+type InputState struct {
+	Name   string `json:"name"`
+	Chip   string `json:"chip"`
+	Line   int    `json:"line"`
+	Active bool   `json:"active"`
+	Error  string `json:"error,omitempty"`
+}
+
+// InputEvent is emitted when an input changes state.
+type InputEvent struct {
+	Name      string `json:"name"`
+	Chip      string `json:"chip"`
+	Line      int    `json:"line"`
+	Active    bool   `json:"active"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type TemperatureReading struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Celsius float64 `json:"celsius"`
+}
+
+type EnvironmentReading struct {
+	Name        string  `json:"name"`
+	Celsius     float64 `json:"celsius"`
+	HumidityPct float64 `json:"humidity_pct"`
+	PressureHPa float64 `json:"pressure_hpa"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type Metrics struct {
+	Inputs       []InputState         `json:"inputs"`
+	Temperatures []TemperatureReading `json:"temperatures"`
+	Environment  []EnvironmentReading `json:"environment"`
+	Timestamp    int64                `json:"timestamp"`
+}
+
+// lineWatcher is implemented per platform; it holds a requested GPIO line
+// and reports edges until closed.
+type lineWatcher interface {
+	Value() (bool, error)
+	Close() error
+}
+
+type input struct {
+	cfg     config.GPIOInput
+	watcher lineWatcher
+	err     error
+}
+
+// Monitor owns the requested GPIO lines and samples the sensors.
+type Monitor struct {
+	cfg     config.GPIOConfig
+	onEvent func(InputEvent)
+	oneWire string // 1-Wire devices directory
+
+	mu     sync.Mutex
+	inputs []*input
+}
+
+// New requests the configured input lines. Lines that can't be requested are
+// reported with an error in every sample instead of failing the module.
+// hostPaths.Sys, when set, replaces /sys for the 1-Wire sensors.
+func New(cfg config.GPIOConfig, hostPaths collect.HostPaths, onEvent func(InputEvent)) *Monitor {
+	sys := hostPaths.Sys
+	if sys == "" {
+		sys = "/sys"
+	}
+	m := &Monitor{cfg: cfg, onEvent: onEvent, oneWire: filepath.Join(sys, "bus", "w1", "devices")}
+	for _, in := range cfg.Inputs {
+		if in.Chip == "" {
+			in.Chip = "gpiochip0"
+		}
+		if in.Name == "" {
+			in.Name = in.Chip + ":" + strconv.Itoa(in.Line)
+		}
+		entry := &input{cfg: in}
+		entry.watcher, entry.err = watchLine(in, m.emit)
+		if entry.err != nil {
+			log.Printf("GPIO input %s unavailable: %v", in.Name, entry.err)
+		}
+		m.inputs = append(m.inputs, entry)
+	}
+	return m
+}
+
+func (m *Monitor) emit(in config.GPIOInput, active bool) {
+	if m.onEvent == nil {
+		return
+	}
+	m.onEvent(InputEvent{
+		Name:      in.Name,
+		Chip:      in.Chip,
+		Line:      in.Line,
+		Active:    active,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// Collect samples all inputs and sensors.
+func (m *Monitor) Collect() *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metrics := &Metrics{
+		Inputs:       []InputState{},
+		Temperatures: []TemperatureReading{},
+		Environment:  []EnvironmentReading{},
+		Timestamp:    time.Now().Unix(),
+	}
+
+	for _, in := range m.inputs {
+		state := InputState{Name: in.cfg.Name, Chip: in.cfg.Chip, Line: in.cfg.Line}
+		if in.err != nil {
+			state.Error = in.err.Error()
+		} else if v, err := in.watcher.Value(); err != nil {
+			state.Error = err.Error()
+		} else {
+			state.Active = v
+		}
+		metrics.Inputs = append(metrics.Inputs, state)
+	}
+
+	if m.cfg.OneWire {
+		metrics.Temperatures = readOneWire(m.oneWire, m.cfg.OneWireNames)
+	}
+
+	for _, sensor := range m.cfg.BME280 {
+		reading := EnvironmentReading{Name: sensor.Name}
+		if reading.Name == "" {
+			reading.Name = "bme280-" + strconv.Itoa(sensor.Bus) + "-" + strconv.FormatInt(int64(sensor.Address), 16)
+		}
+		c, h, p, err := readBME280(sensor.Bus, sensor.Address)
+		if err != nil {
+			reading.Error = err.Error()
+		} else {
+			reading.Celsius, reading.HumidityPct, reading.PressureHPa = c, h, p
+		}
+		metrics.Environment = append(metrics.Environment, reading)
+	}
+
+	return metrics
+}
+
+// Close releases all requested lines.
+func (m *Monitor) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, in := range m.inputs {
+		if in.watcher != nil {
+			in.watcher.Close()
+		}
+	}
+}
+
+// readOneWire reads every DS18B20 (family code 28) exposed by the w1-therm
+// driver. Readings with a failed CRC are skipped.
+func readOneWire(root string, names map[string]string) []TemperatureReading {
+	readings := []TemperatureReading{}
+	devices, _ := filepath.Glob(filepath.Join(root, "28-*"))
+	for _, dev := range devices {
+		id := filepath.Base(dev)
+		data, err := os.ReadFile(filepath.Join(dev, "w1_slave"))
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) < 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+			continue
+		}
+		_, raw, ok := strings.Cut(lines[1], "t=")
+		if !ok {
+			continue
+		}
+		milli, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			continue
+		}
+		name := names[id]
+		if name == "" {
+			name = id
+		}
+		readings = append(readings, TemperatureReading{
+			ID:      id,
+			Name:    name,
+			Celsius: float64(milli) / 1000,
+		})
+	}
+	return readings
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package gpio
+
+import (
+	"errors"
+
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+var errUnsupported = errors.New("gpio module is only supported on Linux")
+
+func watchLine(config.GPIOInput, func(config.GPIOInput, bool)) (lineWatcher, error) {
+	return nil, errUnsupported
+}
+
+func readBME280(int, int) (float64, float64, float64, error) {
+	return 0, 0, 0, errUnsupported
+}
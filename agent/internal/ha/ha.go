@@ -0,0 +1,266 @@
+// Package ha reports the state of active/standby clusters: keepalived VRRP
+// instances, Pacemaker nodes and resources, and which node holds each
+// virtual IP. A change of master, a VIP moving to or from this node or a
+// resource moving between nodes is reported as a failover event.
+package ha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// VIP is a configured virtual IP. Holder is the node holding it: this node
+// when Local, otherwise the node running its Pacemaker resource, if known.
+type VIP struct {
+	Address   string `json:"address"`
+	Local     bool   `json:"local"`
+	Interface string `json:"interface,omitempty"`
+	Holder    string `json:"holder,omitempty"`
+	// unknown marks a VIP whose holder couldn't be read this sample
+	// because crm_mon failed.
+	unknown bool
+}
+
+// Metrics is published as the "ha" metric.
+type Metrics struct {
+	Node string `json:"node"`
+	// Role is "active" when this node holds a VIP (or, without VIPs, is
+	// master of a VRRP instance or runs an IP address resource),
+	// "standby" when it doesn't and "" without any cluster information.
+	Role      string         `json:"role"`
+	VRRP      []VRRPInstance `json:"vrrp"`
+	Pacemaker *Cluster       `json:"pacemaker,omitempty"`
+	VIPs      []VIP          `json:"vips"`
+	Errors    []string       `json:"errors,omitempty"`
+	Timestamp int64          `json:"timestamp"`
+}
+
+// Failover is published as an "ha_failover" event. Source is "vrrp" (From
+// and To are states), "vip" or "pacemaker" (From and To are nodes, comma
+// separated when a resource runs on several; "another node" when a VIP's
+// holder isn't known).
+type Failover struct {
+	Source    string `json:"source"`
+	Name      string `json:"name"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Node      string `json:"node"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Monitor samples the cluster state on each Collect.
+type Monitor struct {
+	cfg     config.HAConfig
+	root    string
+	onEvent func(Failover)
+	node    string
+
+	mu sync.Mutex
+	// last holds each tracked item's previous state, keyed by
+	// "<source>:<name>"; nil before the first sample.
+	last map[string]string
+}
+
+// New returns a Monitor. hostPaths.Root prefixes the state file globs in
+// host mode.
+func New(cfg config.HAConfig, hostPaths collect.HostPaths, onEvent func(Failover)) *Monitor {
+	node, _ := os.Hostname()
+	return &Monitor{cfg: cfg, root: hostPaths.Root, onEvent: onEvent, node: node}
+}
+
+// Collect reads every source and emits failover events for changes since
+// the previous sample.
+func (m *Monitor) Collect(ctx context.Context) *Metrics {
+	mt := &Metrics{Node: m.node, VRRP: []VRRPInstance{}, VIPs: []VIP{}, Timestamp: time.Now().Unix()}
+	fail := func(source string, err error) {
+		mt.Errors = append(mt.Errors, fmt.Sprintf("%s: %v", source, err))
+	}
+
+	if m.cfg.DBus == nil || *m.cfg.DBus {
+		instances, err := dbusInstances(ctx)
+		if err != nil {
+			fail("keepalived dbus", err)
+		}
+		mt.VRRP = append(mt.VRRP, instances...)
+	}
+	instances, errs := fileInstances(m.root, m.cfg.StateFiles)
+	for _, err := range errs {
+		fail("keepalived state file", err)
+	}
+	mt.VRRP = append(mt.VRRP, instances...)
+
+	pacemakerFailed := false
+	if m.cfg.Pacemaker == nil || *m.cfg.Pacemaker {
+		cluster, err := pacemakerCluster(ctx)
+		switch {
+		case errors.Is(err, errNoPacemaker):
+		case err != nil:
+			fail("pacemaker", err)
+			pacemakerFailed = true
+		default:
+			cluster.LocalNode = localNode(m.node, cluster.Nodes)
+			mt.Pacemaker = cluster
+		}
+	}
+
+	local := localAddrs()
+	for _, v := range m.cfg.VIPs {
+		vip := VIP{Address: v.Address}
+		if ip := net.ParseIP(v.Address); ip != nil {
+			vip.Interface, vip.Local = local[ip.String()]
+		}
+		switch {
+		case vip.Local:
+			vip.Holder = m.node
+			if mt.Pacemaker != nil && mt.Pacemaker.LocalNode != "" {
+				vip.Holder = mt.Pacemaker.LocalNode
+			}
+		case v.Resource != "" && mt.Pacemaker != nil:
+			for _, r := range mt.Pacemaker.Resources {
+				if r.ID == v.Resource {
+					vip.Holder = strings.Join(r.Nodes, ",")
+				}
+			}
+		case v.Resource != "" && pacemakerFailed:
+			vip.unknown = true
+		}
+		mt.VIPs = append(mt.VIPs, vip)
+	}
+
+	mt.Role = role(mt)
+	m.detect(mt)
+	return mt
+}
+
+// role derives this node's role from the most direct evidence available.
+func role(mt *Metrics) string {
+	if len(mt.VIPs) > 0 {
+		for _, v := range mt.VIPs {
+			if v.Local {
+				return "active"
+			}
+		}
+		return "standby"
+	}
+	if len(mt.VRRP) > 0 {
+		for _, v := range mt.VRRP {
+			if v.State == "MASTER" {
+				return "active"
+			}
+		}
+		return "standby"
+	}
+	if c := mt.Pacemaker; c != nil && c.LocalNode != "" {
+		seen := false
+		for _, r := range c.Resources {
+			if !strings.Contains(strings.ToLower(r.Agent), "ipaddr") {
+				continue
+			}
+			seen = true
+			for _, n := range r.Nodes {
+				if n == c.LocalNode {
+					return "active"
+				}
+			}
+		}
+		if seen {
+			return "standby"
+		}
+	}
+	return ""
+}
+
+// detect compares tracked states with the previous sample. Items that
+// disappear (keepalived restarting, crm_mon failing) aren't failovers and
+// are forgotten until they come back; that includes VIPs whose holder is
+// only known from crm_mon.
+func (m *Monitor) detect(mt *Metrics) {
+	cur := map[string]string{}
+	for _, v := range mt.VRRP {
+		if v.State != "" {
+			cur["vrrp:"+v.Name] = v.State
+		}
+	}
+	for _, v := range mt.VIPs {
+		if v.unknown {
+			continue
+		}
+		holder := v.Holder
+		if holder == "" {
+			holder = "another node"
+		}
+		cur["vip:"+v.Address] = holder
+	}
+	if mt.Pacemaker != nil {
+		for _, r := range mt.Pacemaker.Resources {
+			if loc := r.location(); loc != "" {
+				cur["pacemaker:"+r.ID] = loc
+			}
+		}
+	}
+
+	m.mu.Lock()
+	prev := m.last
+	m.last = cur
+	m.mu.Unlock()
+	if prev == nil || m.onEvent == nil {
+		return
+	}
+	for key, to := range cur {
+		from, ok := prev[key]
+		if !ok || from == to {
+			continue
+		}
+		source, name, _ := strings.Cut(key, ":")
+		m.onEvent(Failover{
+			Source:    source,
+			Name:      name,
+			From:      from,
+			To:        to,
+			Node:      m.node,
+			Timestamp: mt.Timestamp,
+		})
+	}
+}
+
+// localNode matches the hostname to a Pacemaker node name, which may be
+// the short name.
+func localNode(hostname string, nodes []Node) string {
+	short, _, _ := strings.Cut(hostname, ".")
+	for _, n := range nodes {
+		if n.Name == hostname || n.Name == short {
+			return n.Name
+		}
+	}
+	return ""
+}
+
+// localAddrs maps this host's IP addresses to their interfaces.
+func localAddrs() map[string]string {
+	addrs := map[string]string{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+	for _, iface := range ifaces {
+		as, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range as {
+			if ipn, ok := a.(*net.IPNet); ok {
+				addrs[ipn.IP.String()] = iface.Name
+			}
+		}
+	}
+	return addrs
+}
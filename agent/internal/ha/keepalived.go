@@ -0,0 +1,140 @@
+package ha
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const vrrpService = "org.keepalived.Vrrp1"
+
+// VRRPInstance is one keepalived VRRP instance on this node.
+type VRRPInstance struct {
+	Name      string `json:"name"`
+	Interface string `json:"interface,omitempty"`
+	VRID      int    `json:"vrid,omitempty"`
+	Family    string `json:"family,omitempty"` // IPv4 or IPv6
+	// State is MASTER, BACKUP, FAULT, INIT or STOP.
+	State    string `json:"state"`
+	Priority int    `json:"priority,omitempty"`
+	Source   string `json:"source"` // "dbus" or "file"
+}
+
+// normalizeState maps keepalived's spellings ("Master", "MASTER") to one.
+func normalizeState(s string) string {
+	s = strings.ToUpper(strings.Trim(s, `"`))
+	switch s {
+	case "MASTER", "BACKUP", "FAULT", "INIT", "STOP":
+		return s
+	}
+	return ""
+}
+
+// dbusInstances lists the instances keepalived exports over D-Bus at
+// /org/keepalived/Vrrp1/Instance/<interface>/<vrid>/<family>. It returns
+// nil without an error when busctl or the service isn't there.
+func dbusInstances(ctx context.Context) ([]VRRPInstance, error) {
+	out, err := exec.CommandContext(ctx, "busctl", "--system", "--list", "tree", vrrpService).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.Is(err, exec.ErrNotFound) || errors.As(err, &exitErr) {
+			return nil, nil // no busctl, or keepalived isn't on the bus
+		}
+		return nil, err
+	}
+	var instances []VRRPInstance
+	for _, path := range strings.Fields(string(out)) {
+		parts := strings.Split(strings.TrimPrefix(path, "/org/keepalived/Vrrp1/Instance/"), "/")
+		if len(parts) != 3 || !strings.HasPrefix(path, "/org/keepalived/Vrrp1/Instance/") {
+			continue
+		}
+		vrid, _ := strconv.Atoi(parts[1])
+		inst := VRRPInstance{Interface: parts[0], VRID: vrid, Family: parts[2], Source: "dbus"}
+		props, err := exec.CommandContext(ctx, "busctl", "--system", "get-property",
+			vrrpService, path, vrrpService+".Instance", "Name", "State").Output()
+		if err != nil {
+			return instances, err
+		}
+		// One line per property: `s "VI_1"` and `(us) 2 "Master"`.
+		lines := strings.Split(strings.TrimSpace(string(props)), "\n")
+		if len(lines) == 2 {
+			inst.Name = lastQuoted(lines[0])
+			inst.State = normalizeState(lastQuoted(lines[1]))
+		}
+		if inst.Name == "" {
+			inst.Name = parts[0] + "/" + parts[1]
+		}
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+func lastQuoted(s string) string {
+	end := strings.LastIndexByte(s, '"')
+	if end <= 0 {
+		return ""
+	}
+	start := strings.LastIndexByte(s[:end], '"')
+	if start < 0 {
+		return ""
+	}
+	return s[start+1 : end]
+}
+
+// fileInstances reads the state files matching the globs under root.
+func fileInstances(root string, globs []string) ([]VRRPInstance, []error) {
+	var instances []VRRPInstance
+	var errs []error
+	seen := map[string]bool{}
+	for _, glob := range globs {
+		paths, err := filepath.Glob(filepath.Join(root, glob))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			inst, err := readStateFile(path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			instances = append(instances, inst)
+		}
+	}
+	return instances, errs
+}
+
+func readStateFile(path string) (VRRPInstance, error) {
+	base := filepath.Base(path)
+	inst := VRRPInstance{Name: strings.TrimSuffix(base, filepath.Ext(base)), Source: "file"}
+	f, err := os.Open(path)
+	if err != nil {
+		return inst, err
+	}
+	defer f.Close()
+	// The last line wins when a notify script appends.
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch {
+		case len(fields) >= 3 && (fields[0] == "INSTANCE" || fields[0] == "GROUP"):
+			inst.Name = strings.Trim(fields[1], `"`)
+			inst.State = normalizeState(fields[2])
+			if len(fields) >= 4 {
+				inst.Priority, _ = strconv.Atoi(fields[3])
+			}
+		case len(fields) >= 1 && normalizeState(fields[0]) != "":
+			inst.State = normalizeState(fields[0])
+		}
+	}
+	return inst, sc.Err()
+}
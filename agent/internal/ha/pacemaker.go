@@ -0,0 +1,213 @@
+package ha
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Cluster is the Pacemaker view of the cluster.
+type Cluster struct {
+	DC        string     `json:"dc,omitempty"`
+	Quorum    bool       `json:"quorum"`
+	LocalNode string     `json:"local_node,omitempty"`
+	Nodes     []Node     `json:"nodes"`
+	Resources []Resource `json:"resources"`
+}
+
+type Node struct {
+	Name             string `json:"name"`
+	Online           bool   `json:"online"`
+	Standby          bool   `json:"standby,omitempty"`
+	Maintenance      bool   `json:"maintenance,omitempty"`
+	Unclean          bool   `json:"unclean,omitempty"`
+	DC               bool   `json:"dc,omitempty"`
+	ResourcesRunning int    `json:"resources_running"`
+}
+
+// Resource is a primitive resource. Clone instances are merged into one
+// Resource running on several nodes; Promoted lists where a promotable
+// clone is promoted.
+type Resource struct {
+	ID       string   `json:"id"`
+	Agent    string   `json:"agent"`
+	Group    string   `json:"group,omitempty"`
+	Clone    string   `json:"clone,omitempty"`
+	Role     string   `json:"role"`
+	Active   bool     `json:"active"`
+	Failed   bool     `json:"failed,omitempty"`
+	Managed  bool     `json:"managed"`
+	Nodes    []string `json:"nodes"`
+	Promoted []string `json:"promoted,omitempty"`
+}
+
+// crmMon covers both crm_mon --output-as=xml (Pacemaker 2) and the older
+// --as-xml output, which share these elements.
+type crmMon struct {
+	Summary struct {
+		CurrentDC struct {
+			Name       string `xml:"name,attr"`
+			WithQuorum bool   `xml:"with_quorum,attr"`
+		} `xml:"current_dc"`
+	} `xml:"summary"`
+	Nodes     []crmNode `xml:"nodes>node"`
+	Resources struct {
+		Resources []crmResource `xml:"resource"`
+		Groups    []crmGroup    `xml:"group"`
+		Clones    []struct {
+			ID        string        `xml:"id,attr"`
+			Resources []crmResource `xml:"resource"`
+			Groups    []crmGroup    `xml:"group"`
+		} `xml:"clone"`
+	} `xml:"resources"`
+}
+
+type crmNode struct {
+	Name             string `xml:"name,attr"`
+	Online           bool   `xml:"online,attr"`
+	Standby          bool   `xml:"standby,attr"`
+	Maintenance      bool   `xml:"maintenance,attr"`
+	Unclean          bool   `xml:"unclean,attr"`
+	IsDC             bool   `xml:"is_dc,attr"`
+	ResourcesRunning int    `xml:"resources_running,attr"`
+}
+
+type crmGroup struct {
+	ID        string        `xml:"id,attr"`
+	Resources []crmResource `xml:"resource"`
+}
+
+type crmResource struct {
+	ID      string `xml:"id,attr"`
+	Agent   string `xml:"resource_agent,attr"`
+	Role    string `xml:"role,attr"`
+	Active  bool   `xml:"active,attr"`
+	Failed  bool   `xml:"failed,attr"`
+	Managed bool   `xml:"managed,attr"`
+	Nodes   []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"node"`
+}
+
+// errNoPacemaker is returned when crm_mon isn't installed.
+var errNoPacemaker = errors.New("crm_mon not found")
+
+// pacemakerCluster runs crm_mon once, falling back to the pre-2.0 XML flag.
+func pacemakerCluster(ctx context.Context) (*Cluster, error) {
+	out, err := exec.CommandContext(ctx, "crm_mon", "-1", "--output-as=xml").Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errNoPacemaker
+	}
+	if err != nil {
+		out, err = exec.CommandContext(ctx, "crm_mon", "-1", "--as-xml").Output()
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return parseCrmMon(out)
+}
+
+func parseCrmMon(data []byte) (*Cluster, error) {
+	var mon crmMon
+	if err := xml.Unmarshal(data, &mon); err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		DC:        mon.Summary.CurrentDC.Name,
+		Quorum:    mon.Summary.CurrentDC.WithQuorum,
+		Nodes:     []Node{},
+		Resources: []Resource{},
+	}
+	for _, n := range mon.Nodes {
+		c.Nodes = append(c.Nodes, Node{
+			Name:             n.Name,
+			Online:           n.Online,
+			Standby:          n.Standby,
+			Maintenance:      n.Maintenance,
+			Unclean:          n.Unclean,
+			DC:               n.IsDC,
+			ResourcesRunning: n.ResourcesRunning,
+		})
+		if n.IsDC && c.DC == "" {
+			c.DC = n.Name
+		}
+	}
+	add := func(r crmResource, group, clone string) {
+		var nodes []string
+		for _, n := range r.Nodes {
+			nodes = append(nodes, n.Name)
+		}
+		promoted := r.Role == "Promoted" || r.Role == "Master"
+		if clone != "" {
+			// Clone instances share the primitive's ID; merge them.
+			for i := range c.Resources {
+				e := &c.Resources[i]
+				if e.ID == r.ID && e.Clone == clone {
+					e.Nodes = append(e.Nodes, nodes...)
+					if promoted {
+						e.Promoted = append(e.Promoted, nodes...)
+					}
+					e.Active = e.Active || r.Active
+					e.Failed = e.Failed || r.Failed
+					return
+				}
+			}
+		}
+		res := Resource{
+			ID:      r.ID,
+			Agent:   r.Agent,
+			Group:   group,
+			Clone:   clone,
+			Role:    r.Role,
+			Active:  r.Active,
+			Failed:  r.Failed,
+			Managed: r.Managed,
+			Nodes:   append([]string{}, nodes...),
+		}
+		if clone != "" && promoted {
+			res.Promoted = nodes
+		}
+		c.Resources = append(c.Resources, res)
+	}
+	for _, r := range mon.Resources.Resources {
+		add(r, "", "")
+	}
+	for _, g := range mon.Resources.Groups {
+		for _, r := range g.Resources {
+			add(r, g.ID, "")
+		}
+	}
+	for _, cl := range mon.Resources.Clones {
+		for _, r := range cl.Resources {
+			add(r, "", cl.ID)
+		}
+		for _, g := range cl.Groups {
+			for _, r := range g.Resources {
+				add(r, g.ID, cl.ID)
+			}
+		}
+	}
+	for i := range c.Resources {
+		slices.Sort(c.Resources[i].Nodes)
+		c.Resources[i].Nodes = slices.Compact(c.Resources[i].Nodes)
+		slices.Sort(c.Resources[i].Promoted)
+	}
+	return c, nil
+}
+
+// location is where a resource counts as placed for failover: the nodes
+// running it, or for a clone the nodes where it is promoted (running a
+// clone everywhere is not a failover).
+func (r Resource) location() string {
+	if r.Clone != "" {
+		return strings.Join(r.Promoted, ",")
+	}
+	return strings.Join(r.Nodes, ",")
+}
@@ -0,0 +1,376 @@
+// Package iotbridge subscribes to a site's local MQTT broker (Tasmota,
+// Zigbee2MQTT, Shelly and similar devices) and forwards mapped readings as
+// virtual devices. Backend commands are mapped back onto LAN topics.
+package iotbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+// Virtual devices not heard from for this long are dropped from samples.
+const staleAfter = 24 * time.Hour
+
+// VirtualDevice is the latest mapped state of one LAN device.
+type VirtualDevice struct {
+	ID       string             `json:"id"`
+	Device   string             `json:"device"`
+	Template string             `json:"template"`
+	Metrics  map[string]float64 `json:"metrics"`
+	States   map[string]string  `json:"states,omitempty"`
+	LastSeen int64              `json:"last_seen"`
+}
+
+type Metrics struct {
+	Connected bool            `json:"connected"`
+	Devices   []VirtualDevice `json:"devices"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+type template struct {
+	config.BridgeTemplate
+	filter      string
+	deviceLevel int
+	exclude     map[string]bool
+}
+
+// Bridge holds the LAN broker connection and the latest device states.
+type Bridge struct {
+	client    mqtt.Client
+	templates []*template
+
+	mu      sync.Mutex
+	devices map[string]*VirtualDevice
+}
+
+func newTemplate(t config.BridgeTemplate) (*template, error) {
+	if t.Preset != "" {
+		preset, ok := presets[t.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown iotbridge preset %q", t.Preset)
+		}
+		if t.Name == "" {
+			t.Name = t.Preset
+		}
+		if t.Topic == "" {
+			t.Topic = preset.Topic
+		}
+		if t.Fields == nil {
+			t.Fields = preset.Fields
+		}
+		if t.Commands == nil {
+			t.Commands = preset.Commands
+		}
+		if t.ExcludeDevices == nil {
+			t.ExcludeDevices = preset.ExcludeDevices
+		}
+	}
+	if t.Name == "" || t.Topic == "" {
+		return nil, errors.New("iotbridge template needs a name and topic")
+	}
+
+	tpl := &template{BridgeTemplate: t, deviceLevel: -1, exclude: map[string]bool{}}
+	levels := strings.Split(t.Topic, "/")
+	for i, level := range levels {
+		if level == "{device}" {
+			tpl.deviceLevel = i
+			levels[i] = "+"
+		}
+	}
+	if tpl.deviceLevel < 0 {
+		return nil, fmt.Errorf("iotbridge template %s: topic %q has no {device} level", t.Name, t.Topic)
+	}
+	tpl.filter = strings.Join(levels, "/")
+	for _, d := range t.ExcludeDevices {
+		tpl.exclude[d] = true
+	}
+	return tpl, nil
+}
+
+// New connects to the LAN broker and subscribes to every template's topic.
+// Subscriptions are re-established on reconnect.
+func New(cfg config.IoTBridgeConfig, agentDeviceID string) (*Bridge, error) {
+	if cfg.BrokerURL == "" {
+		return nil, errors.New("iotbridge broker_url is not configured")
+	}
+	b := &Bridge{devices: map[string]*VirtualDevice{}}
+	for _, t := range cfg.Templates {
+		tpl, err := newTemplate(t)
+		if err != nil {
+			return nil, err
+		}
+		b.templates = append(b.templates, tpl)
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "iotmonitor-bridge-" + agentDeviceID
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.BrokerURL)
+	opts.SetClientID(clientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.OnConnect = func(c mqtt.Client) {
+		log.Printf("iotbridge connected to %s", cfg.BrokerURL)
+		for _, tpl := range b.templates {
+			c.Subscribe(tpl.filter, 0, func(_ mqtt.Client, msg mqtt.Message) {
+				b.handle(tpl, msg.Topic(), msg.Payload())
+			})
+		}
+	}
+	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
+		log.Printf("iotbridge lost connection to %s: %v", cfg.BrokerURL, err)
+	}
+
+	b.client = mqtt.NewClient(opts)
+	// With ConnectRetry the token completes once the first attempt is made;
+	// the client keeps retrying in the background if the broker is down.
+	b.client.Connect().WaitTimeout(5 * time.Second)
+	return b, nil
+}
+
+func (b *Bridge) handle(tpl *template, topic string, payload []byte) {
+	levels := strings.Split(topic, "/")
+	if tpl.deviceLevel >= len(levels) {
+		return
+	}
+	device := levels[tpl.deviceLevel]
+	if tpl.exclude[device] {
+		return
+	}
+
+	var doc any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		// Plain payloads (e.g. Tasmota "ON") are only usable via the "" path.
+		doc = string(payload)
+	}
+
+	id := tpl.Name + ":" + device
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vd := b.devices[id]
+	if vd == nil {
+		vd = &VirtualDevice{
+			ID:       id,
+			Device:   device,
+			Template: tpl.Name,
+			Metrics:  map[string]float64{},
+			States:   map[string]string{},
+		}
+		b.devices[id] = vd
+	}
+
+	matched := false
+	for name, path := range tpl.Fields {
+		v, ok := lookup(doc, path)
+		if !ok {
+			continue
+		}
+		matched = true
+		switch val := v.(type) {
+		case float64:
+			vd.Metrics[name] = val
+		case bool:
+			vd.Metrics[name] = boolToFloat(val)
+		case string:
+			switch strings.ToUpper(val) {
+			case "ON", "TRUE", "ONLINE":
+				vd.Metrics[name] = 1
+			case "OFF", "FALSE", "OFFLINE":
+				vd.Metrics[name] = 0
+			default:
+				if f, err := strconv.ParseFloat(val, 64); err == nil {
+					vd.Metrics[name] = f
+				} else {
+					vd.States[name] = val
+				}
+			}
+		}
+	}
+	if matched {
+		vd.LastSeen = time.Now().Unix()
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// lookup resolves a dot-separated path ("ENERGY.Power", "sensors.0.value")
+// in a decoded JSON document. An empty path returns the document itself.
+func lookup(doc any, path string) (any, bool) {
+	if path == "" {
+		return doc, doc != nil
+	}
+	cur := doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]any:
+			v, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, cur != nil
+}
+
+// Collect returns a snapshot of all virtual devices seen recently.
+func (b *Bridge) Collect() *Metrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metrics := &Metrics{
+		Connected: b.client.IsConnectionOpen(),
+		Devices:   []VirtualDevice{},
+		Timestamp: time.Now().Unix(),
+	}
+	cutoff := time.Now().Add(-staleAfter).Unix()
+	for id, vd := range b.devices {
+		if vd.LastSeen == 0 {
+			continue
+		}
+		if vd.LastSeen < cutoff {
+			delete(b.devices, id)
+			continue
+		}
+		snapshot := *vd
+		snapshot.Metrics = make(map[string]float64, len(vd.Metrics))
+		for k, v := range vd.Metrics {
+			snapshot.Metrics[k] = v
+		}
+		snapshot.States = make(map[string]string, len(vd.States))
+		for k, v := range vd.States {
+			snapshot.States[k] = v
+		}
+		metrics.Devices = append(metrics.Devices, snapshot)
+	}
+	sort.Slice(metrics.Devices, func(i, j int) bool { return metrics.Devices[i].ID < metrics.Devices[j].ID })
+	return metrics
+}
+
+// Command publishes a mapped command to a LAN device. device is either a
+// virtual device ID ("template:device") or a raw device name when only one
+// template defines the command.
+func (b *Bridge) Command(ctx context.Context, device, command string, value any) error {
+	tplName, name, hasTemplate := strings.Cut(device, ":")
+	if !hasTemplate {
+		name = device
+	}
+
+	var tpl *template
+	for _, t := range b.templates {
+		if _, ok := t.Commands[command]; !ok {
+			continue
+		}
+		if hasTemplate && t.Name != tplName {
+			continue
+		}
+		if tpl != nil {
+			return fmt.Errorf("command %q is ambiguous for device %q; use template:device", command, device)
+		}
+		tpl = t
+	}
+	if tpl == nil {
+		return fmt.Errorf("no template defines command %q for device %q", command, device)
+	}
+
+	if !b.knownDevice(tpl.Name+":"+name) && !deviceNameRe.MatchString(name) {
+		return fmt.Errorf("invalid device name %q", name)
+	}
+
+	cmd := tpl.Commands[command]
+	topic := strings.ReplaceAll(cmd.Topic, "{device}", name)
+	payload, err := commandPayload(cmd.Payload, value)
+	if err != nil {
+		return err
+	}
+
+	token := b.client.Publish(topic, 1, false, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deviceNameRe is what a device name must look like unless the device has
+// been seen on its template: one topic level, free of wildcards.
+var deviceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]{0,127}$`)
+
+func (b *Bridge) knownDevice(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.devices[id]
+	return ok && !strings.ContainsAny(id, "/+#\x00")
+}
+
+// commandPayload fills "{value}" with the JSON encoding of value. A quoted
+// "{value}" is replaced as a whole, so templates written either way stay
+// valid JSON, and a payload that is only "{value}" takes a string value
+// as-is (plain payloads such as Tasmota's "ON").
+func commandPayload(tmpl string, value any) (string, error) {
+	if !strings.Contains(tmpl, "{value}") {
+		return tmpl, nil
+	}
+	if value == nil {
+		return "", errors.New("value is required")
+	}
+	if s, ok := value.(string); ok && tmpl == "{value}" {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("value: %w", err)
+	}
+	payload := strings.ReplaceAll(tmpl, `"{value}"`, string(encoded))
+	return strings.ReplaceAll(payload, "{value}", string(encoded)), nil
+}
+
+// Close disconnects from the LAN broker.
+func (b *Bridge) Close() {
+	b.client.Disconnect(250)
+}
+
+// HandleCommand is the "iotbridge.command" typed command handler. Params:
+// device, command and value.
+func (b *Bridge) HandleCommand(ctx context.Context, params map[string]any) (any, error) {
+	device, _ := params["device"].(string)
+	command, _ := params["command"].(string)
+	if device == "" || command == "" {
+		return nil, errors.New("device and command are required")
+	}
+	if err := b.Command(ctx, device, command, params["value"]); err != nil {
+		return nil, err
+	}
+	return map[string]any{"device": device, "command": command, "sent": true}, nil
+}
@@ -0,0 +1,62 @@
+package iotbridge
+
+import "github.com/iotmonitor/agent/internal/config"
+
+// presets are built-in templates for common LAN device firmwares. Config
+// templates referencing a preset may override any part of it.
+var presets = map[string]config.BridgeTemplate{
+	"tasmota": {
+		Topic: "tele/{device}/+",
+		Fields: map[string]string{
+			"power":        "ENERGY.Power",
+			"voltage":      "ENERGY.Voltage",
+			"current":      "ENERGY.Current",
+			"energy_total": "ENERGY.Total",
+			"relay":        "POWER",
+			"wifi_rssi":    "Wifi.RSSI",
+			"temperature":  "DS18B20.Temperature",
+		},
+		Commands: map[string]config.BridgeCommand{
+			"power": {Topic: "cmnd/{device}/POWER", Payload: "{value}"},
+		},
+	},
+	"zigbee2mqtt": {
+		Topic: "zigbee2mqtt/{device}",
+		Fields: map[string]string{
+			"temperature": "temperature",
+			"humidity":    "humidity",
+			"battery":     "battery",
+			"linkquality": "linkquality",
+			"power":       "power",
+			"voltage":     "voltage",
+			"current":     "current",
+			"energy":      "energy",
+			"state":       "state",
+			"contact":     "contact",
+			"occupancy":   "occupancy",
+			"water_leak":  "water_leak",
+		},
+		Commands: map[string]config.BridgeCommand{
+			"state": {Topic: "zigbee2mqtt/{device}/set", Payload: `{"state":{value}}`},
+		},
+		ExcludeDevices: []string{"bridge"},
+	},
+	"shelly": {
+		// Gen2+ devices publishing switch status over MQTT.
+		Topic: "{device}/status/switch:0",
+		Fields: map[string]string{
+			"power":        "apower",
+			"voltage":      "voltage",
+			"current":      "current",
+			"energy_total": "aenergy.total",
+			"output":       "output",
+			"temperature":  "temperature.tC",
+		},
+		Commands: map[string]config.BridgeCommand{
+			"switch": {
+				Topic:   "{device}/rpc",
+				Payload: `{"id":1,"src":"iotmonitor","method":"Switch.Set","params":{"id":0,"on":{value}}}`,
+			},
+		},
+	},
+}
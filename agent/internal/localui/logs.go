@@ -0,0 +1,41 @@
+package localui
+
+import (
+	"strings"
+	"sync"
+)
+
+// LogBuffer keeps the most recent log lines for the logs page. It is an
+// io.Writer meant to sit next to stderr in log.SetOutput.
+type LogBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	partial string
+}
+
+func NewLogBuffer(max int) *LogBuffer {
+	return &LogBuffer{max: max}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	text := b.partial + string(p)
+	parts := strings.Split(text, "\n")
+	b.partial = parts[len(parts)-1]
+	for _, line := range parts[:len(parts)-1] {
+		b.lines = append(b.lines, line)
+	}
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = append(b.lines[:0], b.lines[over:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns a copy of the buffered lines, oldest first.
+func (b *LogBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.lines...)
+}
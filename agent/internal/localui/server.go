@@ -0,0 +1,487 @@
+// Package localui serves an optional on-site setup and status page so
+// technicians can check the agent and fix its configuration without SSH.
+// Every API call requires a session obtained with the device's setup code.
+package localui
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/internal/mqtt"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+const (
+	sessionCookie   = "iotmonitor_setup"
+	sessionTTL      = time.Hour
+	maxLoginFails   = 5
+	loginLockout    = time.Minute
+	maxLoginClients = 1024
+	testConnTimeout = 10 * time.Second
+	maxBody         = 1 << 20
+)
+
+// loginFailures counts one client's failed logins.
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+type reading struct {
+	At   time.Time       `json:"at"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Server is the local setup/status web server.
+type Server struct {
+	cfg        *config.Config
+	configPath string
+	code       string
+	modules    map[string]bool
+	interval   time.Duration
+	logs       *LogBuffer
+	started    time.Time
+	restart    chan struct{}
+	httpServer *http.Server
+
+	mu        sync.Mutex
+	connected func() bool
+	readings  map[string]reading
+	sessions  map[string]time.Time
+	// failures is keyed by client IP, so one host guessing codes doesn't
+	// lock out the technician.
+	failures map[string]*loginFailures
+}
+
+// New prepares the server. modules is the enabled-module map, interval the
+// collection interval used to flag stale modules. When the config has no
+// setup code a random one is generated and logged.
+func New(cfg *config.Config, configPath string, modules map[string]bool, interval time.Duration, logs *LogBuffer) *Server {
+	code := cfg.LocalUISetupCode
+	if code == "" {
+		code = randomToken(5)
+		log.Printf("Local setup UI code: %s", code)
+	}
+	s := &Server{
+		cfg:        cfg,
+		configPath: configPath,
+		code:       code,
+		modules:    modules,
+		interval:   interval,
+		logs:       logs,
+		started:    time.Now(),
+		restart:    make(chan struct{}, 1),
+		readings:   map[string]reading{},
+		sessions:   map[string]time.Time{},
+		failures:   map[string]*loginFailures{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("POST /api/login", s.handleLogin)
+	mux.HandleFunc("POST /api/logout", s.auth(s.handleLogout))
+	mux.HandleFunc("GET /api/status", s.auth(s.handleStatus))
+	mux.HandleFunc("GET /api/readings", s.auth(s.handleReadings))
+	mux.HandleFunc("GET /api/config", s.auth(s.handleGetConfig))
+	mux.HandleFunc("POST /api/config/validate", s.auth(s.handleValidateConfig))
+	mux.HandleFunc("PUT /api/config", s.auth(s.handleSaveConfig))
+	mux.HandleFunc("POST /api/test-connection", s.auth(s.handleTestConnection))
+	mux.HandleFunc("GET /api/logs", s.auth(s.handleLogs))
+	mux.HandleFunc("POST /api/restart", s.auth(s.handleRestart))
+	s.httpServer = &http.Server{
+		Addr:              cfg.LocalUIAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// Start begins listening; errors binding the port are returned directly.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Local setup UI listening on %s", ln.Addr())
+	go func() {
+		if err := s.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Local setup UI stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.httpServer.Close()
+}
+
+// SetConnectionStatus sets how broker connectivity is reported.
+func (s *Server) SetConnectionStatus(fn func() bool) {
+	s.mu.Lock()
+	s.connected = fn
+	s.mu.Unlock()
+}
+
+// RecordMetric keeps the latest payload of each metric type. It matches
+// mqtt.Client.SetMetricObserver.
+func (s *Server) RecordMetric(checkType string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.readings[checkType] = reading{At: time.Now(), Data: data}
+	s.mu.Unlock()
+}
+
+// RestartRequested is signalled when a technician asks for a restart to
+// apply saved configuration. The agent exits and its service manager
+// starts it again.
+func (s *Server) RestartRequested() <-chan struct{} {
+	return s.restart
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// auth requires a valid session. Mutating requests must be JSON, which
+// (together with the SameSite cookie) keeps other sites from submitting
+// forms to the device.
+func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		s.mu.Lock()
+		expires, ok := time.Time{}, false
+		if err == nil {
+			expires, ok = s.sessions[cookie.Value]
+		}
+		if ok && time.Now().After(expires) {
+			delete(s.sessions, cookie.Value)
+			ok = false
+		}
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "login required")
+			return
+		}
+		if r.Method != http.MethodGet && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeError(w, http.StatusUnsupportedMediaType, "expected application/json")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(indexHTML)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for ip, f := range s.failures {
+		if now.Sub(f.last) > loginLockout && now.After(f.lockedUntil) {
+			delete(s.failures, ip)
+		}
+	}
+	f := s.failures[client]
+	if f != nil && now.Before(f.lockedUntil) {
+		writeError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(req.Code)), []byte(s.code)) != 1 {
+		if f == nil {
+			if len(s.failures) >= maxLoginClients {
+				// Too many clients guessing at once to track them
+				// individually.
+				writeError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+				return
+			}
+			f = &loginFailures{}
+			s.failures[client] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= maxLoginFails {
+			f.count = 0
+			f.lockedUntil = now.Add(loginLockout)
+			log.Printf("Local setup UI: too many failed logins from %s", client)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid setup code")
+		return
+	}
+	delete(s.failures, client)
+	for token, exp := range s.sessions {
+		if now.After(exp) {
+			delete(s.sessions, token)
+		}
+	}
+	token := randomToken(20)
+	s.sessions[token] = now.Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(sessionTTL.Seconds()),
+	})
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, cookie.Value)
+		s.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+type moduleHealth struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"` // ok, stale, no_data
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	connected := s.connected != nil && s.connected()
+	var modules []moduleHealth
+	for name, enabled := range s.modules {
+		if !enabled {
+			continue
+		}
+		m := moduleHealth{Name: name, Status: "no_data"}
+		if rd, ok := s.readings[name]; ok {
+			at := rd.At
+			m.LastUpdate = &at
+			m.Status = "ok"
+			if time.Since(at) > 3*s.interval {
+				m.Status = "stale"
+			}
+		}
+		modules = append(modules, m)
+	}
+	s.mu.Unlock()
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Name < modules[j].Name })
+
+	configErrors := []string{}
+	if err := s.cfg.Validate(); err != nil {
+		configErrors = strings.Split(err.Error(), "\n")
+	}
+	hostname, _ := os.Hostname()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"device_id":     s.cfg.DeviceID,
+		"hostname":      hostname,
+		"mqtt_url":      s.cfg.MQTTURL,
+		"connected":     connected,
+		"uptime_sec":    int64(time.Since(s.started).Seconds()),
+		"modules":       modules,
+		"config_errors": configErrors,
+	})
+}
+
+func (s *Server) handleReadings(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	out := make(map[string]reading, len(s.readings))
+	for k, v := range s.readings {
+		out[k] = v
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+// currentConfig returns the config file as a generic object, or the running
+// configuration when the agent was configured from the environment.
+func (s *Server) currentConfig() (map[string]any, error) {
+	data, err := os.ReadFile(s.configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = json.Marshal(s.cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	m, err := s.currentConfig()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	config.MaskSecrets(m)
+	writeJSON(w, http.StatusOK, map[string]any{"path": s.configPath, "config": m})
+}
+
+// candidate decodes a submitted config, restoring masked secrets from the
+// current file, and returns both the typed config and the object to save.
+// Unknown keys are rejected so typos don't silently fall back to defaults.
+func (s *Server) candidate(r *http.Request) (*config.Config, map[string]any, error) {
+	var m map[string]any
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBody)).Decode(&m); err != nil {
+		return nil, nil, err
+	}
+	current, err := s.currentConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := config.RestoreSecrets(m, current); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg config.Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, m, nil
+}
+
+func validationErrors(cfg *config.Config) []string {
+	if err := cfg.Validate(); err != nil {
+		return strings.Split(err.Error(), "\n")
+	}
+	return []string{}
+}
+
+func (s *Server) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, _, err := s.candidate(r)
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]any{"valid": false, "errors": []string{err.Error()}})
+		return
+	}
+	errs := validationErrors(cfg)
+	writeJSON(w, http.StatusOK, map[string]any{"valid": len(errs) == 0, "errors": errs})
+}
+
+func (s *Server) handleSaveConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, m, err := s.candidate(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"saved": false, "errors": []string{err.Error()}})
+		return
+	}
+	if errs := validationErrors(cfg); len(errs) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"saved": false, "errors": errs})
+		return
+	}
+	if err := s.writeConfig(m); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"saved": false, "errors": []string{err.Error()}})
+		return
+	}
+	log.Printf("Local setup UI: configuration saved to %s by %s", s.configPath, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]any{"saved": true, "restart_required": true})
+}
+
+// writeConfig replaces the config file atomically, keeping the previous
+// version as <path>.bak.
+func (s *Server) writeConfig(m map[string]any) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(s.configPath); err == nil {
+		if err := os.WriteFile(s.configPath+".bak", old, 0600); err != nil {
+			return err
+		}
+	}
+	tmp := s.configPath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.configPath)
+}
+
+func (s *Server) handleTestConnection(w http.ResponseWriter, r *http.Request) {
+	cfg, _, err := s.candidate(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+	start := time.Now()
+	err = mqtt.TestConnection(cfg, testConnTimeout)
+	result := map[string]any{"ok": err == nil, "duration_ms": time.Since(start).Milliseconds()}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	lines := []string{}
+	if s.logs != nil {
+		lines = s.logs.Lines()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"lines": lines})
+}
+
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Local setup UI: restart requested by %s", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]bool{"restarting": true})
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
@@ -6,21 +6,104 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/internal/e2e"
 )
 
 type Client struct {
 	mqtt.Client
 	Config *config.Config
+	e2e    *e2e.Session
+
+	// sparkplug is set when metrics are published as Sparkplug B.
+	sparkplug *sparkplug
+	// offline is set when the file sink is the only output and no broker
+	// connection is made.
+	offline bool
+
+	handlersMu sync.RWMutex
+	handlers   map[string]CommandHandler
+
+	observerMu    sync.Mutex
+	observer      func(checkType string, payload any)
+	eventObserver func(eventType string, payload any)
+	sink          Sink
+}
+
+// Sink keeps a local copy of everything published. kind is "metric",
+// "event" or "status".
+type Sink interface {
+	Write(kind, name string, payload any)
 }
 
 func NewClient(cfg *config.Config) (*Client, error) {
+	// Checked here too since only the local UI runs Config.Validate: a
+	// sealed config must never fall back to plaintext Sparkplug.
+	if err := cfg.Sparkplug.Validate(cfg.E2EEnabled); err != nil {
+		return nil, err
+	}
+
+	var session *e2e.Session
+	if cfg.E2EEnabled {
+		kr, err := e2e.LoadOrCreateKeyring(cfg.E2EKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load e2e keyring: %w", err)
+		}
+		session, err = e2e.NewSession(kr, cfg.E2EBackendPublicKey, cfg.E2EBackendSigningKey)
+		if err != nil {
+			return nil, err
+		}
+		// The backend asks an operator to confirm a new device's key id.
+		log.Printf("End-to-end encryption enabled, device key id %s", kr.Current().KeyID)
+	}
+
+	opts := clientOptions(cfg, cfg.DeviceID)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(5 * time.Minute)
+
+	var sp *sparkplug
+	if cfg.Sparkplug.Enabled {
+		sp = newSparkplug(cfg)
+		sp.setWill(opts)
+		opts.SetReconnectingHandler(sp.reconnecting)
+	}
+
+	opts.OnConnect = func(c mqtt.Client) {
+		log.Printf("Connected to MQTT broker at %s", cfg.MQTTURL)
+		if sp != nil {
+			sp.connected(c)
+		}
+	}
+
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		log.Printf("Disconnected from MQTT broker: %v", err)
+		if sp != nil {
+			sp.connectionLost()
+		}
+	}
+
+	client := mqtt.NewClient(opts)
+	offline := cfg.FileSink.Enabled && cfg.FileSink.Only
+	if offline {
+		log.Println("File sink only: not connecting to an MQTT broker")
+	} else if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return &Client{Client: client, Config: cfg, e2e: session, sparkplug: sp, offline: offline}, nil
+}
+
+// clientOptions builds the broker address, credentials, proxy and TLS
+// settings shared by the agent connection and TestConnection.
+func clientOptions(cfg *config.Config, clientID string) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(cfg.MQTTURL)
-	opts.SetClientID(cfg.DeviceID)
+	opts.SetClientID(clientID)
+	opts.SetCustomOpenConnectionFn(proxyConnection(cfg.Proxy))
 
 	// Prefer explicit broker credentials from settings/build env; fallback to device auth.
 	username := strings.TrimSpace(cfg.MQTTUsername)
@@ -32,8 +115,6 @@ func NewClient(cfg *config.Config) (*Client, error) {
 
 	opts.SetUsername(username)
 	opts.SetPassword(password)
-	opts.SetAutoReconnect(true)
-	opts.SetMaxReconnectInterval(5 * time.Minute)
 
 	if cfg.UseTLS {
 		tlsConfig := &tls.Config{
@@ -41,24 +122,104 @@ func NewClient(cfg *config.Config) (*Client, error) {
 		}
 		opts.SetTLSConfig(tlsConfig)
 	}
+	return opts
+}
 
-	opts.OnConnect = func(c mqtt.Client) {
-		log.Printf("Connected to MQTT broker at %s", cfg.MQTTURL)
+// TestConnection connects to the broker described by cfg with a separate
+// client ID (so the running agent's session is not taken over) and
+// disconnects again.
+func TestConnection(cfg *config.Config, timeout time.Duration) error {
+	opts := clientOptions(cfg, cfg.DeviceID+"-setup-test")
+	opts.SetConnectTimeout(timeout)
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out connecting to %s", cfg.MQTTURL)
+	}
+	if err := token.Error(); err != nil {
+		return err
 	}
+	client.Disconnect(250)
+	return nil
+}
 
-	opts.OnConnectionLost = func(c mqtt.Client, err error) {
-		log.Printf("Disconnected from MQTT broker: %v", err)
+// SetMetricObserver registers fn to be called with every metric payload
+// before it is published, e.g. to show latest readings locally.
+func (c *Client) SetMetricObserver(fn func(checkType string, payload any)) {
+	c.observerMu.Lock()
+	c.observer = fn
+	c.observerMu.Unlock()
+}
+
+// SetEventObserver registers fn to be called with every event before it is
+// published, whether or not the broker is reachable.
+func (c *Client) SetEventObserver(fn func(eventType string, payload any)) {
+	c.observerMu.Lock()
+	c.eventObserver = fn
+	c.observerMu.Unlock()
+}
+
+// SetSink registers a sink that receives every metric, event and status,
+// whether or not the broker is reachable.
+func (c *Client) SetSink(s Sink) {
+	c.observerMu.Lock()
+	c.sink = s
+	c.observerMu.Unlock()
+}
+
+// record passes a published payload to the sink, if any.
+func (c *Client) record(kind, name string, payload any) {
+	c.observerMu.Lock()
+	sink := c.sink
+	c.observerMu.Unlock()
+	if sink != nil {
+		sink.Write(kind, name, payload)
 	}
+}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+// seal encrypts an outgoing payload when end-to-end encryption is enabled.
+func (c *Client) seal(data []byte) ([]byte, error) {
+	if c.e2e == nil {
+		return data, nil
 	}
+	return c.e2e.Seal(data)
+}
 
-	return &Client{client, cfg}, nil
+// PublishKeys announces the device's current public keys (retained) so the
+// backend can seal commands to it and verify its payloads. The broker isn't
+// trusted with them: the announcement is signed, and the backend only uses
+// a key an operator approved or the previous approved key endorsed.
+func (c *Client) PublishKeys() error {
+	if c.e2e == nil || c.offline {
+		return nil
+	}
+	topic := fmt.Sprintf("%s/%s/keys", c.Config.MQTTPrefix, c.Config.DeviceID)
+	data, err := json.Marshal(c.e2e.Keyring().PublicKeys())
+	if err != nil {
+		return err
+	}
+	token := c.Publish(topic, 1, true, data)
+	token.Wait()
+	return token.Error()
 }
 
 func (c *Client) PublishMetric(checkType string, payload interface{}) error {
+	c.observerMu.Lock()
+	observer := c.observer
+	c.observerMu.Unlock()
+	if observer != nil {
+		observer(checkType, payload)
+	}
+	c.record("metric", checkType, payload)
+	if c.offline {
+		return nil
+	}
+
+	if c.sparkplug != nil {
+		return c.sparkplug.publish(c.Client, checkType, payload)
+	}
+
 	topic := fmt.Sprintf("%s/%s/metrics/%s", c.Config.MQTTPrefix, c.Config.DeviceID, checkType)
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -69,12 +230,67 @@ func (c *Client) PublishMetric(checkType string, payload interface{}) error {
 		log.Printf("[DEBUG] Publishing %s: %s", checkType, string(data))
 	}
 
+	data, err = c.seal(data)
+	if err != nil {
+		return err
+	}
+
+	token := c.Publish(topic, 1, false, data)
+	token.Wait()
+	return token.Error()
+}
+
+// PublishEvent publishes a discrete occurrence (as opposed to a periodic
+// sample) on <prefix>/<device>/events/<eventType>.
+func (c *Client) PublishEvent(eventType string, payload interface{}) error {
+	c.observerMu.Lock()
+	observer := c.eventObserver
+	c.observerMu.Unlock()
+	if observer != nil {
+		observer(eventType, payload)
+	}
+	c.record("event", eventType, payload)
+	if c.offline {
+		return nil
+	}
+
+	topic := fmt.Sprintf("%s/%s/events/%s", c.Config.MQTTPrefix, c.Config.DeviceID, eventType)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if c.Config.Debug {
+		log.Printf("[DEBUG] Publishing event %s: %s", eventType, string(data))
+	}
+
+	data, err = c.seal(data)
+	if err != nil {
+		return err
+	}
+
 	token := c.Publish(topic, 1, false, data)
 	token.Wait()
 	return token.Error()
 }
 
+// Disconnect closes the broker connection. A Sparkplug edge node first
+// publishes its NDEATH, since a clean disconnect doesn't send the will and
+// hosts would otherwise see the node online until its session expires.
+func (c *Client) Disconnect(quiesce uint) {
+	if c.sparkplug != nil && !c.offline && c.IsConnectionOpen() {
+		if err := c.sparkplug.death(c.Client); err != nil {
+			log.Printf("Sparkplug NDEATH failed: %v", err)
+		}
+	}
+	c.Client.Disconnect(quiesce)
+}
+
 func (c *Client) PublishStatus(status string) error {
+	c.record("status", "status", status)
+	if c.offline {
+		return nil
+	}
 	topic := fmt.Sprintf("%s/%s/status", c.Config.MQTTPrefix, c.Config.DeviceID)
 	token := c.Publish(topic, 1, true, status)
 	token.Wait()
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotmonitor/agent/internal/e2e"
 )
 
 type CommandRequest struct {
@@ -16,6 +17,31 @@ type CommandRequest struct {
 	Payload   string   `json:"payload"`
 	Args      []string `json:"args"`
 	Timeout   int      `json:"timeout"` // in seconds
+
+	// Type selects a registered typed command instead of running Payload
+	// as a process; Params are passed to its handler.
+	Type   string         `json:"type,omitempty"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// CommandHandler implements a typed command. The returned value is JSON
+// encoded into the response output.
+type CommandHandler func(ctx context.Context, params map[string]any) (any, error)
+
+// RegisterHandler makes a typed command available under name.
+func (c *Client) RegisterHandler(name string, h CommandHandler) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	if c.handlers == nil {
+		c.handlers = map[string]CommandHandler{}
+	}
+	c.handlers[name] = h
+}
+
+func (c *Client) handler(name string) CommandHandler {
+	c.handlersMu.RLock()
+	defer c.handlersMu.RUnlock()
+	return c.handlers[name]
 }
 
 type CommandResponse struct {
@@ -26,34 +52,97 @@ type CommandResponse struct {
 }
 
 func (c *Client) HandleCommands() {
+	if c.offline {
+		return
+	}
 	topic := fmt.Sprintf("%s/%s/commands", c.Config.MQTTPrefix, c.Config.DeviceID)
 	c.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
 		if c.Config.Debug {
 			log.Printf("[DEBUG] Received message on %s: %s", msg.Topic(), string(msg.Payload()))
 		}
 
+		payload := msg.Payload()
+		if c.e2e != nil {
+			// With encryption enabled only sealed, backend-signed commands
+			// are accepted; plaintext could have been injected at the broker.
+			if !e2e.IsEnvelope(payload) {
+				log.Printf("Rejected unencrypted command on %s", msg.Topic())
+				return
+			}
+			opened, err := c.e2e.Open(payload)
+			if err != nil {
+				log.Printf("Rejected command: %v", err)
+				return
+			}
+			payload = opened
+		}
+
 		var req CommandRequest
-		if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		if err := json.Unmarshal(payload, &req); err != nil {
 			log.Printf("Failed to unmarshal command: %v", err)
 			return
 		}
 
-		log.Printf("Received command: %s %v", req.Payload, req.Args)
-		resp := c.ExecuteCommand(req)
+		var resp CommandResponse
+		if req.Type != "" {
+			log.Printf("Received typed command: %s", req.Type)
+			resp = c.executeTyped(req)
+		} else {
+			log.Printf("Received command: %s %v", req.Payload, req.Args)
+			resp = c.ExecuteCommand(req)
+		}
 
 		respTopic := fmt.Sprintf("%s/%s/responses", c.Config.MQTTPrefix, c.Config.DeviceID)
 		respData, _ := json.Marshal(resp)
+		respData, err := c.seal(respData)
+		if err != nil {
+			log.Printf("Failed to seal command response: %v", err)
+			return
+		}
 		client.Publish(respTopic, 1, false, respData)
 	})
 }
 
-func (c *Client) ExecuteCommand(req CommandRequest) CommandResponse {
+func commandTimeout(req CommandRequest) time.Duration {
 	timeout := time.Duration(req.Timeout) * time.Second
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
+	return timeout
+}
+
+func (c *Client) executeTyped(req CommandRequest) CommandResponse {
+	resp := CommandResponse{CommandID: req.CommandID}
+	if !c.Config.CommandPolicy.Permits(req.Type) {
+		log.Printf("Rejected typed command %s: not permitted by command_policy", req.Type)
+		resp.Error = fmt.Sprintf("command %q is not permitted by the command policy", req.Type)
+		resp.ExitCode = -1
+		return resp
+	}
+	h := c.handler(req.Type)
+	if h == nil {
+		resp.Error = fmt.Sprintf("unknown command type %q", req.Type)
+		resp.ExitCode = -1
+		return resp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(req))
+	defer cancel()
+
+	result, err := h(ctx, req.Params)
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ExitCode = 1
+	}
+	if result != nil {
+		out, _ := json.Marshal(result)
+		resp.Output = string(out)
+	}
+	return resp
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func (c *Client) ExecuteCommand(req CommandRequest) CommandResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(req))
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, req.Payload, req.Args...)
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+// proxyConnection returns a paho connection function that reaches the
+// broker through p for tcp, tls and websocket URLs. paho's own dialer only
+// honours SOCKS proxies from ALL_PROXY.
+func proxyConnection(p collect.Proxy) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		forward := options.Dialer
+		if forward == nil {
+			forward = &net.Dialer{Timeout: 30 * time.Second}
+		}
+		switch uri.Scheme {
+		case "ws", "wss":
+			wsOpts := mqtt.WebsocketOptions{}
+			if options.WebsocketOptions != nil {
+				wsOpts = *options.WebsocketOptions
+			}
+			wsOpts.Proxy = p.HTTPProxy()
+			dialURI := *uri // gorilla/websocket rejects URLs with userinfo
+			dialURI.User = nil
+			var tlsc *tls.Config
+			if uri.Scheme == "wss" {
+				tlsc = options.TLSConfig
+			}
+			return mqtt.NewWebsocket(dialURI.String(), tlsc, options.ConnectTimeout, options.HTTPHeaders, &wsOpts)
+		case "unix":
+			path := uri.Host
+			if path == "" {
+				path = uri.Path
+			}
+			return forward.Dial("unix", path)
+		}
+
+		ctx := context.Background()
+		if options.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+			defer cancel()
+		}
+		conn, err := p.DialContext(forward)(ctx, "tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		switch uri.Scheme {
+		case "mqtt", "tcp":
+			return conn, nil
+		case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+			tlsc := &tls.Config{}
+			if options.TLSConfig != nil {
+				tlsc = options.TLSConfig.Clone()
+			}
+			if tlsc.ServerName == "" {
+				tlsc.ServerName = uri.Hostname()
+			}
+			tc := tls.Client(conn, tlsc)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		default:
+			conn.Close()
+			return nil, fmt.Errorf("unsupported broker scheme %q", uri.Scheme)
+		}
+	}
+}
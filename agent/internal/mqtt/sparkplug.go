@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+const (
+	spNamespace   = "spBv1.0"
+	bdSeqMetric   = "bdSeq"
+	rebirthMetric = "Node Control/Rebirth"
+)
+
+// sparkplug publishes metrics as a Sparkplug B edge node. NDEATH is the MQTT
+// will; every connection starts with NBIRTH, and each module is a device
+// that is born (DBIRTH) with its full metric set and then reports changed
+// values only (DDATA). A metric that wasn't in the last DBIRTH triggers a
+// new DBIRTH, since hosts only accept aliases announced at birth.
+type sparkplug struct {
+	group, node string
+
+	mu        sync.Mutex
+	bdSeq     uint64
+	seq       uint64
+	born      bool // NBIRTH sent on the current connection
+	nextAlias uint64
+	aliases   map[string]uint64 // "<device>/<metric>"
+	devices   map[string]*spDevice
+}
+
+type spDevice struct {
+	born   bool
+	types  map[string]uint64 // metrics announced in the last DBIRTH
+	values map[string]any    // last published values
+}
+
+func newSparkplug(cfg *config.Config) *sparkplug {
+	group := cfg.Sparkplug.GroupID
+	if group == "" {
+		group = "iotmonitor"
+	}
+	node := cfg.Sparkplug.EdgeNodeID
+	if node == "" {
+		node = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(cfg.DeviceID)
+	}
+	return &sparkplug{
+		group:   group,
+		node:    node,
+		aliases: map[string]uint64{},
+		devices: map[string]*spDevice{},
+	}
+}
+
+func (s *sparkplug) topic(kind, device string) string {
+	t := spNamespace + "/" + s.group + "/" + kind + "/" + s.node
+	if device != "" {
+		t += "/" + device
+	}
+	return t
+}
+
+func nowMillis() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
+
+// setWill registers the NDEATH for the current bdSeq as the MQTT will.
+func (s *sparkplug) setWill(opts *mqtt.ClientOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	death := encodePayload(nowMillis(), nil, []spMetric{
+		{name: bdSeqMetric, alias: s.alias("", bdSeqMetric), datatype: spUInt64, value: s.bdSeq},
+	})
+	opts.SetBinaryWill(s.topic("NDEATH", ""), death, 1, false)
+}
+
+// reconnecting starts a new birth/death sequence before each reconnect
+// attempt.
+func (s *sparkplug) reconnecting(_ mqtt.Client, opts *mqtt.ClientOptions) {
+	s.mu.Lock()
+	s.bdSeq = (s.bdSeq + 1) % 256
+	s.born = false
+	s.mu.Unlock()
+	s.setWill(opts)
+}
+
+// death publishes the NDEATH for the current bdSeq, which the broker
+// doesn't send as the will after a clean disconnect.
+func (s *sparkplug) death(cl mqtt.Client) error {
+	s.mu.Lock()
+	death := encodePayload(nowMillis(), nil, []spMetric{
+		{name: bdSeqMetric, alias: s.alias("", bdSeqMetric), datatype: spUInt64, value: s.bdSeq},
+	})
+	s.born = false
+	s.mu.Unlock()
+	token := cl.Publish(s.topic("NDEATH", ""), 1, false, death)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errors.New("timed out")
+	}
+	return token.Error()
+}
+
+func (s *sparkplug) connectionLost() {
+	s.mu.Lock()
+	s.born = false
+	s.mu.Unlock()
+}
+
+func (s *sparkplug) alias(device, name string) uint64 {
+	key := device + "/" + name
+	a, ok := s.aliases[key]
+	if !ok {
+		s.nextAlias++
+		a = s.nextAlias
+		s.aliases[key] = a
+	}
+	return a
+}
+
+func (s *sparkplug) nextSeq() *uint64 {
+	s.seq = (s.seq + 1) % 256
+	seq := s.seq
+	return &seq
+}
+
+// connected subscribes to node commands and publishes the births.
+func (s *sparkplug) connected(cl mqtt.Client) {
+	cl.Subscribe(s.topic("NCMD", ""), 0, func(cl mqtt.Client, msg mqtt.Message) {
+		metrics, err := decodeMetrics(msg.Payload())
+		if err != nil {
+			log.Printf("Sparkplug NCMD: %v", err)
+			return
+		}
+		s.mu.Lock()
+		rebirthAlias := s.alias("", rebirthMetric)
+		s.mu.Unlock()
+		for _, m := range metrics {
+			if (m.name == rebirthMetric || m.name == "" && m.alias == rebirthAlias) && m.value == true {
+				log.Println("Sparkplug rebirth requested")
+				go s.birth(cl)
+				return
+			}
+		}
+	})
+	s.birth(cl)
+}
+
+// birth publishes NBIRTH, then a DBIRTH with the last values of every
+// module seen so far.
+func (s *sparkplug) birth(cl mqtt.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq = 0
+	seq := uint64(0)
+	nbirth := encodePayload(nowMillis(), &seq, []spMetric{
+		{name: bdSeqMetric, alias: s.alias("", bdSeqMetric), datatype: spUInt64, value: s.bdSeq},
+		{name: rebirthMetric, alias: s.alias("", rebirthMetric), datatype: spBoolean, value: false},
+	})
+	if err := publishWait(cl, s.topic("NBIRTH", ""), nbirth); err != nil {
+		log.Printf("Sparkplug NBIRTH failed: %v", err)
+		return
+	}
+	s.born = true
+	for _, name := range slices.Sorted(maps.Keys(s.devices)) {
+		if err := s.deviceBirth(cl, name, s.devices[name]); err != nil {
+			log.Printf("Sparkplug DBIRTH %s failed: %v", name, err)
+		}
+	}
+}
+
+func (s *sparkplug) deviceBirth(cl mqtt.Client, name string, d *spDevice) error {
+	d.types = map[string]uint64{}
+	metrics := make([]spMetric, 0, len(d.values))
+	for _, metric := range slices.Sorted(maps.Keys(d.values)) {
+		v := d.values[metric]
+		dt := datatype(v)
+		d.types[metric] = dt
+		metrics = append(metrics, spMetric{name: metric, alias: s.alias(name, metric), datatype: dt, value: v})
+	}
+	d.born = true
+	return publishWait(cl, s.topic("DBIRTH", name), encodePayload(nowMillis(), s.nextSeq(), metrics))
+}
+
+// publish sends one module's metrics as DBIRTH or DDATA. Before NBIRTH
+// the values are only kept for the coming births.
+func (s *sparkplug) publish(cl mqtt.Client, device string, payload any) error {
+	values, err := flattenMetrics(payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.devices[device]
+	if d == nil {
+		d = &spDevice{}
+		s.devices[device] = d
+	}
+	if !s.born {
+		d.values, d.born = values, false
+		return nil
+	}
+
+	rebirth := !d.born
+	for name, v := range values {
+		if dt, ok := d.types[name]; !ok || dt != datatype(v) {
+			rebirth = true
+			break
+		}
+	}
+	if rebirth {
+		d.values = values
+		return s.deviceBirth(cl, device, d)
+	}
+
+	var changed []spMetric
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		v := values[name]
+		if prev, ok := d.values[name]; ok && prev == v {
+			continue
+		}
+		d.values[name] = v
+		changed = append(changed, spMetric{alias: s.alias(device, name), datatype: d.types[name], value: v})
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return publishWait(cl, s.topic("DDATA", device), encodePayload(nowMillis(), s.nextSeq(), changed))
+}
+
+func publishWait(cl mqtt.Client, topic string, payload []byte) error {
+	token := cl.Publish(topic, 0, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func datatype(v any) uint64 {
+	switch v.(type) {
+	case bool:
+		return spBoolean
+	case string:
+		return spString
+	}
+	return spDouble
+}
+
+// flattenMetrics turns a module's JSON payload into Sparkplug metrics named
+// by their path ("cpu/usage_percent"). Array elements are named by their
+// name, id, host or url when they have one, so a container or probe keeps
+// its metric names when the list changes order. Numbers are all Doubles:
+// the JSON encoding doesn't tell 2.0 from 2, and a datatype that flips
+// between samples would force a rebirth.
+func flattenMetrics(payload any) (map[string]any, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	if m, ok := v.(map[string]any); ok {
+		delete(m, "timestamp") // carried by the payload itself
+	}
+	flatten("", v, out)
+	return out, nil
+}
+
+func flatten(name string, v any, out map[string]any) {
+	join := func(child string) string {
+		child = strings.ReplaceAll(child, "/", "_")
+		if name == "" {
+			return child
+		}
+		return name + "/" + child
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			flatten(join(k), child, out)
+		}
+	case []any:
+		used := map[string]bool{}
+		for i, child := range v {
+			elem := elementName(child)
+			if elem == "" || used[elem] {
+				elem = strconv.Itoa(i)
+			}
+			used[elem] = true
+			flatten(join(elem), child, out)
+		}
+	case float64, bool, string:
+		if name != "" {
+			out[name] = v
+		}
+	}
+}
+
+func elementName(v any) string {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return ""
+	}
+	if names, ok := m["names"].([]any); ok && len(names) > 0 {
+		if s, ok := names[0].(string); ok && s != "" {
+			return strings.TrimPrefix(s, "/")
+		}
+	}
+	for _, k := range []string{"name", "id", "host", "url"} {
+		if s, ok := m[k].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
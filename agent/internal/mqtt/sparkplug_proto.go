@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B data types used by the agent.
+const (
+	spUInt64  = 8
+	spDouble  = 10
+	spBoolean = 11
+	spString  = 12
+)
+
+// Field numbers of the Sparkplug B Payload and Payload.Metric messages.
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+
+	metricName      = 1
+	metricAlias     = 2
+	metricTimestamp = 3
+	metricDatatype  = 4
+	metricLong      = 11
+	metricDouble    = 13
+	metricBoolean   = 14
+	metricString    = 15
+)
+
+// spMetric is a Sparkplug metric. value is a uint64, float64, bool or
+// string; name is left empty in DATA messages, which refer to the metric
+// by alias only.
+type spMetric struct {
+	name     string
+	alias    uint64
+	datatype uint64
+	value    any
+}
+
+// encodePayload encodes a Sparkplug B Payload. NDEATH carries no sequence
+// number, so seq is optional.
+func encodePayload(timestamp uint64, seq *uint64, metrics []spMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeMetric(m, timestamp))
+	}
+	if seq != nil {
+		b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, *seq)
+	}
+	return b
+}
+
+func encodeMetric(m spMetric, timestamp uint64) []byte {
+	var b []byte
+	if m.name != "" {
+		b = protowire.AppendTag(b, metricName, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	b = protowire.AppendTag(b, metricAlias, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.alias)
+	b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	b = protowire.AppendTag(b, metricDatatype, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.datatype)
+	switch v := m.value.(type) {
+	case uint64:
+		b = protowire.AppendTag(b, metricLong, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, metricDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, metricBoolean, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, metricString, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+var errMalformed = errors.New("malformed Sparkplug payload")
+
+// decodeMetrics returns the metrics of a Sparkplug B Payload, decoding the
+// fields commands use (name, alias and a boolean value).
+func decodeMetrics(b []byte) ([]spMetric, error) {
+	var metrics []spMetric
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errMalformed
+		}
+		b = b[n:]
+		if num == payloadMetrics && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, errMalformed
+			}
+			m, err := decodeMetric(v)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, m)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, errMalformed
+		}
+		b = b[n:]
+	}
+	return metrics, nil
+}
+
+func decodeMetric(b []byte) (spMetric, error) {
+	var m spMetric
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, errMalformed
+		}
+		b = b[n:]
+		switch {
+		case num == metricName && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return m, errMalformed
+			}
+			m.name, b = v, b[n:]
+		case (num == metricAlias || num == metricBoolean) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return m, errMalformed
+			}
+			if num == metricAlias {
+				m.alias = v
+			} else {
+				m.value = protowire.DecodeBool(v)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return m, errMalformed
+			}
+			b = b[n:]
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,440 @@
+// Package opcua reads PLC and industrial controller values over OPC UA,
+// either by polling each node every sample or through a server-side
+// subscription, and reports them with their quality codes.
+package opcua
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	gopcua "github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/iotmonitor/agent/internal/config"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	minBackoff     = 5 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// Value is the latest reading of one configured node. While its server
+// isn't connected, a last good reading is reported as uncertain
+// (StatusUncertainLastUsableValue).
+type Value struct {
+	Name   string `json:"name"`
+	NodeID string `json:"node_id"`
+	Unit   string `json:"unit,omitempty"`
+	// Value is the scaled reading for numeric and boolean nodes; Raw holds
+	// anything else (strings, arrays) as returned by the server.
+	Value           *float64 `json:"value,omitempty"`
+	Raw             any      `json:"raw,omitempty"`
+	Quality         string   `json:"quality"` // good, uncertain, bad
+	StatusCode      uint32   `json:"status_code"`
+	Status          string   `json:"status,omitempty"`
+	SourceTimestamp int64    `json:"source_timestamp,omitempty"`
+}
+
+// ServerMetrics is the state of one OPC UA endpoint.
+type ServerMetrics struct {
+	Name      string  `json:"name"`
+	Endpoint  string  `json:"endpoint"`
+	State     string  `json:"state"` // connected, reconnecting, disconnected
+	Connected bool    `json:"connected"`
+	Error     string  `json:"error,omitempty"`
+	Values    []Value `json:"values"`
+}
+
+type Metrics struct {
+	Servers   []ServerMetrics `json:"servers"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+type server struct {
+	cfg   config.OPCUAServer
+	nodes []*ua.NodeID
+
+	client  *gopcua.Client
+	sub     *gopcua.Subscription
+	cancel  context.CancelFunc
+	backoff time.Duration
+	retryAt time.Time
+
+	mu      sync.Mutex
+	lastErr string
+	values  []Value
+}
+
+// Collector keeps one client per configured server.
+type Collector struct {
+	servers []*server
+}
+
+// New validates the configured servers and node IDs. Connections are made
+// lazily on the first Collect so an unreachable PLC does not delay startup.
+func New(cfg []config.OPCUAServer) (*Collector, error) {
+	if len(cfg) == 0 {
+		return nil, errors.New("no opcua servers configured")
+	}
+	c := &Collector{}
+	for _, sc := range cfg {
+		if sc.Endpoint == "" {
+			return nil, fmt.Errorf("opcua server %q has no endpoint", sc.Name)
+		}
+		if sc.Name == "" {
+			sc.Name = sc.Endpoint
+		}
+		s := &server{cfg: sc, backoff: minBackoff}
+		for _, n := range sc.Nodes {
+			id, err := ua.ParseNodeID(n.NodeID)
+			if err != nil {
+				return nil, fmt.Errorf("opcua server %s: node %q: %w", sc.Name, n.NodeID, err)
+			}
+			s.nodes = append(s.nodes, id)
+			s.values = append(s.values, Value{Name: n.Name, NodeID: n.NodeID, Unit: n.Unit, Quality: "bad"})
+		}
+		c.servers = append(c.servers, s)
+	}
+	return c, nil
+}
+
+// Collect polls or snapshots every server. Servers that are down are
+// reconnected with exponential backoff.
+func (c *Collector) Collect(ctx context.Context) *Metrics {
+	metrics := &Metrics{Servers: []ServerMetrics{}, Timestamp: time.Now().Unix()}
+	for _, s := range c.servers {
+		metrics.Servers = append(metrics.Servers, s.collect(ctx))
+	}
+	return metrics
+}
+
+func (s *server) collect(ctx context.Context) ServerMetrics {
+	if s.client == nil || s.client.State() == gopcua.Closed {
+		s.connect(ctx)
+	}
+
+	if s.client != nil && !s.cfg.Subscribe && s.client.State() == gopcua.Connected {
+		if err := s.read(ctx); err != nil {
+			s.setError(err)
+		}
+	}
+
+	state := "disconnected"
+	if s.client != nil {
+		switch s.client.State() {
+		case gopcua.Connected:
+			state = "connected"
+		case gopcua.Connecting, gopcua.Reconnecting, gopcua.Disconnected:
+			state = "reconnecting"
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sm := ServerMetrics{
+		Name:      s.cfg.Name,
+		Endpoint:  s.cfg.Endpoint,
+		State:     state,
+		Connected: state == "connected",
+		Error:     s.lastErr,
+		Values:    append([]Value(nil), s.values...),
+	}
+	if sm.Connected && s.cfg.Subscribe {
+		sm.Error = ""
+	}
+	if !sm.Connected {
+		// Cached readings aren't live; keep them for context but never
+		// report them as good.
+		for i := range sm.Values {
+			if sm.Values[i].Quality == "good" {
+				sm.Values[i].Quality = "uncertain"
+				sm.Values[i].StatusCode = uint32(ua.StatusUncertainLastUsableValue)
+				sm.Values[i].Status = ua.StatusCodes[ua.StatusUncertainLastUsableValue].Name
+			}
+		}
+	}
+	return sm
+}
+
+func (s *server) setError(err error) {
+	s.mu.Lock()
+	s.lastErr = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *server) connect(ctx context.Context) {
+	if time.Now().Before(s.retryAt) {
+		return
+	}
+	s.closeClient()
+
+	if err := s.dial(ctx); err != nil {
+		log.Printf("opcua %s: %v (retry in %s)", s.cfg.Name, err, s.backoff)
+		s.setError(err)
+		s.closeClient()
+		s.retryAt = time.Now().Add(s.backoff)
+		s.backoff = min(s.backoff*2, maxBackoff)
+		return
+	}
+	log.Printf("opcua %s: connected to %s", s.cfg.Name, s.cfg.Endpoint)
+	s.backoff = minBackoff
+	s.mu.Lock()
+	s.lastErr = ""
+	s.mu.Unlock()
+}
+
+func (s *server) dial(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	policy := s.cfg.SecurityPolicy
+	if policy == "" {
+		policy = "None"
+	}
+	mode := s.cfg.SecurityMode
+	if mode == "" {
+		mode = "None"
+	}
+	eps, err := gopcua.GetEndpoints(ctx, s.cfg.Endpoint)
+	if err != nil {
+		return fmt.Errorf("get endpoints: %w", err)
+	}
+	ep, err := gopcua.SelectEndpoint(eps, policy, ua.MessageSecurityModeFromString(mode))
+	if err != nil {
+		return err
+	}
+
+	opts := []gopcua.Option{
+		gopcua.SecurityPolicy(policy),
+		gopcua.SecurityModeString(mode),
+		gopcua.CertificateFile(s.cfg.CertFile),
+		gopcua.PrivateKeyFile(s.cfg.KeyFile),
+		gopcua.AutoReconnect(true),
+		gopcua.ReconnectInterval(minBackoff),
+		gopcua.DialTimeout(connectTimeout),
+		gopcua.RequestTimeout(connectTimeout),
+	}
+	switch s.cfg.AuthMode {
+	case "", "anonymous":
+		opts = append(opts, gopcua.AuthAnonymous(), gopcua.SecurityFromEndpoint(ep, ua.UserTokenTypeAnonymous))
+	case "username":
+		opts = append(opts, gopcua.AuthUsername(s.cfg.Username, s.cfg.Password), gopcua.SecurityFromEndpoint(ep, ua.UserTokenTypeUserName))
+	case "certificate":
+		cert, err := loadCertDER(s.cfg.CertFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, gopcua.AuthCertificate(cert), gopcua.SecurityFromEndpoint(ep, ua.UserTokenTypeCertificate))
+	default:
+		return fmt.Errorf("unknown auth_mode %q", s.cfg.AuthMode)
+	}
+
+	client, err := gopcua.NewClient(ep.EndpointURL, opts...)
+	if err != nil {
+		return err
+	}
+	s.client = client
+	if err := client.Connect(ctx); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	if s.cfg.Subscribe {
+		return s.subscribe(ctx)
+	}
+	return nil
+}
+
+func loadCertDER(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("certificate auth needs cert_file")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		return block.Bytes, nil
+	}
+	return b, nil
+}
+
+// subscribe creates one monitored item per node; the client handle is the
+// node's index. The library recreates the subscription after a reconnect.
+func (s *server) subscribe(ctx context.Context) error {
+	interval := time.Duration(s.cfg.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	notify := make(chan *gopcua.PublishNotificationData, 64)
+	sub, err := s.client.Subscribe(ctx, &gopcua.SubscriptionParameters{Interval: interval}, notify)
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	s.sub = sub
+
+	items := make([]*ua.MonitoredItemCreateRequest, len(s.nodes))
+	for i, id := range s.nodes {
+		items[i] = gopcua.NewMonitoredItemCreateRequestWithDefaults(id, ua.AttributeIDValue, uint32(i))
+	}
+	res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, items...)
+	if err != nil {
+		return fmt.Errorf("monitor: %w", err)
+	}
+	for i, r := range res.Results {
+		if r.StatusCode != ua.StatusOK {
+			s.update(i, &ua.DataValue{Status: r.StatusCode})
+		}
+	}
+
+	subCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.receive(subCtx, notify)
+	return nil
+}
+
+func (s *server) receive(ctx context.Context, notify <-chan *gopcua.PublishNotificationData) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notify:
+			if n.Error != nil {
+				s.setError(n.Error)
+				continue
+			}
+			dc, ok := n.Value.(*ua.DataChangeNotification)
+			if !ok {
+				continue
+			}
+			for _, item := range dc.MonitoredItems {
+				s.update(int(item.ClientHandle), item.Value)
+			}
+		}
+	}
+}
+
+func (s *server) read(ctx context.Context) error {
+	req := &ua.ReadRequest{TimestampsToReturn: ua.TimestampsToReturnBoth}
+	for _, id := range s.nodes {
+		req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: id, AttributeID: ua.AttributeIDValue})
+	}
+	resp, err := s.client.Read(ctx, req)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	for i, dv := range resp.Results {
+		s.update(i, dv)
+	}
+	s.mu.Lock()
+	s.lastErr = ""
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *server) update(i int, dv *ua.DataValue) {
+	if i < 0 || i >= len(s.cfg.Nodes) || dv == nil {
+		return
+	}
+	node := s.cfg.Nodes[i]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &s.values[i]
+	v.StatusCode = uint32(dv.Status)
+	v.Quality = quality(dv.Status)
+	v.Status = ""
+	if dv.Status != ua.StatusOK {
+		if desc, ok := ua.StatusCodes[dv.Status]; ok {
+			v.Status = desc.Name
+		} else {
+			v.Status = fmt.Sprintf("0x%08X", uint32(dv.Status))
+		}
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		v.SourceTimestamp = dv.SourceTimestamp.Unix()
+	}
+	v.Value, v.Raw = nil, nil
+	if dv.Value == nil {
+		return
+	}
+	raw := dv.Value.Value()
+	if f, ok := toFloat(raw); ok {
+		scale := node.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		scaled := f*scale + node.Offset
+		v.Value = &scaled
+	} else {
+		v.Raw = raw
+	}
+}
+
+// quality maps the severity bits of an OPC UA status code (Part 4, 7.34).
+func quality(code ua.StatusCode) string {
+	switch uint32(code) >> 30 {
+	case 0:
+		return "good"
+	case 1:
+		return "uncertain"
+	default:
+		return "bad"
+	}
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (s *server) closeClient() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.sub = nil
+	if s.client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		s.client.Close(ctx)
+		cancel()
+		s.client = nil
+	}
+}
+
+// Close disconnects from every server.
+func (c *Collector) Close() {
+	for _, s := range c.servers {
+		s.closeClient()
+	}
+}
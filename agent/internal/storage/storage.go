@@ -0,0 +1,119 @@
+// Package storage runs the storage latency probe on its own, much longer,
+// interval than the main tick, so a slow disk can't stall it, and reports
+// paths turning degraded or recovering.
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/iotmonitor/agent/internal/config"
+	"github.com/iotmonitor/agent/pkg/collect"
+)
+
+const defaultInterval = 300 * time.Second
+
+// Change is published as a "storage_degraded" event. State is "degraded"
+// or "cleared".
+type Change struct {
+	Path      string   `json:"path"`
+	State     string   `json:"state"`
+	Reasons   []string `json:"reasons"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// Probe periodically measures the configured paths.
+type Probe struct {
+	collector *collect.StorageCollector
+	interval  time.Duration
+	onMetrics func(*collect.StorageMetrics)
+	onChange  func(Change)
+
+	// degraded is each path's last reported state; only the loop uses it.
+	degraded map[string]bool
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// New returns a Probe. hostPaths.Root, when set, prefixes the probed paths
+// so a containerised agent in host mode measures the host's disks.
+func New(cfg config.StorageConfig, hostPaths collect.HostPaths, onMetrics func(*collect.StorageMetrics), onChange func(Change)) *Probe {
+	paths := cfg.Paths
+	if len(paths) == 0 {
+		paths = []string{config.DefaultStoragePath}
+	}
+	baselineFile := cfg.BaselineFile
+	if baselineFile == "" {
+		baselineFile = config.DefaultStorageBaseline
+	}
+	interval := defaultInterval
+	if cfg.IntervalSec > 0 {
+		interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	p := &Probe{
+		collector: collect.NewStorageCollector(
+			collect.WithStoragePaths(paths...),
+			collect.WithStorageHostPaths(hostPaths),
+			collect.WithStorageFileSize(int64(cfg.FileSizeMB)<<20),
+			collect.WithStorageSamples(cfg.Samples),
+			collect.WithDegradationFactor(cfg.DegradationFactor),
+			collect.WithStorageBaselineFile(baselineFile),
+		),
+		interval:  interval,
+		onMetrics: onMetrics,
+		onChange:  onChange,
+		degraded:  map[string]bool{},
+	}
+	p.ctx, p.stop = context.WithCancel(context.Background())
+	return p
+}
+
+// Start runs the probe loop. The first run starts right away.
+func (p *Probe) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			p.run()
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the loop, cancelling a run in progress.
+func (p *Probe) Close() {
+	p.stop()
+	p.wg.Wait()
+}
+
+// run probes once, bounded by half the interval, and reports the result
+// unless the probe was closed meanwhile.
+func (p *Probe) run() {
+	ctx, cancel := context.WithTimeout(p.ctx, p.interval/2)
+	m := p.collector.Collect(ctx)
+	cancel()
+	if p.ctx.Err() != nil {
+		return
+	}
+	p.onMetrics(m)
+	for _, pm := range m.Paths {
+		if pm.Error != "" || pm.Degraded == p.degraded[pm.Path] {
+			continue
+		}
+		p.degraded[pm.Path] = pm.Degraded
+		state := "cleared"
+		if pm.Degraded {
+			state = "degraded"
+		}
+		p.onChange(Change{Path: pm.Path, State: state, Reasons: pm.Reasons, Timestamp: m.Timestamp})
+	}
+}
@@ -1,4 +1,4 @@
-package monitor
+package collect
 
 import (
 	"bytes"
@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +19,9 @@ type PJSIPRegistration struct {
 	Status    string `json:"status"`
 	ExpiresS  *int64 `json:"expiresS,omitempty"`
 	Raw       string `json:"raw,omitempty"`
+	// SuppressedBy names the failing dependency a lost registration is
+	// attributed to, when the caller applies dependency suppression.
+	SuppressedBy string `json:"suppressed_by,omitempty"`
 }
 
 type PJSIPContact struct {
@@ -27,6 +31,8 @@ type PJSIPContact struct {
 	Status     string   `json:"status"`
 	RTTms      *float64 `json:"rttMs,omitempty"`
 	Raw        string   `json:"raw,omitempty"`
+	// SuppressedBy is set like PJSIPRegistration.SuppressedBy.
+	SuppressedBy string `json:"suppressed_by,omitempty"`
 }
 
 type AsteriskPJSIPMetrics struct {
@@ -81,7 +87,8 @@ func execAsterisk(ctx context.Context, container string, cmd string) (string, er
 	return localExecAsterisk(ctx, cmd)
 }
 
-func parsePJSIPRegistrations(output string) []PJSIPRegistration {
+// ParsePJSIPRegistrations parses `pjsip show registrations` CLI output.
+func ParsePJSIPRegistrations(output string) []PJSIPRegistration {
 	lines := strings.Split(output, "\n")
 	var rows []string
 
@@ -147,7 +154,8 @@ func parsePJSIPRegistrations(output string) []PJSIPRegistration {
 	return regs
 }
 
-func parsePJSIPContacts(output string) []PJSIPContact {
+// ParsePJSIPContacts parses `pjsip show contacts` CLI output.
+func ParsePJSIPContacts(output string) []PJSIPContact {
 	lines := strings.Split(output, "\n")
 	var rows []string
 
@@ -216,22 +224,85 @@ func parsePJSIPContacts(output string) []PJSIPContact {
 	return contacts
 }
 
-// Public function your main loop can call
-func GetAsteriskPJSIPMetrics(container string) (AsteriskPJSIPMetrics, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+// CLIExecutor runs an Asterisk CLI command (as with `asterisk -rx`) and
+// returns its output.
+type CLIExecutor func(ctx context.Context, cmd string) (string, error)
+
+// AsteriskCollector gathers PJSIP registration and contact state, and
+// Asterisk's own health (see Health).
+type AsteriskCollector struct {
+	container    string
+	exec         CLIExecutor
+	timeout      time.Duration
+	amiPing      func(ctx context.Context) error
+	processCheck func(ctx context.Context) (bool, error)
+	procRoot     string
+
+	mu             sync.Mutex
+	cli            map[string]*cliStat
+	taskProcessors map[string]*tpSample
+}
+
+// AsteriskOption configures an AsteriskCollector.
+type AsteriskOption func(*AsteriskCollector)
+
+// WithAsteriskContainer runs the CLI via `docker exec` in the named container,
+// falling back to a local asterisk binary.
+func WithAsteriskContainer(name string) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		c.container = name
+	}
+}
+
+// WithCLIExecutor replaces how CLI commands are executed (e.g. over SSH or AMI).
+func WithCLIExecutor(exec CLIExecutor) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		c.exec = exec
+	}
+}
+
+// WithAsteriskTimeout bounds a whole Collect call (default 4s).
+func WithAsteriskTimeout(d time.Duration) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// NewAsteriskCollector returns an AsteriskCollector with the given options.
+func NewAsteriskCollector(opts ...AsteriskOption) *AsteriskCollector {
+	c := &AsteriskCollector{timeout: 4 * time.Second, procRoot: "/proc"}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.exec == nil {
+		container := c.container
+		c.exec = func(ctx context.Context, cmd string) (string, error) {
+			return execAsterisk(ctx, container, cmd)
+		}
+	}
+	return c
+}
+
+// Collect runs the PJSIP show commands and summarises the result. A
+// command that doesn't answer in time fails with an error wrapping
+// ErrCLITimeout.
+func (c *AsteriskCollector) Collect(ctx context.Context) (*AsteriskPJSIPMetrics, error) {
+	tctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	regOut, err := execAsterisk(ctx, container, "pjsip show registrations")
+	regOut, err := c.run(ctx, tctx, "pjsip show registrations")
 	if err != nil {
-		return AsteriskPJSIPMetrics{}, err
+		return nil, err
 	}
-	contOut, err := execAsterisk(ctx, container, "pjsip show contacts")
+	contOut, err := c.run(ctx, tctx, "pjsip show contacts")
 	if err != nil {
-		return AsteriskPJSIPMetrics{}, err
+		return nil, err
 	}
 
-	regs := parsePJSIPRegistrations(regOut)
-	contacts := parsePJSIPContacts(contOut)
+	regs := ParsePJSIPRegistrations(regOut)
+	contacts := ParsePJSIPContacts(contOut)
 
 	// Summaries
 	summary := map[string]any{
@@ -257,7 +328,7 @@ func GetAsteriskPJSIPMetrics(container string) (AsteriskPJSIPMetrics, error) {
 	summary["contactsAvail"] = avail
 	summary["contactsUnavail"] = unavail
 
-	return AsteriskPJSIPMetrics{
+	return &AsteriskPJSIPMetrics{
 		Registrations: regs,
 		Contacts:      contacts,
 		Summary:       summary,
@@ -0,0 +1,357 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCLITimeout is wrapped by errors of Asterisk CLI commands that didn't
+// answer before their deadline, as opposed to ones that failed outright. A
+// running Asterisk whose CLI times out is usually deadlocked.
+var ErrCLITimeout = errors.New("asterisk CLI command timed out")
+
+// Deadlock heuristics. A taskprocessor is stalled when it has work queued
+// but processed nothing since the previous sample.
+const (
+	cliTimeoutStreak    = 2
+	stalledSamples      = 3
+	growingSamples      = 5
+	slowLatencyFactor   = 5
+	slowLatencyMinMs    = 500
+	maxTaskProcessors   = 20
+	baselineSmoothing   = 0.2
+	processCheckTimeout = 2 * time.Second
+)
+
+// CLITiming is how the last run of an Asterisk CLI command (or the AMI
+// ping) went. Slow marks a latency well above the command's baseline;
+// TimedOut marks no answer at all.
+type CLITiming struct {
+	Command    string  `json:"command"`
+	LatencyMs  float64 `json:"latency_ms"`
+	BaselineMs float64 `json:"baseline_ms,omitempty"`
+	Slow       bool    `json:"slow,omitempty"`
+	TimedOut   bool    `json:"timed_out,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	// TimeoutStreak counts consecutive timeouts.
+	TimeoutStreak int `json:"timeout_streak,omitempty"`
+}
+
+// TaskProcessor is one row of `core show taskprocessors`. GrowingSamples
+// and StalledSamples count consecutive samples in which the queue grew or
+// nothing was processed despite queued work.
+type TaskProcessor struct {
+	Name           string `json:"name"`
+	Processed      uint64 `json:"processed"`
+	InQueue        int64  `json:"in_queue"`
+	MaxDepth       int64  `json:"max_depth"`
+	LowWater       int64  `json:"low_water,omitempty"`
+	HighWater      int64  `json:"high_water,omitempty"`
+	GrowingSamples int    `json:"growing_samples,omitempty"`
+	StalledSamples int    `json:"stalled_samples,omitempty"`
+}
+
+// AsteriskHealth reports whether Asterisk is still doing work. Only the
+// busiest taskprocessors (queued work, or a high-water mark reached) are
+// listed.
+type AsteriskHealth struct {
+	// ProcessRunning is nil when it couldn't be determined.
+	ProcessRunning     *bool           `json:"process_running,omitempty"`
+	CLI                []CLITiming     `json:"cli"`
+	AMI                *CLITiming      `json:"ami,omitempty"`
+	TaskProcessorCount int             `json:"taskprocessor_count"`
+	QueuedTotal        int64           `json:"queued_total"`
+	TaskProcessors     []TaskProcessor `json:"taskprocessors"`
+	SuspectedDeadlock  bool            `json:"suspected_deadlock"`
+	Reasons            []string        `json:"reasons,omitempty"`
+	Timestamp          int64           `json:"timestamp"`
+}
+
+// WithAMIPing adds an AMI round trip to Health, so a manager interface that
+// stops answering counts toward a suspected deadlock.
+func WithAMIPing(ping func(ctx context.Context) error) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		c.amiPing = ping
+	}
+}
+
+// WithProcessCheck replaces how Health tells whether Asterisk is running.
+// By default the container's state is read with `docker inspect`, falling
+// back to looking for an asterisk process in /proc.
+func WithProcessCheck(check func(ctx context.Context) (bool, error)) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		c.processCheck = check
+	}
+}
+
+// WithAsteriskProcRoot sets where procfs is mounted for the default process
+// check (default "/proc"), e.g. the host's /proc mounted into the agent's
+// container.
+func WithAsteriskProcRoot(path string) AsteriskOption {
+	return func(c *AsteriskCollector) {
+		if path != "" {
+			c.procRoot = path
+		}
+	}
+}
+
+// cliStat tracks one command across samples.
+type cliStat struct {
+	baseline float64
+	streak   int
+	last     CLITiming
+}
+
+type tpSample struct {
+	processed uint64
+	inQueue   int64
+	growing   int
+	stalled   int
+}
+
+// run executes a CLI command under ctx, derived from parent with the
+// command's deadline, and records its latency, telling timeouts from
+// failures. When parent itself ends first the command says nothing about
+// Asterisk, so nothing is recorded.
+func (c *AsteriskCollector) run(parent, ctx context.Context, cmd string) (string, error) {
+	start := time.Now()
+	out, err := c.exec(ctx, cmd)
+	if err != nil && parent.Err() != nil {
+		return out, err
+	}
+	timing := CLITiming{Command: cmd, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%s: %w", cmd, ErrCLITimeout)
+	}
+	c.record(cmd, timing, err)
+	return out, err
+}
+
+func (c *AsteriskCollector) record(cmd string, timing CLITiming, err error) CLITiming {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cli == nil {
+		c.cli = map[string]*cliStat{}
+	}
+	s := c.cli[cmd]
+	if s == nil {
+		s = &cliStat{}
+		c.cli[cmd] = s
+	}
+	switch {
+	case errors.Is(err, ErrCLITimeout) || errors.Is(err, context.DeadlineExceeded):
+		timing.TimedOut = true
+		s.streak++
+	case err != nil:
+		timing.Error = err.Error()
+		s.streak = 0
+	default:
+		s.streak = 0
+		if s.baseline == 0 {
+			s.baseline = timing.LatencyMs
+		} else {
+			timing.Slow = timing.LatencyMs > s.baseline*slowLatencyFactor && timing.LatencyMs > slowLatencyMinMs
+			if !timing.Slow {
+				s.baseline += baselineSmoothing * (timing.LatencyMs - s.baseline)
+			}
+		}
+	}
+	timing.BaselineMs = float64(int64(s.baseline*10)) / 10
+	timing.TimeoutStreak = s.streak
+	s.last = timing
+	return timing
+}
+
+// Health samples `core show taskprocessors`, pings AMI when configured and
+// checks whether Asterisk is running. It flags a suspected deadlock when
+// the process is up but its CLI or AMI keeps timing out, or when a
+// taskprocessor stalls or its queue keeps growing. Each step is bounded by
+// the collector timeout; only that deadline counts as a timeout, not ctx
+// ending, so callers should pass a context of its own rather than one
+// shared with other work.
+func (c *AsteriskCollector) Health(ctx context.Context) *AsteriskHealth {
+	h := &AsteriskHealth{TaskProcessors: []TaskProcessor{}, Timestamp: time.Now().Unix()}
+
+	pctx, cancel := context.WithTimeout(ctx, processCheckTimeout)
+	if running, err := c.processRunning(pctx); err == nil {
+		h.ProcessRunning = &running
+	}
+	cancel()
+
+	tctx, cancel := context.WithTimeout(ctx, c.timeout)
+	out, err := c.run(ctx, tctx, "core show taskprocessors")
+	cancel()
+	var stalled, growing []TaskProcessor
+	if err == nil {
+		all := ParseTaskProcessors(out)
+		c.trackTaskProcessors(all)
+		h.TaskProcessorCount = len(all)
+		for _, tp := range all {
+			h.QueuedTotal += tp.InQueue
+			if tp.StalledSamples >= stalledSamples {
+				stalled = append(stalled, tp)
+			}
+			if tp.GrowingSamples >= growingSamples {
+				growing = append(growing, tp)
+			}
+			if tp.InQueue > 0 || (tp.HighWater > 0 && tp.MaxDepth >= tp.HighWater) {
+				h.TaskProcessors = append(h.TaskProcessors, tp)
+			}
+		}
+		sort.SliceStable(h.TaskProcessors, func(i, j int) bool {
+			a, b := h.TaskProcessors[i], h.TaskProcessors[j]
+			if a.InQueue != b.InQueue {
+				return a.InQueue > b.InQueue
+			}
+			return a.MaxDepth > b.MaxDepth
+		})
+		if len(h.TaskProcessors) > maxTaskProcessors {
+			h.TaskProcessors = h.TaskProcessors[:maxTaskProcessors]
+		}
+	}
+
+	if c.amiPing != nil {
+		actx, cancel := context.WithTimeout(ctx, c.timeout)
+		start := time.Now()
+		err := c.amiPing(actx)
+		if err != nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+			err = ErrCLITimeout
+		}
+		cancel()
+		if err == nil || ctx.Err() == nil {
+			ami := c.record("ami ping", CLITiming{Command: "ami ping", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}, err)
+			h.AMI = &ami
+		}
+	}
+
+	c.mu.Lock()
+	for cmd, s := range c.cli {
+		if cmd != "ami ping" {
+			h.CLI = append(h.CLI, s.last)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(h.CLI, func(i, j int) bool { return h.CLI[i].Command < h.CLI[j].Command })
+
+	// A stopped Asterisk is down, not deadlocked.
+	if h.ProcessRunning != nil && !*h.ProcessRunning {
+		return h
+	}
+	for _, t := range append(h.CLI, derefTiming(h.AMI)...) {
+		if t.TimeoutStreak >= cliTimeoutStreak {
+			h.Reasons = append(h.Reasons, fmt.Sprintf("%s timed out %d times in a row", t.Command, t.TimeoutStreak))
+		}
+	}
+	for _, tp := range stalled {
+		h.Reasons = append(h.Reasons, fmt.Sprintf("taskprocessor %s processed nothing for %d samples with %d queued", tp.Name, tp.StalledSamples, tp.InQueue))
+	}
+	for _, tp := range growing {
+		h.Reasons = append(h.Reasons, fmt.Sprintf("taskprocessor %s queue grew for %d samples to %d", tp.Name, tp.GrowingSamples, tp.InQueue))
+	}
+	h.SuspectedDeadlock = len(h.Reasons) > 0
+	return h
+}
+
+func derefTiming(t *CLITiming) []CLITiming {
+	if t == nil {
+		return nil
+	}
+	return []CLITiming{*t}
+}
+
+// trackTaskProcessors updates each processor's growth and stall counters
+// from the previous sample.
+func (c *AsteriskCollector) trackTaskProcessors(tps []TaskProcessor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := make(map[string]*tpSample, len(tps))
+	for i := range tps {
+		tp := &tps[i]
+		s := &tpSample{processed: tp.Processed, inQueue: tp.InQueue}
+		if prev := c.taskProcessors[tp.Name]; prev != nil {
+			if tp.InQueue > prev.inQueue {
+				s.growing = prev.growing + 1
+			}
+			if tp.InQueue > 0 && tp.Processed == prev.processed {
+				s.stalled = prev.stalled + 1
+			}
+		}
+		tp.GrowingSamples, tp.StalledSamples = s.growing, s.stalled
+		next[tp.Name] = s
+	}
+	c.taskProcessors = next
+}
+
+// ParseTaskProcessors parses `core show taskprocessors` output. Older
+// Asterisk versions print no low and high water columns.
+func ParseTaskProcessors(output string) []TaskProcessor {
+	var tps []TaskProcessor
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		var nums []int64
+		for _, f := range fields[1:] {
+			n, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				nums = nil
+				break
+			}
+			nums = append(nums, n)
+		}
+		if len(nums) < 3 {
+			continue // header, summary or foreign line
+		}
+		tp := TaskProcessor{
+			Name:      fields[0],
+			Processed: uint64(nums[0]),
+			InQueue:   nums[1],
+			MaxDepth:  nums[2],
+		}
+		if len(nums) >= 5 {
+			tp.LowWater, tp.HighWater = nums[3], nums[4]
+		}
+		tps = append(tps, tp)
+	}
+	return tps
+}
+
+func (c *AsteriskCollector) processRunning(ctx context.Context) (bool, error) {
+	if c.processCheck != nil {
+		return c.processCheck(ctx)
+	}
+	if c.container != "" {
+		out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.State.Running}}", c.container).Output()
+		if err == nil {
+			return strings.TrimSpace(string(out)) == "true", nil
+		}
+	}
+	return localProcessRunning(c.procRoot, "asterisk")
+}
+
+// localProcessRunning looks for a process by its comm name.
+func localProcessRunning(procRoot, name string) (bool, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
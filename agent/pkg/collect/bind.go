@@ -0,0 +1,83 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Binding pins a probe to one uplink, either by interface (SO_BINDTODEVICE,
+// Linux only, needs CAP_NET_RAW) or by source address. The zero value uses
+// the default route.
+type Binding struct {
+	Interface string `json:"interface,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+}
+
+// IsZero reports whether b leaves routing to the kernel.
+func (b Binding) IsZero() bool {
+	return b.Interface == "" && b.SourceIP == ""
+}
+
+func (b Binding) String() string {
+	switch {
+	case b.Interface != "" && b.SourceIP != "":
+		return b.Interface + "/" + b.SourceIP
+	case b.Interface != "":
+		return b.Interface
+	default:
+		return b.SourceIP
+	}
+}
+
+// dialer returns a dialer whose sockets are bound according to b.
+func (b Binding) dialer(timeout time.Duration) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if b.SourceIP != "" {
+		ip := net.ParseIP(b.SourceIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source_ip %q", b.SourceIP)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if b.Interface != "" {
+		control, err := bindToDevice(b.Interface)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
+
+// Dialer returns a dialer bound according to b that also resolves names
+// over the binding, for traffic other than probes (e.g. alert delivery over
+// a secondary uplink).
+func (b Binding) Dialer(timeout time.Duration) (*net.Dialer, error) {
+	d, err := b.dialer(timeout)
+	if err != nil {
+		return nil, err
+	}
+	d.Resolver = b.resolver(d)
+	return d, nil
+}
+
+// resolver sends DNS queries over the same binding so a dead uplink shows up
+// as a DNS failure on that uplink rather than succeeding via another one.
+func (b Binding) resolver(d *net.Dialer) *net.Resolver {
+	if b.IsZero() {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// LocalAddr is a TCPAddr; UDP lookups need the matching type.
+			ud := *d
+			if ta, ok := d.LocalAddr.(*net.TCPAddr); ok && (network == "udp" || network == "udp4" || network == "udp6") {
+				ud.LocalAddr = &net.UDPAddr{IP: ta.IP}
+			}
+			return ud.DialContext(ctx, network, address)
+		},
+	}
+}
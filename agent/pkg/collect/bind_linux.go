@@ -0,0 +1,22 @@
+//go:build linux
+
+package collect
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package collect
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to an interface is only supported on Linux; use source_ip")
+}
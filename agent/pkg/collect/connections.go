@@ -0,0 +1,338 @@
+package collect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bound on remembered endpoints per watched process, so a process
+// talking to many peers can't grow the agent without limit. When it is
+// reached the endpoint seen least recently is forgotten; it is reported
+// as new again if it comes back.
+const maxSeenEndpoints = 2048
+
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// ProcessConnection aggregates the sockets one process has open to one
+// remote endpoint. Inbound connections (to a port the host listens on) are
+// grouped by local port instead, since the peer's port is ephemeral.
+type ProcessConnection struct {
+	PID        int32          `json:"pid"`
+	Process    string         `json:"process"`
+	Protocol   string         `json:"protocol"`
+	Direction  string         `json:"direction"`
+	LocalPort  int            `json:"local_port,omitempty"`
+	RemoteIP   string         `json:"remote_ip"`
+	RemotePort int            `json:"remote_port,omitempty"`
+	Count      int            `json:"count"`
+	States     map[string]int `json:"states"`
+}
+
+// RemoteEndpointEvent reports a watched process contacting an endpoint it
+// has not been seen talking to before.
+type RemoteEndpointEvent struct {
+	PID        int32  `json:"pid"`
+	Process    string `json:"process"`
+	Protocol   string `json:"protocol"`
+	RemoteIP   string `json:"remote_ip"`
+	RemotePort int    `json:"remote_port"`
+	FirstSeen  int64  `json:"first_seen"`
+}
+
+type procSocket struct {
+	protocol   string
+	localPort  int
+	remoteIP   net.IP
+	remotePort int
+	state      string
+	inode      string
+}
+
+type procOwner struct {
+	pid  int32
+	name string
+}
+
+// connectionTracker maps /proc/net sockets to their owning processes and
+// remembers which endpoints watched processes have used.
+type connectionTracker struct {
+	procRoot string
+	watch    map[string]bool
+
+	mu       sync.Mutex
+	baseline bool
+	// seen maps each watched process's endpoints to when they were last
+	// seen.
+	seen map[string]map[string]int64
+}
+
+func newConnectionTracker(procRoot string, watch []string) *connectionTracker {
+	t := &connectionTracker{
+		procRoot: procRoot,
+		watch:    map[string]bool{},
+		seen:     map[string]map[string]int64{},
+	}
+	for _, name := range watch {
+		if name = strings.TrimSpace(name); name != "" {
+			t.watch[name] = true
+		}
+	}
+	return t
+}
+
+// parseProcNetAddr decodes the "ADDR:PORT" hex notation of /proc/net/*.
+// Addresses are stored as host-endian 32-bit words.
+func parseProcNetAddr(s string) (net.IP, int, error) {
+	host, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	raw, err := hex.DecodeString(host)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed port %q", s)
+	}
+	return ip, int(port), nil
+}
+
+// readProcNet returns the connected sockets in a /proc/net table and adds
+// the table's listening ports to listening.
+func readProcNet(path, protocol string, listening map[int]bool) ([]procSocket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sockets []procSocket
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		_, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		if fields[3] == "0A" && strings.HasPrefix(protocol, "tcp") {
+			listening[localPort] = true
+			continue
+		}
+		ip, port, err := parseProcNetAddr(fields[2])
+		if err != nil || ip.IsUnspecified() || port == 0 {
+			// Unconnected UDP sockets have no remote endpoint.
+			continue
+		}
+		inode := fields[9]
+		if inode == "0" {
+			// TIME_WAIT and similar sockets no longer belong to a process.
+			continue
+		}
+
+		state := tcpStates[fields[3]]
+		if strings.HasPrefix(protocol, "udp") {
+			state = "ESTABLISHED"
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		sockets = append(sockets, procSocket{
+			protocol:   protocol,
+			localPort:  localPort,
+			remoteIP:   ip,
+			remotePort: port,
+			state:      state,
+			inode:      inode,
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// socketOwners walks /proc/<pid>/fd and maps socket inodes to processes.
+// Processes we may not inspect are skipped silently.
+func (t *connectionTracker) socketOwners() map[string]procOwner {
+	owners := map[string]procOwner{}
+	entries, err := os.ReadDir(t.procRoot)
+	if err != nil {
+		return owners
+	}
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(t.procRoot, entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		var name string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if name == "" {
+				comm, _ := os.ReadFile(filepath.Join(t.procRoot, entry.Name(), "comm"))
+				name = strings.TrimSpace(string(comm))
+				if name == "" {
+					name = "unknown"
+				}
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			owners[inode] = procOwner{pid: int32(pid), name: name}
+		}
+	}
+	return owners
+}
+
+// collect returns the aggregated connection map and any new-endpoint events
+// for watched processes. The first call only records a baseline.
+func (t *connectionTracker) collect() ([]ProcessConnection, []RemoteEndpointEvent, error) {
+	var sockets []procSocket
+	var readErr error
+	listening := map[int]bool{}
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		s, err := readProcNet(filepath.Join(t.procRoot, "net", proto), proto, listening)
+		if err != nil {
+			readErr = err
+			continue
+		}
+		sockets = append(sockets, s...)
+	}
+	if len(sockets) == 0 && readErr != nil {
+		return nil, nil, readErr
+	}
+
+	owners := t.socketOwners()
+	agg := map[string]*ProcessConnection{}
+	for _, s := range sockets {
+		owner, ok := owners[s.inode]
+		if !ok {
+			continue
+		}
+		proto := strings.TrimSuffix(s.protocol, "6")
+		direction, localPort, remotePort := "outbound", 0, s.remotePort
+		if proto == "tcp" && listening[s.localPort] {
+			direction, localPort, remotePort = "inbound", s.localPort, 0
+		}
+		key := fmt.Sprintf("%d|%s|%s|%d|%s|%d", owner.pid, proto, direction, localPort, s.remoteIP, remotePort)
+		pc, ok := agg[key]
+		if !ok {
+			pc = &ProcessConnection{
+				PID:        owner.pid,
+				Process:    owner.name,
+				Protocol:   proto,
+				Direction:  direction,
+				LocalPort:  localPort,
+				RemoteIP:   s.remoteIP.String(),
+				RemotePort: remotePort,
+				States:     map[string]int{},
+			}
+			agg[key] = pc
+		}
+		pc.Count++
+		pc.States[s.state]++
+	}
+
+	conns := make([]ProcessConnection, 0, len(agg))
+	for _, pc := range agg {
+		conns = append(conns, *pc)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Process != conns[j].Process {
+			return conns[i].Process < conns[j].Process
+		}
+		if conns[i].Count != conns[j].Count {
+			return conns[i].Count > conns[j].Count
+		}
+		return conns[i].RemoteIP < conns[j].RemoteIP
+	})
+
+	return conns, t.newEndpoints(conns), nil
+}
+
+func (t *connectionTracker) newEndpoints(conns []ProcessConnection) []RemoteEndpointEvent {
+	if len(t.watch) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix()
+	var events []RemoteEndpointEvent
+	for _, c := range conns {
+		if !t.watch[c.Process] || c.Direction != "outbound" {
+			continue
+		}
+		seen := t.seen[c.Process]
+		if seen == nil {
+			seen = map[string]int64{}
+			t.seen[c.Process] = seen
+		}
+		endpoint := c.Protocol + "|" + net.JoinHostPort(c.RemoteIP, strconv.Itoa(c.RemotePort))
+		_, known := seen[endpoint]
+		seen[endpoint] = now
+		if known {
+			continue
+		}
+		if len(seen) > maxSeenEndpoints {
+			evictOldest(seen, endpoint)
+		}
+		if !t.baseline {
+			continue
+		}
+		events = append(events, RemoteEndpointEvent{
+			PID:        c.PID,
+			Process:    c.Process,
+			Protocol:   c.Protocol,
+			RemoteIP:   c.RemoteIP,
+			RemotePort: c.RemotePort,
+			FirstSeen:  now,
+		})
+	}
+	t.baseline = true
+	return events
+}
+
+// evictOldest forgets the endpoint seen least recently, other than keep.
+func evictOldest(seen map[string]int64, keep string) {
+	oldest, oldestAt := "", int64(0)
+	for endpoint, at := range seen {
+		if endpoint != keep && (oldest == "" || at < oldestAt) {
+			oldest, oldestAt = endpoint, at
+		}
+	}
+	delete(seen, oldest)
+}
@@ -0,0 +1,394 @@
+package collect
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// ServiceTarget is a service found through container labels:
+//
+//	iotmonitor.check=redis        check to run (tcp, http, redis, mysql, nginx)
+//	iotmonitor.port=6379          port (default depends on the check)
+//	iotmonitor.interval=30s       check interval
+//	iotmonitor.path=/nginx_status HTTP path for http/nginx checks
+//	iotmonitor.host=10.0.0.5      address override
+//	iotmonitor.network=backend    which container network's IP to use
+//
+// Other iotmonitor.* labels are passed to the check in Labels with the
+// prefix removed.
+type ServiceTarget struct {
+	ContainerID string            `json:"container_id"`
+	Container   string            `json:"container"`
+	Check       string            `json:"check"`
+	Host        string            `json:"host"`
+	Port        int               `json:"port"`
+	Path        string            `json:"path,omitempty"`
+	Interval    time.Duration     `json:"-"`
+	Labels      map[string]string `json:"-"`
+}
+
+// Address is host:port.
+func (t ServiceTarget) Address() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// ServiceResult is the latest check of a discovered service.
+type ServiceResult struct {
+	ServiceTarget
+	Up        bool               `json:"up"`
+	Latency   int64              `json:"latency_ms,omitempty"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+	Info      map[string]string  `json:"info,omitempty"`
+	CheckedAt int64              `json:"checked_at"`
+	ProbeStatus
+}
+
+type serviceWorker struct {
+	target ServiceTarget
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	last *ServiceResult
+}
+
+// ServiceDiscovery watches Docker for containers labelled for monitoring and
+// runs one check loop per service, starting and stopping them as containers
+// come and go.
+type ServiceDiscovery struct {
+	cli             *client.Client
+	ownsClient      bool
+	prefix          string
+	defaultInterval time.Duration
+	timeout         time.Duration
+	resync          time.Duration
+	checks          map[string]ServiceCheck
+
+	mu      sync.Mutex
+	workers map[string]*serviceWorker
+}
+
+// DiscoveryOption configures a ServiceDiscovery.
+type DiscoveryOption func(*ServiceDiscovery)
+
+// WithDiscoveryClient uses an existing Docker API client. The caller keeps
+// ownership of the client.
+func WithDiscoveryClient(cli *client.Client) DiscoveryOption {
+	return func(d *ServiceDiscovery) {
+		d.cli = cli
+	}
+}
+
+// WithLabelPrefix changes the label namespace (default "iotmonitor").
+func WithLabelPrefix(prefix string) DiscoveryOption {
+	return func(d *ServiceDiscovery) {
+		if prefix != "" {
+			d.prefix = prefix
+		}
+	}
+}
+
+// WithDefaultCheckInterval sets the interval for services without an
+// interval label (default 30s).
+func WithDefaultCheckInterval(interval time.Duration) DiscoveryOption {
+	return func(d *ServiceDiscovery) {
+		if interval > 0 {
+			d.defaultInterval = interval
+		}
+	}
+}
+
+// WithServiceCheck adds or replaces the check run for a label value.
+func WithServiceCheck(name string, check ServiceCheck) DiscoveryOption {
+	return func(d *ServiceDiscovery) {
+		d.checks[name] = check
+	}
+}
+
+// NewServiceDiscovery returns a ServiceDiscovery; call Run to start it.
+func NewServiceDiscovery(opts ...DiscoveryOption) (*ServiceDiscovery, error) {
+	d := &ServiceDiscovery{
+		prefix:          "iotmonitor",
+		defaultInterval: 30 * time.Second,
+		timeout:         5 * time.Second,
+		resync:          time.Minute,
+		checks:          map[string]ServiceCheck{},
+		workers:         map[string]*serviceWorker{},
+	}
+	for name, check := range builtinServiceChecks {
+		d.checks[name] = check
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.cli == nil {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, err
+		}
+		d.cli = cli
+		d.ownsClient = true
+	}
+	return d, nil
+}
+
+// Run syncs with Docker until ctx is cancelled, reacting to container
+// events and re-listing containers periodically in case events were missed.
+func (d *ServiceDiscovery) Run(ctx context.Context) {
+	defer d.stopAll()
+	resync := time.NewTicker(d.resync)
+	defer resync.Stop()
+
+	for {
+		d.sync(ctx)
+
+		evCtx, cancel := context.WithCancel(ctx)
+		msgs, errs := d.cli.Events(evCtx, events.ListOptions{
+			Filters: filters.NewArgs(filters.Arg("type", string(events.ContainerEventType))),
+		})
+	watch:
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case msg := <-msgs:
+				switch msg.Action {
+				case events.ActionStart, events.ActionDie, events.ActionStop,
+					events.ActionDestroy, events.ActionPause, events.ActionUnPause,
+					events.ActionConnect, events.ActionDisconnect:
+					d.sync(ctx)
+				}
+			case <-resync.C:
+				d.sync(ctx)
+			case <-errs:
+				// Docker restarted or the stream broke; back off and resubscribe.
+				cancel()
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				break watch
+			}
+		}
+	}
+}
+
+// sync starts workers for new services and stops those whose container is
+// gone or whose address or labels changed.
+func (d *ServiceDiscovery) sync(ctx context.Context) {
+	listCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	containers, err := d.cli.ContainerList(listCtx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", d.prefix+".check")),
+	})
+	if err != nil {
+		log.Printf("service discovery: list containers: %v", err)
+		return
+	}
+
+	desired := map[string]ServiceTarget{}
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		t, ok := d.target(c)
+		if ok {
+			desired[c.ID] = t
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, w := range d.workers {
+		if t, ok := desired[id]; !ok || !sameTarget(t, w.target) {
+			w.cancel()
+			delete(d.workers, id)
+		}
+	}
+	for id, t := range desired {
+		if _, ok := d.workers[id]; ok {
+			continue
+		}
+		wctx, cancel := context.WithCancel(ctx)
+		w := &serviceWorker{target: t, cancel: cancel}
+		d.workers[id] = w
+		go d.runWorker(wctx, w)
+	}
+}
+
+func sameTarget(a, b ServiceTarget) bool {
+	if a.Check != b.Check || a.Host != b.Host || a.Port != b.Port || a.Path != b.Path || a.Interval != b.Interval {
+		return false
+	}
+	if len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if b.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// target builds a ServiceTarget from a container's labels and networks.
+func (d *ServiceDiscovery) target(c container.Summary) (ServiceTarget, bool) {
+	labels := map[string]string{}
+	for k, v := range c.Labels {
+		if name, ok := strings.CutPrefix(k, d.prefix+"."); ok {
+			labels[name] = v
+		}
+	}
+	name := c.ID[:min(12, len(c.ID))]
+	if len(c.Names) > 0 {
+		name = strings.TrimPrefix(c.Names[0], "/")
+	}
+
+	t := ServiceTarget{
+		ContainerID: c.ID,
+		Container:   name,
+		Check:       strings.ToLower(labels["check"]),
+		Host:        labels["host"],
+		Path:        labels["path"],
+		Interval:    d.defaultInterval,
+		Labels:      labels,
+	}
+	if _, ok := d.checks[t.Check]; !ok {
+		log.Printf("service discovery: container %s: unknown check %q", name, t.Check)
+		return t, false
+	}
+	if v := labels["interval"]; v != "" {
+		if iv, err := time.ParseDuration(v); err == nil && iv >= time.Second {
+			t.Interval = iv
+		} else {
+			log.Printf("service discovery: container %s: invalid interval %q", name, v)
+		}
+	}
+
+	t.Port = defaultServicePorts[t.Check]
+	if v := labels["port"]; v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p <= 0 || p > 65535 {
+			log.Printf("service discovery: container %s: invalid port %q", name, v)
+			return t, false
+		}
+		t.Port = p
+	}
+	if t.Port == 0 && len(c.Ports) > 0 {
+		t.Port = int(c.Ports[0].PrivatePort)
+	}
+	if t.Port == 0 {
+		log.Printf("service discovery: container %s: no port for check %s", name, t.Check)
+		return t, false
+	}
+
+	if t.Host == "" {
+		t.Host = containerIP(c, labels["network"])
+	}
+	if t.Host == "" {
+		// Host-networked containers listen on the host itself.
+		t.Host = "127.0.0.1"
+	}
+	return t, true
+}
+
+// containerIP picks the IP on the named network, or the first network with
+// an address (sorted by name for stability).
+func containerIP(c container.Summary, network string) string {
+	if c.NetworkSettings == nil {
+		return ""
+	}
+	if ep, ok := c.NetworkSettings.Networks[network]; ok && ep != nil && ep.IPAddress != "" {
+		return ep.IPAddress
+	}
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for n := range c.NetworkSettings.Networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if ep := c.NetworkSettings.Networks[n]; ep != nil && ep.IPAddress != "" {
+			return ep.IPAddress
+		}
+	}
+	return ""
+}
+
+func (d *ServiceDiscovery) runWorker(ctx context.Context, w *serviceWorker) {
+	check := d.checks[w.target.Check]
+	ticker := time.NewTicker(w.target.Interval)
+	defer ticker.Stop()
+	for {
+		result := runServiceCheck(ctx, check, w.target, d.timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		w.mu.Lock()
+		w.last = &result
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect returns the latest result of every discovered service that has
+// been checked at least once.
+func (d *ServiceDiscovery) Collect() []ServiceResult {
+	d.mu.Lock()
+	workers := make([]*serviceWorker, 0, len(d.workers))
+	for _, w := range d.workers {
+		workers = append(workers, w)
+	}
+	d.mu.Unlock()
+
+	results := []ServiceResult{}
+	for _, w := range workers {
+		w.mu.Lock()
+		if w.last != nil {
+			results = append(results, *w.last)
+		}
+		w.mu.Unlock()
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Container != results[j].Container {
+			return results[i].Container < results[j].Container
+		}
+		return results[i].Check < results[j].Check
+	})
+	return results
+}
+
+func (d *ServiceDiscovery) stopAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, w := range d.workers {
+		w.cancel()
+		delete(d.workers, id)
+	}
+}
+
+// Close stops all checks and releases the Docker client if the discovery
+// created it.
+func (d *ServiceDiscovery) Close() error {
+	d.stopAll()
+	if d.ownsClient {
+		return d.cli.Close()
+	}
+	return nil
+}
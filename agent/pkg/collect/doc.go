@@ -0,0 +1,14 @@
+// Package collect exposes the IoTMonitor host collectors (system, Docker,
+// Asterisk PJSIP and network) as a reusable library. The agent binary is one
+// consumer; other Go programs can embed the same collectors.
+//
+// Each collector is built with a New*Collector constructor taking functional
+// options and returns typed results from Collect(ctx). Collectors keep the
+// state needed for rate calculations between calls, so callers should reuse
+// one instance rather than constructing a new one per sample.
+//
+// The package is versioned with the module's release tags (agent/vX.Y.Z).
+// Its exported API is stable within a major version: collectors gain new
+// options and result fields, but existing ones keep their names, types and
+// meaning.
+package collect
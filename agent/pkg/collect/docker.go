@@ -1,4 +1,4 @@
-package monitor
+package collect
 
 import (
 	"context"
@@ -22,16 +22,79 @@ type ContainerInfo struct {
 	NetTx       uint64   `json:"net_tx"`
 }
 
-func GetDockerMetrics() ([]ContainerInfo, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// DockerCollector lists containers and their resource usage via the Docker API.
+type DockerCollector struct {
+	cli          *client.Client
+	ownsClient   bool
+	timeout      time.Duration
+	statsTimeout time.Duration
+}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return nil, err
+// DockerOption configures a DockerCollector.
+type DockerOption func(*DockerCollector)
+
+// WithDockerClient uses an existing Docker API client instead of one built
+// from the environment. The caller keeps ownership of the client.
+func WithDockerClient(cli *client.Client) DockerOption {
+	return func(c *DockerCollector) {
+		c.cli = cli
+	}
+}
+
+// WithDockerTimeout bounds a whole Collect call (default 5s).
+func WithDockerTimeout(d time.Duration) DockerOption {
+	return func(c *DockerCollector) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// WithStatsTimeout bounds the per-container stats request (default 1s).
+func WithStatsTimeout(d time.Duration) DockerOption {
+	return func(c *DockerCollector) {
+		if d > 0 {
+			c.statsTimeout = d
+		}
 	}
-	defer cli.Close()
+}
+
+// NewDockerCollector returns a DockerCollector. Without WithDockerClient it
+// connects using the standard DOCKER_* environment variables.
+func NewDockerCollector(opts ...DockerOption) (*DockerCollector, error) {
+	c := &DockerCollector{
+		timeout:      5 * time.Second,
+		statsTimeout: 1 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.cli == nil {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, err
+		}
+		c.cli = cli
+		c.ownsClient = true
+	}
+	return c, nil
+}
+
+// Close releases the Docker client if the collector created it.
+func (c *DockerCollector) Close() error {
+	if c.ownsClient {
+		return c.cli.Close()
+	}
+	return nil
+}
+
+// Collect lists all containers, with CPU, memory and network stats for the
+// running ones.
+func (c *DockerCollector) Collect(ctx context.Context) ([]ContainerInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
 
+	cli := c.cli
 	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
 	if err != nil {
 		return nil, err
@@ -49,7 +112,7 @@ func GetDockerMetrics() ([]ContainerInfo, error) {
 
 		// Only fetch stats for running containers
 		if cnt.State == "running" {
-			statsCtx, statsCancel := context.WithTimeout(ctx, 1*time.Second)
+			statsCtx, statsCancel := context.WithTimeout(ctx, c.statsTimeout)
 			stats, err := cli.ContainerStatsOneShot(statsCtx, cnt.ID)
 			if err == nil {
 				var data struct {
@@ -0,0 +1,138 @@
+package collect
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/common"
+)
+
+// HostPaths points collectors at the host's filesystems when the agent runs
+// in a container, e.g. with -v /proc:/host/proc:ro -v /sys:/host/sys:ro
+// -v /etc:/host/etc:ro -v /:/host/root:ro. Empty fields keep the
+// agent's own view.
+type HostPaths struct {
+	Proc string `json:"proc,omitempty"`
+	Sys  string `json:"sys,omitempty"`
+	Etc  string `json:"etc,omitempty"`
+	Root string `json:"root,omitempty"`
+}
+
+// IsZero reports whether no host path is set.
+func (p HostPaths) IsZero() bool {
+	return p == HostPaths{}
+}
+
+// Context returns ctx carrying the paths in the form gopsutil reads them,
+// so every gopsutil call made with it looks at the host.
+func (p HostPaths) Context(ctx context.Context) context.Context {
+	if p.IsZero() {
+		return ctx
+	}
+	env := common.EnvMap{}
+	if p.Proc != "" {
+		env[common.HostProcEnvKey] = p.Proc
+	}
+	if p.Sys != "" {
+		env[common.HostSysEnvKey] = p.Sys
+	}
+	if p.Etc != "" {
+		env[common.HostEtcEnvKey] = p.Etc
+	}
+	if p.Root != "" {
+		env[common.HostRootEnvKey] = p.Root
+	}
+	return context.WithValue(ctx, common.EnvKey, env)
+}
+
+// Hostname returns the host's hostname from <Etc>/hostname, falling back to
+// the agent's own (which is the container ID inside Docker).
+func (p HostPaths) Hostname() string {
+	if p.Etc != "" {
+		if b, err := os.ReadFile(filepath.Join(p.Etc, "hostname")); err == nil {
+			if name := strings.TrimSpace(string(b)); name != "" {
+				return name
+			}
+		}
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// Validate checks that the configured mounts look like the host's and
+// returns a warning for each problem. It returns nothing when no paths are
+// set.
+func (p HostPaths) Validate() []string {
+	if p.IsZero() {
+		return nil
+	}
+	var warnings []string
+	check := func(kind, dir, probe string) {
+		if dir == "" {
+			warnings = append(warnings, fmt.Sprintf("host %s path is not set; %s metrics will describe the container", kind, kind))
+			return
+		}
+		if _, err := os.Stat(filepath.Join(dir, probe)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("host %s mount %s looks missing (%s not found)", kind, dir, probe))
+		}
+	}
+	check("proc", p.Proc, "stat")
+	check("sys", p.Sys, "class")
+	check("etc", p.Etc, "os-release")
+	check("root", p.Root, "etc")
+
+	// /proc/net and interface counters follow the reader's network
+	// namespace, not the mounted procfs.
+	if p.Proc != "" {
+		own, err1 := os.Readlink("/proc/self/ns/net")
+		host, err2 := os.Readlink(filepath.Join(p.Proc, "1", "ns", "net"))
+		if err1 == nil && err2 == nil && own != host {
+			warnings = append(warnings, "agent is not in the host network namespace; run it with host networking for interface and connection metrics")
+		}
+	}
+	return warnings
+}
+
+// DetectContainer reports whether the current process runs in a container
+// and, if known, which runtime ("docker", "podman", "kubernetes", "lxc",
+// "containerd").
+func DetectContainer() (bool, string) {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return true, "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return true, "podman"
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true, "kubernetes"
+	}
+	if v := os.Getenv("container"); v != "" {
+		return true, v
+	}
+
+	f, err := os.Open("/proc/1/cgroup")
+	if err != nil {
+		return false, ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, runtime := range []string{"docker", "kubepods", "containerd", "lxc", "libpod"} {
+			if strings.Contains(line, runtime) {
+				switch runtime {
+				case "kubepods":
+					return true, "kubernetes"
+				case "libpod":
+					return true, "podman"
+				}
+				return true, runtime
+			}
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,190 @@
+package collect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// ContainerTarget runs DNS, TCP and HTTP checks from inside a Docker
+// container's network namespace, so the results reflect what the
+// containerized app sees (its DNS, routes and firewall) without needing any
+// tools in the image. Linux only; requires CAP_SYS_ADMIN.
+type ContainerTarget struct {
+	Container string       `json:"container"`
+	DNS       []string     `json:"dns,omitempty"`
+	Ports     []PortTarget `json:"ports,omitempty"`
+	HTTP      []HTTPTarget `json:"http,omitempty"`
+}
+
+// DNSResult is a name lookup.
+type DNSResult struct {
+	Name    string   `json:"name"`
+	Success bool     `json:"success"`
+	Addrs   []string `json:"addrs,omitempty"`
+	ProbeStatus
+}
+
+// ContainerProbeResult holds the checks run inside one container. Error is
+// set when the namespace could not be entered, in which case no checks ran.
+type ContainerProbeResult struct {
+	Container   string       `json:"container"`
+	PID         int          `json:"pid,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	DNSResults  []DNSResult  `json:"dns_results,omitempty"`
+	PortResults []PortResult `json:"port_results,omitempty"`
+	HTTPResults []HTTPResult `json:"http_results,omitempty"`
+}
+
+// PIDLookup returns the host PID of a running container's init process.
+type PIDLookup func(ctx context.Context, container string) (int, error)
+
+// DockerPIDLookup resolves container PIDs through the Docker API.
+func DockerPIDLookup(cli *client.Client) PIDLookup {
+	return func(ctx context.Context, container string) (int, error) {
+		info, err := cli.ContainerInspect(ctx, container)
+		if err != nil {
+			return 0, err
+		}
+		if info.State == nil || !info.State.Running || info.State.Pid == 0 {
+			return 0, fmt.Errorf("container %s is not running", container)
+		}
+		return info.State.Pid, nil
+	}
+}
+
+// WithContainerTargets adds checks run inside container network namespaces.
+func WithContainerTargets(targets ...ContainerTarget) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.containerTargets = append(c.containerTargets, targets...)
+	}
+}
+
+// WithContainerPIDLookup sets how container PIDs are found. By default a
+// Docker client is created from the environment on first use.
+func WithContainerPIDLookup(lookup PIDLookup) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.pidLookup = lookup
+	}
+}
+
+func (c *NetworkCollector) lookupPID(ctx context.Context, container string) (int, error) {
+	c.mu.Lock()
+	if c.pidLookup == nil {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.pidLookup = DockerPIDLookup(cli)
+	}
+	lookup := c.pidLookup
+	c.mu.Unlock()
+	return lookup(ctx, container)
+}
+
+// containerNameservers reads the container's own resolv.conf. Docker's
+// embedded DNS (127.0.0.11) is only reachable from inside the namespace.
+func containerNameservers(procRoot string, pid int) []string {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "root", "etc", "resolv.conf"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+func (c *NetworkCollector) probeContainer(ctx context.Context, t ContainerTarget) ContainerProbeResult {
+	result := ContainerProbeResult{Container: t.Container}
+	pid, err := c.lookupPID(ctx, t.Container)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.PID = pid
+
+	ns, err := openNetns(filepath.Join(c.procRoot, strconv.Itoa(pid), "ns", "net"))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer ns.Close()
+
+	// Fast fallback would dial from a goroutine outside the namespace.
+	d := &net.Dialer{Timeout: c.dialTimeout, FallbackDelay: -1}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return ns.dial(ctx, d, network, address)
+	}
+	servers := containerNameservers(c.procRoot, pid)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if len(servers) > 0 {
+				address = servers[0]
+			}
+			return dial(ctx, network, address)
+		},
+	}
+	d.Resolver = resolver
+
+	for _, name := range t.DNS {
+		r := DNSResult{Name: name}
+		start := time.Now()
+		addrs, err := resolver.LookupHost(ctx, name)
+		r.Timings.DNSMs = msSince(start)
+		r.Timings.TotalMs = r.Timings.DNSMs
+		if err != nil {
+			class := FailureDNS
+			if errors.Is(err, context.DeadlineExceeded) {
+				class = FailureTimeout
+			}
+			r.fail(class, err)
+		} else {
+			r.Success = true
+			r.Addrs = addrs
+		}
+		result.DNSResults = append(result.DNSResults, r)
+	}
+
+	for _, p := range t.Ports {
+		status := probeTCP(ctx, dial, resolver, p.Host, p.Port)
+		pr := PortResult{Host: p.Host, Port: p.Port, Open: status.Failure == FailureNone, ProbeStatus: status}
+		if pr.Open {
+			pr.Latency = int64(status.Timings.ConnectMs)
+		}
+		result.PortResults = append(result.PortResults, pr)
+	}
+
+	if len(t.HTTP) > 0 {
+		// No proxy: the host's proxy settings don't apply inside the container.
+		hc := &http.Client{
+			Timeout: 3 * c.dialTimeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				DialContext:       dial,
+			},
+		}
+		for _, h := range t.HTTP {
+			result.HTTPResults = append(result.HTTPResults, probeHTTP(ctx, hc, h))
+		}
+	}
+	return result
+}
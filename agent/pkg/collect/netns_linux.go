@@ -0,0 +1,53 @@
+//go:build linux
+
+package collect
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+type netns struct {
+	file *os.File
+}
+
+func openNetns(path string) (*netns, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &netns{file: f}, nil
+}
+
+// dial creates the socket on a dedicated OS thread switched into the
+// namespace. A socket keeps the namespace it was created in, so the
+// returned connection can be used from any goroutine. The thread is never
+// unlocked and is therefore discarded by the runtime when the goroutine
+// exits, rather than returning to the pool still inside the container's
+// namespace.
+func (n *netns) dial(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Setns(int(n.file.Fd()), unix.CLONE_NEWNET); err != nil {
+			ch <- dialResult{err: err}
+			return
+		}
+		conn, err := d.DialContext(ctx, network, address)
+		ch <- dialResult{conn, err}
+	}()
+	r := <-ch
+	return r.conn, r.err
+}
+
+func (n *netns) Close() error {
+	return n.file.Close()
+}
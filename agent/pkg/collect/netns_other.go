@@ -0,0 +1,21 @@
+//go:build !linux
+
+package collect
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+type netns struct{}
+
+func openNetns(string) (*netns, error) {
+	return nil, errors.New("container network namespace probes are only supported on Linux")
+}
+
+func (*netns) dial(context.Context, *net.Dialer, string, string) (net.Conn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (*netns) Close() error { return nil }
@@ -0,0 +1,402 @@
+package collect
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	psnet "github.com/shirou/gopsutil/v3/net"
+)
+
+type NetworkMetrics struct {
+	PublicIP    string              `json:"public_ip"`
+	LocalIPs    []string            `json:"local_ips"`
+	PingResults []PingResult        `json:"ping_results"`
+	PortResults []PortResult        `json:"port_results"`
+	HTTPResults []HTTPResult        `json:"http_results,omitempty"`
+	Interfaces  []InterfaceStats    `json:"interfaces"`
+	Connections []ProcessConnection `json:"connections,omitempty"`
+
+	// Multi-WAN sites: per-uplink results and the recommended link.
+	Uplinks         []UplinkResult `json:"uplinks,omitempty"`
+	PreferredUplink string         `json:"preferred_uplink,omitempty"`
+	PreferredReason string         `json:"preferred_reason,omitempty"`
+
+	ContainerProbes []ContainerProbeResult `json:"container_probes,omitempty"`
+
+	// NewRemoteEndpoints lists endpoints first contacted by watched
+	// processes since the previous sample. They are meant to be reported
+	// as events rather than as part of the metric payload.
+	NewRemoteEndpoints []RemoteEndpointEvent `json:"-"`
+}
+
+type InterfaceStats struct {
+	Name    string   `json:"name"`
+	IPs     []string `json:"ips"`
+	RxBps   float64  `json:"rx_bps"`
+	TxBps   float64  `json:"tx_bps"`
+	RxBytes uint64   `json:"rx_bytes"`
+	TxBytes uint64   `json:"tx_bytes"`
+}
+
+// PingResult is a TCP reachability probe to port 80. Latency is the connect
+// time and is only set on success.
+type PingResult struct {
+	Host    string `json:"host"`
+	Success bool   `json:"success"`
+	Latency int64  `json:"latency_ms"`
+	ProbeStatus
+}
+
+type PortResult struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Open    bool   `json:"open"`
+	Latency int64  `json:"latency_ms,omitempty"`
+	Binding
+	ProbeStatus
+}
+
+// PortTarget is a TCP endpoint checked for reachability, optionally over a
+// specific interface or source address.
+type PortTarget struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Binding
+}
+
+// NetworkCollector reports addresses, interface throughput and reachability
+// of the configured ping hosts and ports.
+type NetworkCollector struct {
+	pingHosts        []string
+	ports            []PortTarget
+	httpTargets      []HTTPTarget
+	publicIPURL      string
+	httpClient       *http.Client
+	probeClient      *http.Client
+	dialTimeout      time.Duration
+	procRoot         string
+	connMap          bool
+	connWatch        []string
+	conns            *connectionTracker
+	uplinks          []Uplink
+	containerTargets []ContainerTarget
+	pidLookup        PIDLookup
+	uplinkMon        uplinkMonitor
+	proxy            Proxy
+
+	mu           sync.Mutex
+	lastNetStats []psnet.IOCountersStat
+	lastNetTime  time.Time
+	boundClients map[Binding]*http.Client
+}
+
+// NetworkOption configures a NetworkCollector.
+type NetworkOption func(*NetworkCollector)
+
+// WithPingHosts sets the hosts probed with a TCP connect on port 80.
+func WithPingHosts(hosts ...string) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.pingHosts = append(c.pingHosts, hosts...)
+	}
+}
+
+// WithPortTargets sets additional TCP endpoints to check.
+func WithPortTargets(targets ...PortTarget) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.ports = append(c.ports, targets...)
+	}
+}
+
+// WithHTTPTargets sets HTTP(S) endpoints checked for status and content.
+func WithHTTPTargets(targets ...HTTPTarget) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.httpTargets = append(c.httpTargets, targets...)
+	}
+}
+
+// WithPublicIPURL sets the plain-text "what is my IP" endpoint (default
+// https://ident.me). An empty URL disables public IP discovery.
+func WithPublicIPURL(url string) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.publicIPURL = url
+	}
+}
+
+// WithHTTPClient sets the client used for public IP discovery.
+func WithHTTPClient(hc *http.Client) NetworkOption {
+	return func(c *NetworkCollector) {
+		if hc != nil {
+			c.httpClient = hc
+		}
+	}
+}
+
+// WithProxy routes public IP discovery and HTTP checks through a proxy.
+// Without it the standard proxy environment variables apply.
+func WithProxy(p Proxy) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.proxy = p
+	}
+}
+
+// WithDialTimeout sets the per-probe connect timeout (default 2s).
+func WithDialTimeout(d time.Duration) NetworkOption {
+	return func(c *NetworkCollector) {
+		if d > 0 {
+			c.dialTimeout = d
+		}
+	}
+}
+
+// WithProcRoot sets where procfs is mounted (default "/proc"), e.g. the
+// host's /proc mounted into the agent's container.
+func WithProcRoot(path string) NetworkOption {
+	return func(c *NetworkCollector) {
+		if path != "" {
+			c.procRoot = path
+		}
+	}
+}
+
+// WithConnectionMap enables the per-process connection map built from
+// /proc/net/{tcp,tcp6,udp,udp6}. Processes named in watch (by comm name)
+// additionally produce NewRemoteEndpoints when they reach a new peer.
+func WithConnectionMap(watch ...string) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.connMap = true
+		c.connWatch = append(c.connWatch, watch...)
+	}
+}
+
+// NewNetworkCollector returns a NetworkCollector with the given options.
+func NewNetworkCollector(opts ...NetworkOption) *NetworkCollector {
+	c := &NetworkCollector{
+		publicIPURL: "https://ident.me",
+		dialTimeout: 2 * time.Second,
+		procRoot:    "/proc",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.connMap {
+		c.conns = newConnectionTracker(c.procRoot, c.connWatch)
+	}
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = c.proxy.HTTPProxy()
+		c.httpClient = &http.Client{Timeout: 2 * time.Second, Transport: transport}
+	}
+	// Probes use fresh connections so every sample includes DNS, connect
+	// and TLS phases.
+	c.probeClient = &http.Client{
+		Timeout: 3 * c.dialTimeout,
+		Transport: &http.Transport{
+			Proxy:             c.proxy.HTTPProxy(),
+			DisableKeepAlives: true,
+			DialContext:       (&net.Dialer{Timeout: c.dialTimeout}).DialContext,
+		},
+	}
+	return c
+}
+
+func (c *NetworkCollector) publicIP(ctx context.Context) string {
+	if c.publicIPURL == "" {
+		return ""
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.publicIPURL, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	ip, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return string(ip)
+}
+
+// Collect takes one network sample. Interface rates are computed against the
+// previous call, so the first sample carries no interface stats.
+func (c *NetworkCollector) Collect(ctx context.Context) (*NetworkMetrics, error) {
+	metrics := &NetworkMetrics{
+		LocalIPs: []string{},
+	}
+
+	// 1. Get Public IP
+	metrics.PublicIP = c.publicIP(ctx)
+
+	// 2. Get Local IPs
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				if ipnet.IP.To4() != nil {
+					metrics.LocalIPs = append(metrics.LocalIPs, ipnet.IP.String())
+				}
+			}
+		}
+	}
+
+	// 3. Bandwidth & IP Correlation
+	c.mu.Lock()
+	now := time.Now()
+	statsCtx := ctx
+	if c.procRoot != "/proc" {
+		statsCtx = HostPaths{Proc: c.procRoot}.Context(ctx)
+	}
+	if currentStats, err := psnet.IOCountersWithContext(statsCtx, true); err == nil {
+		if !c.lastNetTime.IsZero() {
+			duration := now.Sub(c.lastNetTime).Seconds()
+
+			// Map interface names to IPs
+			ifaceMap := make(map[string][]string)
+			if nIfaces, err := net.Interfaces(); err == nil {
+				for _, iface := range nIfaces {
+					if addrs, err := iface.Addrs(); err == nil {
+						for _, addr := range addrs {
+							if ipnet, ok := addr.(*net.IPNet); ok {
+								if ipnet.IP.To4() != nil {
+									ifaceMap[iface.Name] = append(ifaceMap[iface.Name], ipnet.IP.String())
+								}
+							}
+						}
+					}
+				}
+			}
+
+			for _, curr := range currentStats {
+				for _, prev := range c.lastNetStats {
+					if curr.Name == prev.Name {
+						rxBps := float64(curr.BytesRecv-prev.BytesRecv) * 8 / duration
+						txBps := float64(curr.BytesSent-prev.BytesSent) * 8 / duration
+
+						metrics.Interfaces = append(metrics.Interfaces, InterfaceStats{
+							Name:    curr.Name,
+							IPs:     ifaceMap[curr.Name],
+							RxBps:   rxBps,
+							TxBps:   txBps,
+							RxBytes: curr.BytesRecv,
+							TxBytes: curr.BytesSent,
+						})
+						break
+					}
+				}
+			}
+		}
+		c.lastNetStats = currentStats
+		c.lastNetTime = now
+	}
+	c.mu.Unlock()
+
+	if c.conns != nil {
+		if conns, events, err := c.conns.collect(); err == nil {
+			metrics.Connections = conns
+			metrics.NewRemoteEndpoints = events
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	for _, host := range c.pingHosts {
+		status := probeTCP(ctx, dialer.DialContext, net.DefaultResolver, host, 80)
+		result := PingResult{
+			Host:        host,
+			Success:     status.Failure == FailureNone,
+			ProbeStatus: status,
+		}
+		if result.Success {
+			result.Latency = int64(status.Timings.ConnectMs)
+		}
+		metrics.PingResults = append(metrics.PingResults, result)
+	}
+
+	for _, p := range c.ports {
+		var status ProbeStatus
+		if d, err := p.dialer(c.dialTimeout); err != nil {
+			status.fail(FailureOther, err)
+		} else {
+			status = probeTCP(ctx, d.DialContext, p.resolver(d), p.Host, p.Port)
+		}
+		result := PortResult{
+			Host:        p.Host,
+			Port:        p.Port,
+			Open:        status.Failure == FailureNone,
+			Binding:     p.Binding,
+			ProbeStatus: status,
+		}
+		if result.Open {
+			result.Latency = int64(status.Timings.ConnectMs)
+		}
+		metrics.PortResults = append(metrics.PortResults, result)
+	}
+
+	for _, t := range c.httpTargets {
+		client, err := c.clientFor(t.Binding)
+		if err != nil {
+			result := HTTPResult{URL: t.URL, Binding: t.Binding}
+			result.fail(FailureOther, err)
+			metrics.HTTPResults = append(metrics.HTTPResults, result)
+			continue
+		}
+		metrics.HTTPResults = append(metrics.HTTPResults, probeHTTP(ctx, client, t))
+	}
+
+	if len(c.uplinks) > 0 {
+		// Uplinks are probed in parallel so a dead link's timeouts don't
+		// delay the others.
+		metrics.Uplinks = make([]UplinkResult, len(c.uplinks))
+		var wg sync.WaitGroup
+		for i, u := range c.uplinks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				metrics.Uplinks[i] = c.probeUplink(ctx, u)
+			}()
+		}
+		wg.Wait()
+		metrics.PreferredUplink, metrics.PreferredReason = c.uplinkMon.record(metrics.Uplinks)
+	}
+
+	for _, t := range c.containerTargets {
+		metrics.ContainerProbes = append(metrics.ContainerProbes, c.probeContainer(ctx, t))
+	}
+
+	return metrics, nil
+}
+
+// clientFor returns the probe client for a binding, creating bound clients
+// on first use.
+func (c *NetworkCollector) clientFor(b Binding) (*http.Client, error) {
+	if b.IsZero() {
+		return c.probeClient, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hc, ok := c.boundClients[b]; ok {
+		return hc, nil
+	}
+	d, err := b.dialer(c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d.Resolver = b.resolver(d)
+	hc := &http.Client{
+		Timeout: 3 * c.dialTimeout,
+		Transport: &http.Transport{
+			Proxy:             c.proxy.HTTPProxy(),
+			DisableKeepAlives: true,
+			DialContext:       d.DialContext,
+		},
+	}
+	if c.boundClients == nil {
+		c.boundClients = map[Binding]*http.Client{}
+	}
+	c.boundClients[b] = hc
+	return hc, nil
+}
@@ -0,0 +1,252 @@
+package collect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FailureClass is a machine-readable reason a probe failed.
+type FailureClass string
+
+const (
+	FailureNone            FailureClass = ""
+	FailureDNS             FailureClass = "dns_error"
+	FailureTimeout         FailureClass = "timeout"
+	FailureRefused         FailureClass = "refused"
+	FailureUnreachable     FailureClass = "unreachable"
+	FailureTLS             FailureClass = "tls_error"
+	FailureHTTPStatus      FailureClass = "http_status"
+	FailureContentMismatch FailureClass = "content_mismatch"
+	FailureOther           FailureClass = "error"
+)
+
+// Largest response body read when matching HTTP content.
+const maxProbeBody = 1 << 20
+
+// PhaseTimings breaks a probe down into its network phases, in milliseconds.
+// Phases that did not happen (e.g. TLS on plain TCP) are zero.
+type PhaseTimings struct {
+	DNSMs       float64 `json:"dns_ms,omitempty"`
+	ConnectMs   float64 `json:"connect_ms,omitempty"`
+	TLSMs       float64 `json:"tls_ms,omitempty"`
+	FirstByteMs float64 `json:"first_byte_ms,omitempty"`
+	TotalMs     float64 `json:"total_ms"`
+}
+
+// ProbeStatus is embedded in every probe result. Failure is empty on success.
+// SuppressedBy is set by callers that attribute a failure to a failing
+// upstream dependency (e.g. the WAN probe), naming that root cause.
+type ProbeStatus struct {
+	Failure      FailureClass `json:"failure,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	SuppressedBy string       `json:"suppressed_by,omitempty"`
+	Timings      PhaseTimings `json:"timings"`
+}
+
+func (s *ProbeStatus) fail(class FailureClass, err error) {
+	s.Failure = class
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// HTTPTarget is an HTTP(S) endpoint checked for status and optionally content.
+type HTTPTarget struct {
+	URL string `json:"url"`
+	// ExpectStatus is the required status code; 0 accepts any 2xx or 3xx.
+	ExpectStatus int `json:"expect_status,omitempty"`
+	// ExpectContent, when set, must appear in the response body.
+	ExpectContent string `json:"expect_content,omitempty"`
+	Binding
+}
+
+type HTTPResult struct {
+	URL        string `json:"url"`
+	Success    bool   `json:"success"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Latency    int64  `json:"latency_ms,omitempty"`
+	Binding
+	ProbeStatus
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+func msBetween(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return float64(end.Sub(start).Microseconds()) / 1000
+}
+
+// ClassifyError maps a dial, TLS or HTTP transport error to a FailureClass.
+func ClassifyError(err error) FailureClass {
+	if err == nil {
+		return FailureNone
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailureDNS
+	}
+
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalid x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuth) || errors.As(err, &hostnameErr) || errors.As(err, &certInvalid) {
+		return FailureTLS
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) {
+		return FailureTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return FailureRefused
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EHOSTDOWN) || errors.Is(err, syscall.ENETDOWN) {
+		return FailureUnreachable
+	}
+
+	if strings.Contains(err.Error(), "tls:") || strings.Contains(err.Error(), "x509:") {
+		return FailureTLS
+	}
+	return FailureOther
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// probeTCP resolves host and connects to port, timing each phase separately
+// so a resolver outage is not mistaken for the service being down.
+func probeTCP(ctx context.Context, dial dialFunc, resolver *net.Resolver, host string, port int) (status ProbeStatus) {
+	start := time.Now()
+	defer func() { status.Timings.TotalMs = msSince(start) }()
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		dnsStart := time.Now()
+		addrs, err := resolver.LookupHost(ctx, host)
+		status.Timings.DNSMs = msSince(dnsStart)
+		if err != nil {
+			class := FailureDNS
+			if errors.Is(err, context.DeadlineExceeded) {
+				class = FailureTimeout
+			}
+			status.fail(class, err)
+			return status
+		}
+		ips = addrs
+	}
+
+	var lastErr error
+	connectStart := time.Now()
+	for _, ip := range ips {
+		conn, err := dial(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err == nil {
+			status.Timings.ConnectMs = msSince(connectStart)
+			conn.Close()
+			return status
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	status.Timings.ConnectMs = msSince(connectStart)
+	status.fail(ClassifyError(lastErr), lastErr)
+	return status
+}
+
+// probeHTTP performs a single request on a fresh connection and records DNS,
+// connect, TLS and first-byte timings.
+func probeHTTP(ctx context.Context, client *http.Client, target HTTPTarget) (result HTTPResult) {
+	result.URL = target.URL
+	result.Binding = target.Binding
+	start := time.Now()
+	defer func() { result.Timings.TotalMs = msSince(start) }()
+
+	// The trace callbacks may run on the transport's goroutines, even
+	// after Do returns when a dial is abandoned, so the times are guarded.
+	var mu sync.Mutex
+	var dnsStart, dnsDone, connStart, connDone, tlsStart, tlsDone, firstByte time.Time
+	mark := func(t *time.Time) {
+		mu.Lock()
+		*t = time.Now()
+		mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&dnsDone) },
+		ConnectStart:         func(string, string) { mark(&connStart) },
+		ConnectDone:          func(string, string, error) { mark(&connDone) },
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&tlsDone) },
+		GotFirstResponseByte: func() { mark(&firstByte) },
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target.URL, nil)
+	if err != nil {
+		result.fail(FailureOther, err)
+		return result
+	}
+	resp, err := client.Do(req)
+	mu.Lock()
+	result.Timings.DNSMs = msBetween(dnsStart, dnsDone)
+	result.Timings.ConnectMs = msBetween(connStart, connDone)
+	result.Timings.TLSMs = msBetween(tlsStart, tlsDone)
+	result.Timings.FirstByteMs = msBetween(start, firstByte)
+	mu.Unlock()
+	if err != nil {
+		result.fail(ClassifyError(err), err)
+		return result
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+
+	if target.ExpectStatus != 0 && resp.StatusCode != target.ExpectStatus {
+		result.fail(FailureHTTPStatus, fmt.Errorf("unexpected status %d, want %d", resp.StatusCode, target.ExpectStatus))
+		return result
+	}
+	if target.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		result.fail(FailureHTTPStatus, fmt.Errorf("unexpected status %d", resp.StatusCode))
+		return result
+	}
+
+	if target.ExpectContent != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+		if err != nil {
+			result.fail(ClassifyError(err), err)
+			return result
+		}
+		if !strings.Contains(string(body), target.ExpectContent) {
+			result.fail(FailureContentMismatch, fmt.Errorf("response does not contain %q", target.ExpectContent))
+			return result
+		}
+	}
+
+	result.Success = true
+	result.Latency = time.Since(start).Milliseconds()
+	return result
+}
@@ -0,0 +1,195 @@
+package collect
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Proxy routes outbound HTTP requests and TCP tunnels through an HTTP
+// CONNECT or SOCKS5 proxy. URL is http://[user:pass@]host:port (https://
+// for a TLS connection to the proxy) or socks5://[user:pass@]host:port.
+// NoProxy lists destinations reached directly, in NO_PROXY syntax: hosts,
+// ".domain" suffixes, IPs and CIDRs, optionally with a port; "*" disables
+// the proxy. Loopback destinations never use the proxy.
+//
+// The zero Proxy uses the standard HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and
+// NO_PROXY environment variables (or their lowercase forms).
+type Proxy struct {
+	URL     string `json:"url,omitempty" secret:"userinfo"`
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+// IsZero reports whether p defers to the environment.
+func (p Proxy) IsZero() bool {
+	return p.URL == "" && p.NoProxy == ""
+}
+
+// Validate checks the proxy URL.
+func (p Proxy) Validate() error {
+	if p.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy url: unsupported scheme %q (use http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy url %q has no host", p.URL)
+	}
+	return nil
+}
+
+func (p Proxy) config() *httpproxy.Config {
+	if p.URL != "" {
+		return &httpproxy.Config{HTTPProxy: p.URL, HTTPSProxy: p.URL, NoProxy: p.NoProxy}
+	}
+	cfg := httpproxy.FromEnvironment()
+	if p.NoProxy != "" {
+		cfg.NoProxy = p.NoProxy
+	}
+	// ALL_PROXY is the curl convention for "any protocol", typically SOCKS.
+	all := getenvAny("ALL_PROXY", "all_proxy")
+	if cfg.HTTPProxy == "" {
+		cfg.HTTPProxy = all
+	}
+	if cfg.HTTPSProxy == "" {
+		cfg.HTTPSProxy = all
+	}
+	return cfg
+}
+
+func getenvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// HTTPProxy returns a function for http.Transport.Proxy.
+func (p Proxy) HTTPProxy() func(*http.Request) (*url.URL, error) {
+	fn := p.config().ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}
+}
+
+// DialContext returns a dial function that tunnels TCP connections through
+// the proxy, using forward to reach the proxy itself (or the destination,
+// when it is exempt).
+func (p Proxy) DialContext(forward *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	fn := p.config().ProxyFunc()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxyURL, err := fn(&url.URL{Scheme: "https", Host: addr})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return forward.DialContext(ctx, network, addr)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h":
+			var auth *proxy.Auth
+			if proxyURL.User != nil {
+				pass, _ := proxyURL.User.Password()
+				auth = &proxy.Auth{User: proxyURL.User.Username(), Password: pass}
+			}
+			d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+			if err != nil {
+				return nil, err
+			}
+			return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		case "http", "https":
+			return dialConnect(ctx, forward, proxyURL, addr)
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+	}
+}
+
+// dialConnect opens an HTTP CONNECT tunnel to addr.
+func dialConnect(ctx context.Context, forward *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxyURL.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy TLS: %w", err)
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		pass, _ := proxyURL.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes the proxy sent right after its CONNECT reply
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,276 @@
+package collect
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceCheck probes one discovered service and returns numeric metrics and
+// informational strings. An error means the service is down.
+type ServiceCheck func(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error)
+
+// Built-in checks and the port each uses when the container has no
+// iotmonitor.port label.
+var (
+	builtinServiceChecks = map[string]ServiceCheck{
+		"tcp":   checkTCPService,
+		"http":  checkHTTPService,
+		"redis": checkRedis,
+		"mysql": checkMySQL,
+		"nginx": checkNginx,
+	}
+	defaultServicePorts = map[string]int{
+		"http":  80,
+		"redis": 6379,
+		"mysql": 3306,
+		"nginx": 80,
+	}
+)
+
+func dialService(ctx context.Context, t ServiceTarget) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Address())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func checkTCPService(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error) {
+	conn, err := dialService(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.Close()
+	return nil, nil, nil
+}
+
+func serviceURL(t ServiceTarget, defaultPath string) string {
+	path := t.Path
+	if path == "" {
+		path = defaultPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "http://" + t.Address() + path
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Container addresses are local; never send them through a proxy.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	return client.Do(req)
+}
+
+func checkHTTPService(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error) {
+	resp, err := httpGet(ctx, serviceURL(t, "/"))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	metrics := map[string]float64{"status_code": float64(resp.StatusCode)}
+	if resp.StatusCode >= 400 {
+		return metrics, nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return metrics, nil, nil
+}
+
+// Numeric INFO fields reported for Redis.
+var redisInfoFields = []string{
+	"connected_clients", "blocked_clients", "used_memory", "used_memory_rss",
+	"mem_fragmentation_ratio", "instantaneous_ops_per_sec", "keyspace_hits",
+	"keyspace_misses", "rejected_connections", "evicted_keys", "expired_keys",
+	"connected_slaves", "uptime_in_seconds",
+}
+
+// checkRedis sends INFO over RESP. A server that requires a password still
+// counts as up; set iotmonitor.password to get metrics.
+func checkRedis(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error) {
+	conn, err := dialService(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if pw := t.Labels["password"]; pw != "" {
+		fmt.Fprintf(conn, "*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(pw), pw)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasPrefix(line, "-") {
+			return nil, map[string]string{"auth": "failed"}, nil
+		}
+	}
+
+	if _, err := io.WriteString(conn, "*1\r\n$4\r\nINFO\r\n"); err != nil {
+		return nil, nil, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasPrefix(line, "-NOAUTH") {
+		return nil, map[string]string{"auth": "required"}, nil
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, nil, fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]string{}
+	for _, l := range strings.Split(string(body), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(l), ":"); ok {
+			values[k] = v
+		}
+	}
+	metrics := map[string]float64{}
+	for _, f := range redisInfoFields {
+		if v, err := strconv.ParseFloat(values[f], 64); err == nil {
+			metrics[f] = v
+		}
+	}
+	info := map[string]string{"version": values["redis_version"], "role": values["role"]}
+	return metrics, info, nil
+}
+
+// checkMySQL reads the server greeting, which MySQL and MariaDB send before
+// authentication, so no credentials are needed.
+func checkMySQL(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error) {
+	conn, err := dialService(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, nil, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if size == 0 || size > 1<<16 {
+		return nil, nil, fmt.Errorf("unexpected greeting length %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if payload[0] == 0xFF {
+		// Error packet, e.g. "Host is not allowed to connect" or "Too many
+		// connections": the server is running but refusing us.
+		msg := ""
+		if len(payload) > 3 {
+			msg = string(payload[3:])
+			if strings.HasPrefix(msg, "#") && len(msg) > 6 {
+				msg = msg[6:] // "#" + SQL state
+			}
+		}
+		return nil, nil, fmt.Errorf("server refused connection: %s", msg)
+	}
+	end := 1
+	for end < len(payload) && payload[end] != 0 {
+		end++
+	}
+	info := map[string]string{
+		"protocol": strconv.Itoa(int(payload[0])),
+		"version":  string(payload[1:end]),
+	}
+	metrics := map[string]float64{}
+	if end+5 <= len(payload) {
+		metrics["connection_id"] = float64(binary.LittleEndian.Uint32(payload[end+1:]))
+	}
+	return metrics, info, nil
+}
+
+// checkNginx parses the stub_status page (iotmonitor.path, default
+// /nginx_status).
+func checkNginx(ctx context.Context, t ServiceTarget) (map[string]float64, map[string]string, error) {
+	resp, err := httpGet(ctx, serviceURL(t, "/nginx_status"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("stub_status returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics, err := parseStubStatus(string(body))
+	return metrics, map[string]string{"server": resp.Header.Get("Server")}, err
+}
+
+func parseStubStatus(s string) (map[string]float64, error) {
+	// Active connections: 2
+	// server accepts handled requests
+	//  10 10 25
+	// Reading: 0 Writing: 1 Waiting: 1
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "Active connections:") {
+		return nil, errors.New("response is not an nginx stub_status page")
+	}
+	metrics := map[string]float64{}
+	if v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(lines[0], "Active connections:")), 64); err == nil {
+		metrics["active_connections"] = v
+	}
+	counters := strings.Fields(lines[2])
+	for i, name := range []string{"accepts", "handled", "requests"} {
+		if i < len(counters) {
+			if v, err := strconv.ParseFloat(counters[i], 64); err == nil {
+				metrics[name] = v
+			}
+		}
+	}
+	fields := strings.Fields(lines[3])
+	for i := 0; i+1 < len(fields); i += 2 {
+		if v, err := strconv.ParseFloat(fields[i+1], 64); err == nil {
+			metrics[strings.ToLower(strings.TrimSuffix(fields[i], ":"))] = v
+		}
+	}
+	return metrics, nil
+}
+
+// runServiceCheck wraps a check with timing and failure classification.
+func runServiceCheck(ctx context.Context, check ServiceCheck, t ServiceTarget, timeout time.Duration) ServiceResult {
+	result := ServiceResult{ServiceTarget: t, CheckedAt: time.Now().Unix()}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	metrics, info, err := check(ctx, t)
+	result.Timings.TotalMs = msSince(start)
+	result.Metrics = metrics
+	result.Info = info
+	if err != nil {
+		result.fail(ClassifyError(err), err)
+		return result
+	}
+	result.Up = true
+	result.Latency = int64(result.Timings.TotalMs)
+	return result
+}
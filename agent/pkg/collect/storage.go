@@ -0,0 +1,424 @@
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	storageBlockSize = 4096
+	// storageProbeFile is created in each probed directory and kept between
+	// runs, so the test file isn't rewritten every time.
+	storageProbeFile = ".iotmonitor-storage-probe"
+	// storageBaselineRuns is how many runs the baseline is averaged over
+	// before it is fixed.
+	storageBaselineRuns = 5
+	// Latencies below this are never reported as degraded, however much
+	// they grew.
+	storageDegradedFloorMs = 1.0
+)
+
+// LatencyStats summarises one operation's latencies in milliseconds.
+type LatencyStats struct {
+	Samples int     `json:"samples"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P95Ms   float64 `json:"p95_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// OpBaseline is an operation's usual p50 and p95.
+type OpBaseline struct {
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+}
+
+// StorageBaseline is the average of a path's first runs. It is fixed once
+// Runs reaches its target so that slow degradation stays visible.
+type StorageBaseline struct {
+	Runs      int        `json:"runs"`
+	Complete  bool       `json:"complete"`
+	Since     int64      `json:"since"`
+	Fsync     OpBaseline `json:"fsync"`
+	RandRead  OpBaseline `json:"rand_read"`
+	RandWrite OpBaseline `json:"rand_write"`
+}
+
+// StorageDegradation is each operation's current p95 divided by its
+// baseline p95.
+type StorageDegradation struct {
+	Fsync     float64 `json:"fsync"`
+	RandRead  float64 `json:"rand_read"`
+	RandWrite float64 `json:"rand_write"`
+}
+
+// StoragePathMetrics is one probed directory. RandWrite latencies include
+// making each write durable. DirectIO is false when the filesystem refused
+// O_DIRECT and reads were taken after dropping the file from the page cache
+// instead (or, off Linux, may have been cached).
+type StoragePathMetrics struct {
+	Path        string              `json:"path"`
+	Fsync       LatencyStats        `json:"fsync"`
+	RandRead    LatencyStats        `json:"rand_read"`
+	RandWrite   LatencyStats        `json:"rand_write"`
+	DirectIO    bool                `json:"direct_io"`
+	Baseline    *StorageBaseline    `json:"baseline,omitempty"`
+	Degradation *StorageDegradation `json:"degradation,omitempty"`
+	Degraded    bool                `json:"degraded"`
+	Reasons     []string            `json:"reasons,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+type StorageMetrics struct {
+	Paths     []StoragePathMetrics `json:"paths"`
+	Timestamp int64                `json:"timestamp"`
+}
+
+// StorageCollector measures fsync and 4k random I/O latency on a small test
+// file in each configured directory and compares it with a baseline.
+type StorageCollector struct {
+	paths        []string
+	host         HostPaths
+	fileSize     int64
+	samples      int
+	factor       float64
+	baselineFile string
+
+	mu        sync.Mutex
+	baselines map[string]*StorageBaseline
+	loaded    bool
+	// dirty is set when a baseline changed since it was last saved, so an
+	// established baseline doesn't rewrite the file (and wear an SD card)
+	// on every run.
+	dirty bool
+}
+
+// StorageOption configures a StorageCollector.
+type StorageOption func(*StorageCollector)
+
+// WithStoragePaths sets the directories to probe. Each must be writable.
+func WithStoragePaths(paths ...string) StorageOption {
+	return func(c *StorageCollector) {
+		c.paths = append(c.paths, paths...)
+	}
+}
+
+// WithStorageHostPaths takes the probed directories relative to the host
+// root when the agent runs in a container.
+func WithStorageHostPaths(p HostPaths) StorageOption {
+	return func(c *StorageCollector) {
+		c.host = p
+	}
+}
+
+// WithStorageFileSize bounds the test file (default 8 MiB).
+func WithStorageFileSize(bytes int64) StorageOption {
+	return func(c *StorageCollector) {
+		if bytes >= storageBlockSize {
+			c.fileSize = bytes / storageBlockSize * storageBlockSize
+		}
+	}
+}
+
+// WithStorageSamples sets how many operations of each kind are timed per
+// run (default 32).
+func WithStorageSamples(n int) StorageOption {
+	return func(c *StorageCollector) {
+		if n > 0 {
+			c.samples = n
+		}
+	}
+}
+
+// WithDegradationFactor sets how many times slower than the baseline an
+// operation must get to count as degraded (default 3).
+func WithDegradationFactor(f float64) StorageOption {
+	return func(c *StorageCollector) {
+		if f > 1 {
+			c.factor = f
+		}
+	}
+}
+
+// WithStorageBaselineFile persists baselines across restarts.
+func WithStorageBaselineFile(path string) StorageOption {
+	return func(c *StorageCollector) {
+		c.baselineFile = path
+	}
+}
+
+// NewStorageCollector returns a StorageCollector with the given options.
+func NewStorageCollector(opts ...StorageOption) *StorageCollector {
+	c := &StorageCollector{
+		fileSize:  8 << 20,
+		samples:   32,
+		factor:    3,
+		baselines: map[string]*StorageBaseline{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Collect probes each path in turn. A run writes samples*2 blocks plus the
+// test file the first time; ctx bounds the whole run.
+func (c *StorageCollector) Collect(ctx context.Context) *StorageMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadBaselines()
+
+	m := &StorageMetrics{Paths: []StoragePathMetrics{}, Timestamp: time.Now().Unix()}
+	for _, path := range c.paths {
+		pm := StoragePathMetrics{Path: path}
+		dir := path
+		if c.host.Root != "" {
+			dir = filepath.Join(c.host.Root, path)
+		}
+		if err := c.probe(ctx, dir, &pm); err != nil {
+			pm.Error = err.Error()
+		} else {
+			c.compare(&pm)
+		}
+		m.Paths = append(m.Paths, pm)
+	}
+	c.saveBaselines()
+	return m
+}
+
+func (c *StorageCollector) probe(ctx context.Context, dir string, pm *StoragePathMetrics) error {
+	file := filepath.Join(dir, storageProbeFile)
+	if err := c.prepare(file); err != nil {
+		return err
+	}
+	blocks := int(c.fileSize / storageBlockSize)
+	offset := func() int64 { return int64(rand.IntN(blocks)) * storageBlockSize }
+	buf := storageBlock()
+	for i := range buf {
+		buf[i] = byte(rand.Uint32())
+	}
+
+	// fsync: a buffered write, then time the sync alone.
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	var fsyncs []time.Duration
+	for i := 0; i < c.samples && ctx.Err() == nil; i++ {
+		if _, err := f.WriteAt(buf, offset()); err != nil {
+			f.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+		start := time.Now()
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("fsync: %w", err)
+		}
+		fsyncs = append(fsyncs, time.Since(start))
+	}
+	f.Close()
+
+	// Random writes, each durable before the next.
+	w, err := openStorageWriter(file)
+	if err != nil {
+		return err
+	}
+	var writes []time.Duration
+	for i := 0; i < c.samples && ctx.Err() == nil; i++ {
+		start := time.Now()
+		_, err := w.WriteAt(buf, offset())
+		if err == nil && storageWriteNeedsSync {
+			err = w.Sync()
+		}
+		if err != nil {
+			w.Close()
+			return fmt.Errorf("random write: %w", err)
+		}
+		writes = append(writes, time.Since(start))
+	}
+	w.Close()
+
+	// Random reads, bypassing the page cache where possible.
+	r, direct, err := openStorageReader(file)
+	if err != nil {
+		return err
+	}
+	pm.DirectIO = direct
+	var reads []time.Duration
+	for i := 0; i < c.samples && ctx.Err() == nil; i++ {
+		if !direct {
+			dropStorageCache(r)
+		}
+		start := time.Now()
+		if _, err := r.ReadAt(buf, offset()); err != nil {
+			r.Close()
+			return fmt.Errorf("random read: %w", err)
+		}
+		reads = append(reads, time.Since(start))
+	}
+	r.Close()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.Fsync = latencyStats(fsyncs)
+	pm.RandWrite = latencyStats(writes)
+	pm.RandRead = latencyStats(reads)
+	return nil
+}
+
+// prepare creates the test file at its full size, filled with data so that
+// reads hit allocated blocks. An existing file of the right size is kept.
+func (c *StorageCollector) prepare(file string) error {
+	if info, err := os.Stat(file); err == nil && info.Size() == c.fileSize {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(rand.Uint32())
+	}
+	for written := int64(0); written < c.fileSize; {
+		n := min(int64(len(chunk)), c.fileSize-written)
+		if _, err := f.Write(chunk[:n]); err != nil {
+			f.Close()
+			os.Remove(file)
+			return err
+		}
+		written += n
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func latencyStats(d []time.Duration) LatencyStats {
+	if len(d) == 0 {
+		return LatencyStats{}
+	}
+	ms := make([]float64, len(d))
+	var sum float64
+	for i, v := range d {
+		ms[i] = float64(v.Microseconds()) / 1000
+		sum += ms[i]
+	}
+	sort.Float64s(ms)
+	pct := func(q float64) float64 {
+		i := int(math.Ceil(q*float64(len(ms)))) - 1
+		return ms[max(i, 0)]
+	}
+	return LatencyStats{
+		Samples: len(ms),
+		MeanMs:  roundMs(sum / float64(len(ms))),
+		P50Ms:   pct(0.50),
+		P95Ms:   pct(0.95),
+		P99Ms:   pct(0.99),
+		MaxMs:   ms[len(ms)-1],
+	}
+}
+
+// roundMs rounds to microseconds.
+func roundMs(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// compare folds a run into the path's baseline while it is being
+// established and, once it is, reports how far the run is from it.
+func (c *StorageCollector) compare(pm *StoragePathMetrics) {
+	b := c.baselines[pm.Path]
+	if b == nil {
+		b = &StorageBaseline{Since: time.Now().Unix()}
+		c.baselines[pm.Path] = b
+	}
+	if !b.Complete {
+		b.Runs++
+		n := float64(b.Runs)
+		fold := func(ob *OpBaseline, s LatencyStats) {
+			ob.P50Ms = roundMs(ob.P50Ms + (s.P50Ms-ob.P50Ms)/n)
+			ob.P95Ms = roundMs(ob.P95Ms + (s.P95Ms-ob.P95Ms)/n)
+		}
+		fold(&b.Fsync, pm.Fsync)
+		fold(&b.RandRead, pm.RandRead)
+		fold(&b.RandWrite, pm.RandWrite)
+		b.Complete = b.Runs >= storageBaselineRuns
+		c.dirty = true
+	}
+	copied := *b
+	pm.Baseline = &copied
+	if !b.Complete {
+		return
+	}
+
+	ratio := func(cur, base float64) float64 {
+		if base <= 0 {
+			return 0
+		}
+		return math.Round(cur/base*100) / 100
+	}
+	pm.Degradation = &StorageDegradation{
+		Fsync:     ratio(pm.Fsync.P95Ms, b.Fsync.P95Ms),
+		RandRead:  ratio(pm.RandRead.P95Ms, b.RandRead.P95Ms),
+		RandWrite: ratio(pm.RandWrite.P95Ms, b.RandWrite.P95Ms),
+	}
+	check := func(op string, s LatencyStats, ob OpBaseline) {
+		for _, v := range []struct {
+			name      string
+			cur, base float64
+		}{{"p50", s.P50Ms, ob.P50Ms}, {"p95", s.P95Ms, ob.P95Ms}} {
+			if v.base > 0 && v.cur >= storageDegradedFloorMs && v.cur >= v.base*c.factor {
+				pm.Reasons = append(pm.Reasons, fmt.Sprintf("%s %s %.2fms is %.1fx the baseline %.2fms", op, v.name, v.cur, v.cur/v.base, v.base))
+			}
+		}
+	}
+	check("fsync", pm.Fsync, b.Fsync)
+	check("rand_read", pm.RandRead, b.RandRead)
+	check("rand_write", pm.RandWrite, b.RandWrite)
+	pm.Degraded = len(pm.Reasons) > 0
+}
+
+func (c *StorageCollector) loadBaselines() {
+	if c.loaded || c.baselineFile == "" {
+		return
+	}
+	c.loaded = true
+	data, err := os.ReadFile(c.baselineFile)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(data, &c.baselines)
+	if c.baselines == nil {
+		c.baselines = map[string]*StorageBaseline{}
+	}
+}
+
+func (c *StorageCollector) saveBaselines() {
+	if c.baselineFile == "" || !c.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(c.baselines, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.baselineFile), 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return
+	}
+	tmp := c.baselineFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err == nil && os.Rename(tmp, c.baselineFile) == nil {
+		c.dirty = false
+	}
+}
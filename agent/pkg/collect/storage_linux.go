@@ -0,0 +1,41 @@
+//go:build linux
+
+package collect
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// O_DSYNC makes each write durable on return.
+const storageWriteNeedsSync = false
+
+func openStorageWriter(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|unix.O_DSYNC, 0)
+}
+
+// openStorageReader opens path with O_DIRECT, or without it on filesystems
+// that refuse it (tmpfs, some FUSE and network filesystems).
+func openStorageReader(path string) (*os.File, bool, error) {
+	if f, err := os.OpenFile(path, os.O_RDONLY|unix.O_DIRECT, 0); err == nil {
+		return f, true, nil
+	}
+	f, err := os.Open(path)
+	return f, false, err
+}
+
+func dropStorageCache(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// storageBlock returns a block-sized buffer aligned for O_DIRECT.
+func storageBlock() []byte {
+	buf := make([]byte, 2*storageBlockSize)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (storageBlockSize - 1))
+	if off != 0 {
+		off = storageBlockSize - off
+	}
+	return buf[off : off+storageBlockSize]
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package collect
+
+import "os"
+
+// Without O_DSYNC each timed write is followed by a sync.
+const storageWriteNeedsSync = true
+
+func openStorageWriter(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
+
+// openStorageReader can't bypass the page cache here, so reads may be
+// served from memory.
+func openStorageReader(path string) (*os.File, bool, error) {
+	f, err := os.Open(path)
+	return f, false, err
+}
+
+func dropStorageCache(*os.File) {}
+
+func storageBlock() []byte {
+	return make([]byte, storageBlockSize)
+}
@@ -1,6 +1,8 @@
-package monitor
+package collect
 
 import (
+	"context"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -11,7 +13,6 @@ import (
 	"github.com/shirou/gopsutil/v3/load"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/process"
-	"os"
 )
 
 type TopProcess struct {
@@ -23,6 +24,12 @@ type TopProcess struct {
 
 type SystemMetrics struct {
 	Hostname             string       `json:"hostname"`
+	Platform             string       `json:"platform,omitempty"`
+	PlatformVersion      string       `json:"platform_version,omitempty"`
+	KernelVersion        string       `json:"kernel_version,omitempty"`
+	Containerized        bool         `json:"containerized"`
+	ContainerRuntime     string       `json:"container_runtime,omitempty"`
+	HostMode             bool         `json:"host_mode"`
 	CPUUsage             float64      `json:"cpu_usage"`
 	CPULoad              float64      `json:"cpu_load"` // 1 min load avg
 	CPUPerCore           []float64    `json:"cpu_per_core"`
@@ -47,15 +54,75 @@ type SystemMetrics struct {
 	Timestamp            int64        `json:"timestamp"`
 }
 
-var (
+// SystemCollector samples host CPU, memory, disk and process metrics.
+type SystemCollector struct {
+	diskPath     string
+	topProcesses int
+	cpuSample    time.Duration
+	host         HostPaths
+
+	containerized    bool
+	containerRuntime string
+
 	diskIOMu           sync.Mutex
 	prevDiskSampleAt   time.Time
 	prevDiskReadBytes  uint64
 	prevDiskWriteBytes uint64
-)
+}
+
+// SystemOption configures a SystemCollector.
+type SystemOption func(*SystemCollector)
+
+// WithDiskPath sets the mount point used for disk usage (default "/").
+func WithDiskPath(path string) SystemOption {
+	return func(c *SystemCollector) {
+		if path != "" {
+			c.diskPath = path
+		}
+	}
+}
+
+// WithHostPaths reads CPU, memory, disk, process and OS information from
+// host filesystems mounted into the agent's container. The disk path is then
+// taken relative to the host root.
+func WithHostPaths(p HostPaths) SystemOption {
+	return func(c *SystemCollector) {
+		c.host = p
+	}
+}
+
+// WithTopProcesses sets how many top CPU processes are reported (default 5).
+func WithTopProcesses(n int) SystemOption {
+	return func(c *SystemCollector) {
+		c.topProcesses = n
+	}
+}
 
-func readDiskIOPerSecond() (float64, float64) {
-	counters, err := disk.IOCounters()
+// WithCPUSampleInterval sets the CPU sampling window (default 2s).
+func WithCPUSampleInterval(d time.Duration) SystemOption {
+	return func(c *SystemCollector) {
+		if d > 0 {
+			c.cpuSample = d
+		}
+	}
+}
+
+// NewSystemCollector returns a SystemCollector with the given options applied.
+func NewSystemCollector(opts ...SystemOption) *SystemCollector {
+	c := &SystemCollector{
+		diskPath:     "/",
+		topProcesses: 5,
+		cpuSample:    2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.containerized, c.containerRuntime = DetectContainer()
+	return c
+}
+
+func (c *SystemCollector) readDiskIOPerSecond(ctx context.Context) (float64, float64) {
+	counters, err := disk.IOCountersWithContext(ctx)
 	if err != nil || len(counters) == 0 {
 		return 0, 0
 	}
@@ -68,46 +135,46 @@ func readDiskIOPerSecond() (float64, float64) {
 	}
 
 	now := time.Now()
-	diskIOMu.Lock()
-	defer diskIOMu.Unlock()
+	c.diskIOMu.Lock()
+	defer c.diskIOMu.Unlock()
 
-	if prevDiskSampleAt.IsZero() {
-		prevDiskSampleAt = now
-		prevDiskReadBytes = totalRead
-		prevDiskWriteBytes = totalWrite
+	if c.prevDiskSampleAt.IsZero() {
+		c.prevDiskSampleAt = now
+		c.prevDiskReadBytes = totalRead
+		c.prevDiskWriteBytes = totalWrite
 		return 0, 0
 	}
 
-	elapsed := now.Sub(prevDiskSampleAt).Seconds()
+	elapsed := now.Sub(c.prevDiskSampleAt).Seconds()
 	if elapsed <= 0 {
-		prevDiskSampleAt = now
-		prevDiskReadBytes = totalRead
-		prevDiskWriteBytes = totalWrite
+		c.prevDiskSampleAt = now
+		c.prevDiskReadBytes = totalRead
+		c.prevDiskWriteBytes = totalWrite
 		return 0, 0
 	}
 
 	var readDelta uint64
 	var writeDelta uint64
-	if totalRead >= prevDiskReadBytes {
-		readDelta = totalRead - prevDiskReadBytes
+	if totalRead >= c.prevDiskReadBytes {
+		readDelta = totalRead - c.prevDiskReadBytes
 	}
-	if totalWrite >= prevDiskWriteBytes {
-		writeDelta = totalWrite - prevDiskWriteBytes
+	if totalWrite >= c.prevDiskWriteBytes {
+		writeDelta = totalWrite - c.prevDiskWriteBytes
 	}
 
-	prevDiskSampleAt = now
-	prevDiskReadBytes = totalRead
-	prevDiskWriteBytes = totalWrite
+	c.prevDiskSampleAt = now
+	c.prevDiskReadBytes = totalRead
+	c.prevDiskWriteBytes = totalWrite
 
 	return float64(readDelta) / elapsed, float64(writeDelta) / elapsed
 }
 
-func readTopCPUProcesses(limit int) []TopProcess {
+func readTopCPUProcesses(ctx context.Context, limit int) []TopProcess {
 	if limit <= 0 {
 		return []TopProcess{}
 	}
 
-	procs, err := process.Processes()
+	procs, err := process.ProcessesWithContext(ctx)
 	if err != nil {
 		return []TopProcess{}
 	}
@@ -123,12 +190,12 @@ func readTopCPUProcesses(limit int) []TopProcess {
 			continue
 		}
 
-		cpuPercent, err := procEntry.CPUPercent()
+		cpuPercent, err := procEntry.CPUPercentWithContext(ctx)
 		if err != nil {
 			continue
 		}
-		memPercent, _ := procEntry.MemoryPercent()
-		name, _ := procEntry.Name()
+		memPercent, _ := procEntry.MemoryPercentWithContext(ctx)
+		name, _ := procEntry.NameWithContext(ctx)
 		if name == "" {
 			name = "unknown"
 		}
@@ -154,14 +221,17 @@ func readTopCPUProcesses(limit int) []TopProcess {
 	return top
 }
 
-func GetSystemMetrics() (*SystemMetrics, error) {
+// Collect takes one system sample. It blocks for the CPU sample interval.
+func (c *SystemCollector) Collect(ctx context.Context) (*SystemMetrics, error) {
+	ctx = c.host.Context(ctx)
+
 	// CPU: 2s sample to smooth short spikes (per-core then avg for total)
-	t1, err1 := cpu.Times(false)
-	perCorePercent, err := cpu.Percent(2*time.Second, true)
+	t1, err1 := cpu.TimesWithContext(ctx, false)
+	perCorePercent, err := cpu.PercentWithContext(ctx, c.cpuSample, true)
 	if err != nil {
 		return nil, err
 	}
-	t2, err2 := cpu.Times(false)
+	t2, err2 := cpu.TimesWithContext(ctx, false)
 
 	totalCpu := 0.0
 	for _, v := range perCorePercent {
@@ -192,41 +262,51 @@ func GetSystemMetrics() (*SystemMetrics, error) {
 		}
 	}
 
-	vm, err := mem.VirtualMemory()
+	vm, err := mem.VirtualMemoryWithContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// Disk path can be overridden (useful when running inside containers)
-	path := os.Getenv("IOT_DISK_PATH")
-	if path == "" {
-		path = "/"
+	diskPath := c.diskPath
+	if c.host.Root != "" {
+		diskPath = filepath.Join(c.host.Root, diskPath)
 	}
-
-	diskInfo, err := disk.Usage(path)
+	diskInfo, err := disk.UsageWithContext(ctx, diskPath)
 	if err != nil {
 		// Fallback for some systems where / might not be the right path
 		diskInfo = &disk.UsageStat{}
 	}
 
-	info, err := host.Info()
+	info, err := host.InfoWithContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	hostname := info.Hostname
+	if c.host.Etc != "" {
+		// gopsutil takes the hostname from the UTS namespace, which is the
+		// container's.
+		hostname = c.host.Hostname()
+	}
 
-	avg, err := load.Avg()
+	avg, err := load.AvgWithContext(ctx)
 	if err != nil {
 		avg = &load.AvgStat{}
 	}
-	diskReadBytesPerSec, diskWriteBytesPerSec := readDiskIOPerSecond()
-	topCPUProcesses := readTopCPUProcesses(5)
+	diskReadBytesPerSec, diskWriteBytesPerSec := c.readDiskIOPerSecond(ctx)
+	topCPUProcesses := readTopCPUProcesses(ctx, c.topProcesses)
 
 	// Memory: align with "free -h" by using (total - available) as used
 	memUsed := vm.Total - vm.Available
 	memUsedPct := float64(memUsed) / float64(vm.Total) * 100
 
 	return &SystemMetrics{
-		Hostname:             info.Hostname,
+		Hostname:             hostname,
+		Platform:             info.Platform,
+		PlatformVersion:      info.PlatformVersion,
+		KernelVersion:        info.KernelVersion,
+		Containerized:        c.containerized,
+		ContainerRuntime:     c.containerRuntime,
+		HostMode:             !c.host.IsZero(),
 		CPUUsage:             totalCpu,
 		CPULoad:              avg.Load1,
 		CPUPerCore:           perCorePercent,
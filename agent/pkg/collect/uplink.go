@@ -0,0 +1,214 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Number of samples the rolling uplink figures are computed over.
+const uplinkWindow = 30
+
+// Uplink is one WAN link of a multi-homed site. Every ping host and unbound
+// port target is probed over each uplink.
+type Uplink struct {
+	Name string `json:"name"`
+	Binding
+}
+
+// UplinkProbe is one target probed over an uplink.
+type UplinkProbe struct {
+	Target  string `json:"target"`
+	Success bool   `json:"success"`
+	Latency int64  `json:"latency_ms,omitempty"`
+	ProbeStatus
+}
+
+// UplinkResult reports one uplink. FailedPct and LatencyMs describe this
+// sample; the Avg/Availability figures cover the last uplinkWindow samples.
+type UplinkResult struct {
+	Name string `json:"name"`
+	Binding
+	// Up is true when at least one target answered over this uplink.
+	Up bool `json:"up"`
+	// FailedPct is the share of targets whose TCP connect failed over this
+	// uplink. It is not packet loss: one probe is sent per target.
+	FailedPct       float64       `json:"failed_pct"`
+	LatencyMs       float64       `json:"latency_ms,omitempty"`
+	AvailabilityPct float64       `json:"availability_pct"`
+	AvgFailedPct    float64       `json:"avg_failed_pct"`
+	AvgLatencyMs    float64       `json:"avg_latency_ms,omitempty"`
+	Samples         int           `json:"samples"`
+	Probes          []UplinkProbe `json:"probes"`
+	SuppressedBy    string        `json:"suppressed_by,omitempty"`
+}
+
+type uplinkSample struct {
+	up      bool
+	failed  float64
+	latency float64
+}
+
+type uplinkStats struct {
+	name         string
+	availability float64
+	failed       float64
+	latency      float64
+	up           bool // latest sample
+}
+
+// uplinkMonitor keeps the rolling history and the current recommendation.
+type uplinkMonitor struct {
+	mu        sync.Mutex
+	history   map[string][]uplinkSample
+	preferred string
+}
+
+// WithUplinks probes the ping hosts and port targets over each uplink and
+// recommends the healthiest one.
+func WithUplinks(uplinks ...Uplink) NetworkOption {
+	return func(c *NetworkCollector) {
+		c.uplinks = append(c.uplinks, uplinks...)
+	}
+}
+
+func (c *NetworkCollector) probeUplink(ctx context.Context, u Uplink) UplinkResult {
+	result := UplinkResult{Name: u.Name, Binding: u.Binding, Probes: []UplinkProbe{}}
+
+	type target struct {
+		host string
+		port int
+	}
+	var targets []target
+	for _, h := range c.pingHosts {
+		targets = append(targets, target{h, 80})
+	}
+	for _, p := range c.ports {
+		if p.Binding.IsZero() {
+			targets = append(targets, target{p.Host, p.Port})
+		}
+	}
+
+	dialer, err := u.dialer(c.dialTimeout)
+	var resolver *net.Resolver
+	if err == nil {
+		resolver = u.resolver(dialer)
+	}
+	var ok int
+	var latency float64
+	for _, t := range targets {
+		probe := UplinkProbe{Target: net.JoinHostPort(t.host, strconv.Itoa(t.port))}
+		if err != nil {
+			probe.fail(FailureOther, err)
+		} else {
+			probe.ProbeStatus = probeTCP(ctx, dialer.DialContext, resolver, t.host, t.port)
+		}
+		if probe.Failure == FailureNone {
+			probe.Success = true
+			probe.Latency = int64(probe.Timings.ConnectMs)
+			ok++
+			latency += probe.Timings.ConnectMs
+		}
+		result.Probes = append(result.Probes, probe)
+	}
+	if len(targets) > 0 {
+		result.FailedPct = 100 * float64(len(targets)-ok) / float64(len(targets))
+	}
+	if ok > 0 {
+		result.Up = true
+		result.LatencyMs = latency / float64(ok)
+	}
+	return result
+}
+
+// record adds the sample to each uplink's history, fills in the rolling
+// figures and returns the preferred uplink with the reason it was chosen.
+func (m *uplinkMonitor) record(results []UplinkResult) (string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.history == nil {
+		m.history = map[string][]uplinkSample{}
+	}
+
+	stats := make([]uplinkStats, len(results))
+	for i := range results {
+		r := &results[i]
+		h := append(m.history[r.Name], uplinkSample{up: r.Up, failed: r.FailedPct, latency: r.LatencyMs})
+		if len(h) > uplinkWindow {
+			h = h[len(h)-uplinkWindow:]
+		}
+		m.history[r.Name] = h
+
+		var up, latCount int
+		var failed, lat float64
+		for _, s := range h {
+			if s.up {
+				up++
+			}
+			failed += s.failed
+			if s.latency > 0 {
+				lat += s.latency
+				latCount++
+			}
+		}
+		r.Samples = len(h)
+		r.AvailabilityPct = 100 * float64(up) / float64(len(h))
+		r.AvgFailedPct = failed / float64(len(h))
+		if latCount > 0 {
+			r.AvgLatencyMs = lat / float64(latCount)
+		}
+		stats[i] = uplinkStats{r.Name, r.AvailabilityPct, r.AvgFailedPct, r.AvgLatencyMs, r.Up}
+	}
+	if len(stats) == 0 {
+		return "", ""
+	}
+
+	// Start from the current choice (or the first, primary, uplink) and only
+	// switch when another link is clearly better, so the recommendation
+	// doesn't flap between two similar links.
+	best := stats[0]
+	label := "primary uplink"
+	for _, s := range stats {
+		if s.name == m.preferred {
+			best = s
+			label = "current uplink"
+		}
+	}
+	var reason string
+	switch {
+	case !best.up:
+		reason = label + " down, no better alternative"
+	case best.availability < 100 || best.failed > 0:
+		reason = label + " degraded, no better alternative"
+	default:
+		reason = label + " healthy"
+	}
+	for _, s := range stats {
+		if s.name == best.name {
+			continue
+		}
+		if why, ok := clearlyBetter(s, best); ok {
+			best, reason = s, why
+		}
+	}
+	m.preferred = best.name
+	return best.name, reason
+}
+
+func clearlyBetter(a, b uplinkStats) (string, bool) {
+	switch {
+	case a.availability >= b.availability+5:
+		return fmt.Sprintf("higher availability (%.0f%% vs %.0f%%)", a.availability, b.availability), true
+	case a.availability <= b.availability-5:
+		return "", false
+	case a.failed+10 <= b.failed:
+		return fmt.Sprintf("fewer failed probes (%.0f%% vs %.0f%%)", a.failed, b.failed), true
+	case a.failed >= b.failed+10:
+		return "", false
+	case a.latency > 0 && b.latency > 0 && a.latency < 0.75*b.latency && b.latency-a.latency >= 5:
+		return fmt.Sprintf("lower latency (%.1fms vs %.1fms)", a.latency, b.latency), true
+	}
+	return "", false
+}
@@ -0,0 +1,16 @@
+import { generateBackendKeys } from './services/e2e';
+
+// Prints a fresh backend key pair for end-to-end encryption: the private
+// keys go into the backend's environment, the public keys into each agent's
+// config.json.
+const keys = generateBackendKeys();
+console.log('# Backend environment');
+console.log(`E2E_BACKEND_X25519_KEY=${keys.E2E_BACKEND_X25519_KEY}`);
+console.log(`E2E_BACKEND_SIGNING_KEY=${keys.E2E_BACKEND_SIGNING_KEY}`);
+console.log('');
+console.log('# Agent config.json');
+console.log(JSON.stringify({
+    e2e_enabled: true,
+    e2e_backend_public_key: keys.e2e_backend_public_key,
+    e2e_backend_signing_key: keys.e2e_backend_signing_key,
+}, null, 2));
@@ -0,0 +1,41 @@
+import mongoose from 'mongoose';
+import fs from 'fs';
+import dotenv from 'dotenv';
+import Device from './models/Device';
+import { parseExport, importRecords } from './services/telemetryImport';
+
+dotenv.config();
+
+// Imports files exported by the agent's file sink, e.g. copied from an
+// air-gapped site: npm run import-telemetry -- <device_id> <file>...
+const run = async () => {
+    const [deviceId, ...files] = process.argv.slice(2);
+    if (!deviceId || files.length === 0) {
+        console.error('Usage: import-telemetry <device_id> <file>...');
+        process.exit(2);
+    }
+    try {
+        const MONGODB_URI = process.env.MONGODB_URI || 'mongodb://localhost:27017/iotmonitor';
+        await mongoose.connect(MONGODB_URI);
+
+        if (!(await Device.exists({ device_id: deviceId }))) {
+            console.error(`Device ${deviceId} not found`);
+            process.exit(1);
+        }
+        let failed = false;
+        for (const file of files) {
+            const { records, errors } = parseExport(fs.readFileSync(file));
+            const summary = await importRecords(deviceId, records);
+            summary.errors = [...errors, ...summary.errors];
+            failed = failed || summary.errors.length > 0;
+            console.log(`${file}: ${summary.imported} imported, ${summary.duplicates} already present, ${summary.skipped} skipped of ${summary.records} records`);
+            summary.errors.forEach((err) => console.error(`  ${err}`));
+        }
+        process.exit(failed ? 1 : 0);
+    } catch (err) {
+        console.error('Import failed:', err);
+        process.exit(1);
+    }
+};
+
+run();
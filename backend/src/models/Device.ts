@@ -61,6 +61,20 @@ export interface IDevice extends Document {
     asterisk_container_name?: string;
     assigned_user_ids?: string[];
     custom_fields?: Record<string, string>; // User-defined key-value pairs (e.g. tunnel_port, ssh_user)
+    // End-to-end encryption: approved device public keys, current first, and
+    // a newly announced key waiting for an operator's approval.
+    e2e_keys?: {
+        kid: string;
+        x25519_public: string;
+        ed25519_public: string;
+        approved_at: Date;
+    }[];
+    e2e_pending_key?: {
+        kid: string;
+        x25519_public: string;
+        ed25519_public: string;
+        received_at: Date;
+    };
     created_at: Date;
     updated_at: Date;
 }
@@ -124,6 +138,19 @@ const DeviceSchema: Schema = new Schema({
     asterisk_container_name: { type: String },
     assigned_user_ids: [{ type: String }],
     custom_fields: { type: Schema.Types.Mixed, default: {} },
+    e2e_keys: [{
+        _id: false,
+        kid: { type: String, required: true },
+        x25519_public: { type: String, required: true },
+        ed25519_public: { type: String, required: true },
+        approved_at: { type: Date, default: Date.now },
+    }],
+    e2e_pending_key: {
+        kid: { type: String },
+        x25519_public: { type: String },
+        ed25519_public: { type: String },
+        received_at: { type: Date },
+    },
 }, { timestamps: { createdAt: 'created_at', updatedAt: 'updated_at' } });
 
 export default mongoose.model<IDevice>('Device', DeviceSchema);
@@ -1,4 +1,4 @@
-import { Router, Request } from 'express';
+import express, { Router, Request } from 'express';
 import { authenticate, authorizePermission, AuthRequest, JWT_SECRET } from '../middleware/auth';
 import jwt from 'jsonwebtoken';
 import Device from '../models/Device';
@@ -606,6 +606,49 @@ router.post('/:id/regenerate-token', authorizePermission('devices.update'), asyn
     }
 });
 
+// Approve a device's announced end-to-end encryption key. The caller passes
+// the key id shown in the agent log, so a key injected at the broker isn't
+// approved by mistake. Rotations endorsed by an approved key don't need this.
+router.post('/:id/e2e/approve', authorizePermission('devices.update'), async (req: AuthRequest, res) => {
+    try {
+        const device = await Device.findOne({ device_id: req.params.id });
+        if (!device) return res.status(404).json({ message: 'Device not found' });
+        if (!canAccessDevice(req.user, device)) {
+            return res.status(403).json({ message: 'Access denied for this device' });
+        }
+
+        const pending = device.e2e_pending_key;
+        if (!pending?.kid) return res.status(404).json({ message: 'No key is waiting for approval' });
+        if (req.body?.kid !== pending.kid) {
+            return res.status(400).json({ message: `Pending key id is ${pending.kid}, not ${req.body?.kid}` });
+        }
+
+        const { MAX_DEVICE_KEYS } = await import('../services/e2e');
+        const approved = (device.e2e_keys || []).map((k) => ({
+            kid: k.kid,
+            x25519_public: k.x25519_public,
+            ed25519_public: k.ed25519_public,
+            approved_at: k.approved_at,
+        }));
+        const key = {
+            kid: pending.kid,
+            x25519_public: pending.x25519_public,
+            ed25519_public: pending.ed25519_public,
+            approved_at: new Date(),
+        };
+        await Device.updateOne(
+            { device_id: device.device_id },
+            {
+                $set: { e2e_keys: [key, ...approved.filter((k) => k.kid !== key.kid)].slice(0, MAX_DEVICE_KEYS) },
+                $unset: { e2e_pending_key: 1 },
+            }
+        );
+        res.json({ kid: key.kid });
+    } catch (err: any) {
+        res.status(500).json({ message: err.message });
+    }
+});
+
 // Build agent for an existing device
 router.post('/:id/generate-agent', authorizePermission('devices.build_agent'), async (req: AuthRequest, res) => {
     try {
@@ -875,6 +918,35 @@ router.post('/:id/test-notification', authorizePermission('devices.update'), asy
     }
 });
 
+// Import a file exported by the agent's file sink (NDJSON or CSV, optionally
+// gzipped) as the request body. Telemetry keeps each record's original
+// timestamp.
+router.post(
+    '/:id/telemetry/import',
+    authorizePermission('devices.update'),
+    express.raw({ type: () => true, limit: '64mb' }),
+    async (req: AuthRequest, res) => {
+        try {
+            const device = await Device.findOne({ device_id: req.params.id });
+            if (!device) return res.status(404).json({ message: 'Device not found' });
+            if (!canAccessDevice(req.user, device)) {
+                return res.status(403).json({ message: 'Access denied for this device' });
+            }
+            if (!Buffer.isBuffer(req.body) || req.body.length === 0) {
+                return res.status(400).json({ message: 'Send the exported file as the request body' });
+            }
+
+            const { parseExport, importRecords } = await import('../services/telemetryImport');
+            const { records, errors } = parseExport(req.body);
+            const summary = await importRecords(device.device_id, records);
+            summary.errors = [...errors, ...summary.errors];
+            res.json(summary);
+        } catch (err: any) {
+            res.status(400).json({ message: 'Import failed: ' + err.message });
+        }
+    }
+);
+
 // Get installation script for device
 // Accepts agent token via ?token= query param for remote server curl commands
 router.get('/:id/install-script', installRateLimit, async (req: Request, res) => {
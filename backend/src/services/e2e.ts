@@ -0,0 +1,214 @@
+import crypto from 'crypto';
+
+// Backend half of the agent's end-to-end encryption (e2e_enabled in the
+// agent config). Devices seal metrics, events and command responses to the
+// backend's X25519 key and sign them with their Ed25519 key; commands are
+// sealed to the device's current key and signed with the backend's. The
+// wire format matches agent/internal/e2e/envelope.go.
+
+const ENVELOPE_VERSION = 1;
+const HKDF_INFO = 'iotmonitor-e2e-v1';
+// Same window the agent allows for commands.
+const MAX_SKEW_SECONDS = 5 * 60;
+const MAX_SEEN = 10000;
+// Device keys kept after a rotation, like the agent's keyring.
+export const MAX_DEVICE_KEYS = 3;
+
+// DER prefixes that wrap raw 32-byte keys for Node's crypto.
+const X25519_PKCS8 = Buffer.from('302e020100300506032b656e04220420', 'hex');
+const X25519_SPKI = Buffer.from('302a300506032b656e032100', 'hex');
+const ED25519_PKCS8 = Buffer.from('302e020100300506032b657004220420', 'hex');
+const ED25519_SPKI = Buffer.from('302a300506032b6570032100', 'hex');
+
+export interface Envelope {
+    v: number;
+    kid: string;
+    skid: string;
+    epk: string;
+    nonce: string;
+    ct: string;
+    ts: number;
+    sig: string;
+}
+
+// DeviceKey is an approved device public key, as stored on the device.
+export interface DeviceKey {
+    kid: string;
+    x25519_public: string;
+    ed25519_public: string;
+}
+
+// KeyAnnouncement is what the agent publishes (retained) on
+// iotmonitor/device/<id>/keys.
+export interface KeyAnnouncement extends DeviceKey {
+    previous?: string[];
+    sig: string;
+    endorsed_by?: string;
+    endorsement?: string;
+}
+
+const x25519Private = (raw: Buffer) => crypto.createPrivateKey({ key: Buffer.concat([X25519_PKCS8, raw]), format: 'der', type: 'pkcs8' });
+const x25519Public = (raw: Buffer) => crypto.createPublicKey({ key: Buffer.concat([X25519_SPKI, raw]), format: 'der', type: 'spki' });
+const ed25519Private = (seed: Buffer) => crypto.createPrivateKey({ key: Buffer.concat([ED25519_PKCS8, seed]), format: 'der', type: 'pkcs8' });
+const ed25519Public = (raw: Buffer) => crypto.createPublicKey({ key: Buffer.concat([ED25519_SPKI, raw]), format: 'der', type: 'spki' });
+const rawPublic = (key: crypto.KeyObject) => key.export({ format: 'der', type: 'spki' }).subarray(-32);
+
+// keyId matches the agent's KeyID: the first 8 bytes of SHA-256, in hex.
+export const keyId = (pub: Buffer) => crypto.createHash('sha256').update(pub).digest().subarray(0, 8).toString('hex');
+
+const b64 = (s: unknown) => Buffer.from(typeof s === 'string' ? s : '', 'base64');
+
+interface BackendKeys {
+    x25519: crypto.KeyObject;
+    x25519Public: Buffer;
+    kid: string;
+    signing: crypto.KeyObject;
+    signingKid: string;
+}
+
+let backendKeys: BackendKeys | null | undefined;
+
+// getBackendKeys loads the backend key pair from E2E_BACKEND_X25519_KEY and
+// E2E_BACKEND_SIGNING_KEY (base64 raw X25519 private key and Ed25519 seed,
+// as printed by `npm run e2e-keys`). Returns null when they aren't set.
+export const getBackendKeys = (): BackendKeys | null => {
+    if (backendKeys !== undefined) return backendKeys;
+    const x = process.env.E2E_BACKEND_X25519_KEY;
+    const s = process.env.E2E_BACKEND_SIGNING_KEY;
+    if (!x || !s) {
+        backendKeys = null;
+        return null;
+    }
+    const x25519 = x25519Private(b64(x));
+    const x25519Pub = rawPublic(crypto.createPublicKey(x25519));
+    const signing = ed25519Private(b64(s));
+    backendKeys = {
+        x25519,
+        x25519Public: x25519Pub,
+        kid: keyId(x25519Pub),
+        signing,
+        signingKid: keyId(rawPublic(crypto.createPublicKey(signing))),
+    };
+    return backendKeys;
+};
+
+// generateBackendKeys returns a fresh backend key pair: the private halves
+// for the backend's environment and the public halves for agent configs.
+export const generateBackendKeys = () => {
+    const x = crypto.generateKeyPairSync('x25519');
+    const e = crypto.generateKeyPairSync('ed25519');
+    return {
+        E2E_BACKEND_X25519_KEY: x.privateKey.export({ format: 'der', type: 'pkcs8' }).subarray(-32).toString('base64'),
+        E2E_BACKEND_SIGNING_KEY: e.privateKey.export({ format: 'der', type: 'pkcs8' }).subarray(-32).toString('base64'),
+        e2e_backend_public_key: rawPublic(x.publicKey).toString('base64'),
+        e2e_backend_signing_key: rawPublic(e.publicKey).toString('base64'),
+    };
+};
+
+export const isEnvelope = (raw: Buffer): boolean => {
+    try {
+        const probe = JSON.parse(raw.toString('utf8'));
+        return !!probe && typeof probe === 'object' && probe.v > 0 && typeof probe.ct === 'string' && probe.ct !== '';
+    } catch {
+        return false;
+    }
+};
+
+const signedBytes = (e: Envelope) =>
+    Buffer.from(`${e.v}|${e.kid}|${e.skid}|${e.epk}|${e.nonce}|${e.ct}|${e.ts}`);
+const aad = (e: Envelope) => Buffer.from(`${e.kid}|${e.skid}|${e.ts}`);
+
+const deriveKey = (shared: Buffer, ephPub: Buffer, recipientPub: Buffer) =>
+    Buffer.from(crypto.hkdfSync('sha256', shared, Buffer.concat([ephPub, recipientPub]), HKDF_INFO, 32));
+
+// seen holds the signatures of opened envelopes inside the skew window,
+// so a payload replayed through the broker is rejected.
+const seen = new Map<string, number>();
+
+const remember = (sig: Buffer, ts: number) => {
+    const key = sig.toString('base64');
+    if (seen.has(key)) throw new Error('envelope was already received (replay)');
+    const now = Date.now() / 1000;
+    for (const [k, t] of seen) {
+        if (Math.abs(now - t) > MAX_SKEW_SECONDS) seen.delete(k);
+    }
+    if (seen.size >= MAX_SEEN) throw new Error('too many envelopes inside the replay window');
+    seen.set(key, ts);
+};
+
+// openEnvelope verifies an envelope against the device's approved keys and
+// decrypts it with the backend key.
+export const openEnvelope = (raw: Buffer, deviceKeys: DeviceKey[]): Buffer => {
+    const keys = getBackendKeys();
+    if (!keys) throw new Error('E2E_BACKEND_X25519_KEY and E2E_BACKEND_SIGNING_KEY are not set');
+    const env: Envelope = JSON.parse(raw.toString('utf8'));
+    if (env.v !== ENVELOPE_VERSION) throw new Error(`unsupported envelope version ${env.v}`);
+    if (env.kid !== keys.kid) throw new Error(`envelope sealed to unknown backend key ${env.kid}`);
+
+    const sender = deviceKeys.find((k) => k.kid === env.skid);
+    if (!sender) throw new Error(`envelope signed by unapproved device key ${env.skid}`);
+    const sig = b64(env.sig);
+    if (!crypto.verify(null, signedBytes(env), ed25519Public(b64(sender.ed25519_public)), sig)) {
+        throw new Error('envelope signature verification failed');
+    }
+    if (Math.abs(Date.now() / 1000 - env.ts) > MAX_SKEW_SECONDS) {
+        throw new Error('envelope timestamp outside allowed window');
+    }
+
+    const ephPub = b64(env.epk);
+    const shared = crypto.diffieHellman({ privateKey: keys.x25519, publicKey: x25519Public(ephPub) });
+    const ct = b64(env.ct);
+    const decipher = crypto.createDecipheriv('aes-256-gcm', deriveKey(shared, ephPub, keys.x25519Public), b64(env.nonce));
+    decipher.setAAD(aad(env));
+    decipher.setAuthTag(ct.subarray(ct.length - 16));
+    const plaintext = Buffer.concat([decipher.update(ct.subarray(0, ct.length - 16)), decipher.final()]);
+    remember(sig, env.ts);
+    return plaintext;
+};
+
+// sealEnvelope encrypts plaintext to a device key and signs it with the
+// backend signing key.
+export const sealEnvelope = (plaintext: Buffer, deviceKey: DeviceKey): Buffer => {
+    const keys = getBackendKeys();
+    if (!keys) throw new Error('E2E_BACKEND_X25519_KEY and E2E_BACKEND_SIGNING_KEY are not set');
+    const recipientPub = b64(deviceKey.x25519_public);
+    const eph = crypto.generateKeyPairSync('x25519');
+    const ephPub = rawPublic(eph.publicKey);
+    const shared = crypto.diffieHellman({ privateKey: eph.privateKey, publicKey: x25519Public(recipientPub) });
+    const nonce = crypto.randomBytes(12);
+
+    const env: Envelope = {
+        v: ENVELOPE_VERSION,
+        kid: deviceKey.kid,
+        skid: keys.signingKid,
+        epk: ephPub.toString('base64'),
+        nonce: nonce.toString('base64'),
+        ct: '',
+        ts: Math.floor(Date.now() / 1000),
+        sig: '',
+    };
+    const cipher = crypto.createCipheriv('aes-256-gcm', deriveKey(shared, ephPub, recipientPub), nonce);
+    cipher.setAAD(aad(env));
+    env.ct = Buffer.concat([cipher.update(plaintext), cipher.final(), cipher.getAuthTag()]).toString('base64');
+    env.sig = crypto.sign(null, signedBytes(env), keys.signing).toString('base64');
+    return Buffer.from(JSON.stringify(env));
+};
+
+const announcementBytes = (a: DeviceKey) => Buffer.from(`${a.kid}|${a.x25519_public}|${a.ed25519_public}`);
+
+// checkAnnouncement validates a key announcement's own signature and
+// returns whether an approved key endorsed it (a rotation). Keys that
+// aren't endorsed need an operator's approval before they are used.
+export const checkAnnouncement = (a: KeyAnnouncement, approved: DeviceKey[]): { endorsed: boolean } => {
+    const x = b64(a.x25519_public);
+    const e = b64(a.ed25519_public);
+    if (x.length !== 32 || e.length !== 32) throw new Error('invalid public key length');
+    if (keyId(x) !== a.kid) throw new Error(`key id ${a.kid} doesn't match its x25519 key`);
+    if (!crypto.verify(null, announcementBytes(a), ed25519Public(e), b64(a.sig))) {
+        throw new Error('announcement signature verification failed');
+    }
+    const endorser = approved.find((k) => k.kid === a.endorsed_by);
+    const endorsed = !!endorser && !!a.endorsement &&
+        crypto.verify(null, announcementBytes(a), ed25519Public(b64(endorser.ed25519_public)), b64(a.endorsement));
+    return { endorsed };
+};
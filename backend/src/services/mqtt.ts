@@ -3,6 +3,7 @@ import Device from '../models/Device';
 import { updateDeviceHeartbeat } from './offlineDetection';
 import { checkServiceHealth, checkSIPEndpoints } from './serviceMonitoring';
 import { setMqttBrokerConnected } from './mqttState';
+import { checkAnnouncement, isEnvelope, KeyAnnouncement, MAX_DEVICE_KEYS, openEnvelope, sealEnvelope } from './e2e';
 
 const MQTT_URL = process.env.MQTT_URL || 'mqtt://localhost:1883';
 const MQTT_USERNAME = process.env.MQTT_USERNAME;
@@ -57,6 +58,7 @@ client.on('connect', () => {
     client.subscribe('iotmonitor/device/+/status');
     client.subscribe('iotmonitor/device/+/metrics/+');
     client.subscribe('iotmonitor/device/+/responses');
+    client.subscribe('iotmonitor/device/+/keys');
 });
 
 client.on('reconnect', () => {
@@ -78,6 +80,57 @@ client.on('error', (err) => {
     console.error('[MQTT] Connection error:', err?.message || err);
 });
 
+// readPayload decodes a metric or response. Once a device has an approved
+// end-to-end key only sealed payloads are accepted, since plaintext could
+// have been injected at the broker.
+const readPayload = (device: any, message: Buffer): any => {
+    if (isEnvelope(message)) {
+        return JSON.parse(openEnvelope(message, device.e2e_keys || []).toString('utf8'));
+    }
+    if (device.e2e_keys?.length) {
+        throw new Error('plaintext payload from a device using end-to-end encryption');
+    }
+    return JSON.parse(message.toString());
+};
+
+// handleKeyAnnouncement records a device's announced end-to-end keys. A key
+// endorsed by an approved key (a rotation) is approved right away; any
+// other key waits for an operator to compare its id with the agent log.
+const handleKeyAnnouncement = async (device: any, message: Buffer) => {
+    const announcement: KeyAnnouncement = JSON.parse(message.toString());
+    const approved = (device.e2e_keys || []).map((k: any) => ({
+        kid: k.kid,
+        x25519_public: k.x25519_public,
+        ed25519_public: k.ed25519_public,
+        approved_at: k.approved_at,
+    }));
+    if (approved.some((k: any) => k.kid === announcement.kid)) return;
+
+    const { endorsed } = checkAnnouncement(announcement, approved);
+    const key = {
+        kid: announcement.kid,
+        x25519_public: announcement.x25519_public,
+        ed25519_public: announcement.ed25519_public,
+    };
+    if (endorsed) {
+        await Device.updateOne(
+            { device_id: device.device_id },
+            {
+                $set: { e2e_keys: [{ ...key, approved_at: new Date() }, ...approved].slice(0, MAX_DEVICE_KEYS) },
+                $unset: { e2e_pending_key: 1 },
+            }
+        );
+        console.log(`[MQTT] Device ${device.device_id} rotated its e2e key to ${key.kid}`);
+        return;
+    }
+    if (device.e2e_pending_key?.kid === key.kid) return;
+    await Device.updateOne(
+        { device_id: device.device_id },
+        { $set: { e2e_pending_key: { ...key, received_at: new Date() } } }
+    );
+    console.warn(`[MQTT] Device ${device.device_id} announced e2e key ${key.kid}; approve it once it matches the key id in the agent log`);
+};
+
 client.on('message', async (topic, message, packet) => {
     try {
         if (DEBUG_MQTT) {
@@ -92,6 +145,15 @@ client.on('message', async (topic, message, packet) => {
         const device = await Device.findOne({ device_id });
         if (!device) return;
 
+        if (type === 'keys') {
+            try {
+                await handleKeyAnnouncement(device, message);
+            } catch (err: any) {
+                console.warn(`[MQTT] Rejected e2e key announcement from ${device_id}: ${err.message}`);
+            }
+            return;
+        }
+
         if (type === 'status') {
             const status = message.toString().trim().toLowerCase();
             const oldStatus = String(device.status || '').toLowerCase();
@@ -186,7 +248,13 @@ client.on('message', async (topic, message, packet) => {
 
         if (type === 'metrics') {
             const check_type = parts[4];
-            const payload = JSON.parse(message.toString());
+            let payload: any;
+            try {
+                payload = readPayload(device, message);
+            } catch (err: any) {
+                console.warn(`[MQTT] Rejected ${check_type} metrics from ${device_id}: ${err.message}`);
+                return;
+            }
 
             await updateDeviceHeartbeat(device_id);
 
@@ -416,7 +484,13 @@ client.on('message', async (topic, message, packet) => {
         }
 
         if (type === 'responses') {
-            const payload = JSON.parse(message.toString());
+            let payload: any;
+            try {
+                payload = readPayload(device, message);
+            } catch (err: any) {
+                console.warn(`[MQTT] Rejected command response from ${device_id}: ${err.message}`);
+                return;
+            }
             console.log(`[MQTT] Response received for ${device_id}:`, JSON.stringify(payload).substring(0, 200));
             try {
                 const { getIO } = await import('./socket');
@@ -434,11 +508,15 @@ client.on('message', async (topic, message, packet) => {
     }
 });
 
-export const publishCommand = (device_id: string, command: any) => {
+// publishCommand sends a command, sealed to the device's current key when
+// it uses end-to-end encryption.
+export const publishCommand = async (device_id: string, command: any) => {
     const topic = `iotmonitor/device/${device_id}/commands`;
     const payload = JSON.stringify(command);
     console.log(`[MQTT] Publishing command to ${topic}:`, payload.substring(0, 200));
-    client.publish(topic, payload);
+    const device = await Device.findOne({ device_id }).select({ e2e_keys: 1 });
+    const key = device?.e2e_keys?.[0];
+    client.publish(topic, key ? sealEnvelope(Buffer.from(payload), key) : payload);
 };
 
 export default client;
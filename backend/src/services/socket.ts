@@ -159,7 +159,7 @@ export const initSocket = (httpServer: HttpServer) => {
 
                 console.log(`[SOCKET] Publishing command to MQTT for device ${device_id}:`, parsed);
                 const { publishCommand } = await import('./mqtt');
-                publishCommand(device_id, {
+                await publishCommand(device_id, {
                     command_id: Math.random().toString(36).substring(2, 10),
                     payload: parsed.payload,
                     args: parsed.args,
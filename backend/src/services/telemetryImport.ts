@@ -0,0 +1,201 @@
+import zlib from 'zlib';
+import Telemetry from '../models/Telemetry';
+
+// Records exported by the agent's file sink (file_sink in the agent config).
+// Each NDJSON line or CSV row holds the original publish time, so imported
+// telemetry lands where it belongs on the timeline instead of at import time.
+export interface ExportRecord {
+    timestamp: string;
+    device_id: string;
+    kind: string; // metric, event or status
+    type: string;
+    payload: any;
+}
+
+export interface ImportSummary {
+    records: number;
+    imported: number;
+    duplicates: number;
+    skipped: number;
+    errors: string[];
+}
+
+const CSV_HEADER = 'timestamp,device_id,kind,type,payload';
+// Same window the live MQTT ingestion uses to merge one tick's metrics into
+// a single telemetry document.
+const CONSOLIDATION_WINDOW_MS = 2000;
+// Telemetry older than the collection's TTL would be deleted right away.
+const TELEMETRY_TTL_MS = 30 * 24 * 60 * 60 * 1000;
+const MAX_ERRORS = 20;
+// Upper bound on a decompressed file, so a small gzip bomb can't exhaust
+// memory. The agent rotates files at max_file_mb (16 MB by default).
+const MAX_DECOMPRESSED_BYTES = 256 * 1024 * 1024;
+
+// Minimal RFC 4180 parser: quoted fields may contain commas, quotes ("")
+// and line breaks, as written by Go's encoding/csv.
+const parseCSV = (text: string): string[][] => {
+    const rows: string[][] = [];
+    let row: string[] = [];
+    let field = '';
+    let quoted = false;
+    for (let i = 0; i < text.length; i++) {
+        const c = text[i];
+        if (quoted) {
+            if (c === '"' && text[i + 1] === '"') {
+                field += '"';
+                i++;
+            } else if (c === '"') {
+                quoted = false;
+            } else {
+                field += c;
+            }
+        } else if (c === '"') {
+            quoted = true;
+        } else if (c === ',') {
+            row.push(field);
+            field = '';
+        } else if (c === '\n' || c === '\r') {
+            if (c === '\r' && text[i + 1] === '\n') i++;
+            row.push(field);
+            rows.push(row);
+            row = [];
+            field = '';
+        } else {
+            field += c;
+        }
+    }
+    if (field !== '' || row.length > 0) {
+        row.push(field);
+        rows.push(row);
+    }
+    return rows.filter((r) => r.length > 1 || r[0] !== '');
+};
+
+// parseExport reads one exported file, gzipped or not, in either format.
+export const parseExport = (data: Buffer): { records: ExportRecord[]; errors: string[] } => {
+    let raw = data;
+    if (data.length > 2 && data[0] === 0x1f && data[1] === 0x8b) {
+        try {
+            raw = zlib.gunzipSync(data, { maxOutputLength: MAX_DECOMPRESSED_BYTES });
+        } catch (err: any) {
+            if (err.code === 'ERR_BUFFER_TOO_LARGE') {
+                throw new Error(`decompressed file exceeds ${MAX_DECOMPRESSED_BYTES / (1024 * 1024)} MB`);
+            }
+            throw err;
+        }
+    }
+    const text = raw.toString('utf8');
+    const records: ExportRecord[] = [];
+    const errors: string[] = [];
+    const fail = (line: number, msg: string) => {
+        if (errors.length < MAX_ERRORS) errors.push(`line ${line}: ${msg}`);
+    };
+
+    if (text.startsWith(CSV_HEADER)) {
+        parseCSV(text).slice(1).forEach((cols, i) => {
+            if (cols.length !== 5) return fail(i + 2, `expected 5 columns, got ${cols.length}`);
+            try {
+                const [timestamp, device_id, kind, type, payload] = cols;
+                records.push({ timestamp, device_id, kind, type, payload: JSON.parse(payload) });
+            } catch (err: any) {
+                fail(i + 2, err.message);
+            }
+        });
+        return { records, errors };
+    }
+
+    text.split('\n').forEach((line, i) => {
+        if (!line.trim()) return;
+        try {
+            records.push(JSON.parse(line));
+        } catch (err: any) {
+            fail(i + 1, err.message);
+        }
+    });
+    return { records, errors };
+};
+
+// applyMetric merges a metric payload into a telemetry document the way the
+// live MQTT ingestion stores it.
+const applyMetric = (doc: any, type: string, payload: any): boolean => {
+    doc.extra = doc.extra || {};
+    if (type === 'system') {
+        const fields = [
+            'cpu_usage', 'cpu_idle', 'cpu_steal', 'cpu_user', 'cpu_system', 'cpu_iowait', 'uptime',
+            'cpu_load', 'cpu_per_core', 'memory_usage', 'memory_total', 'memory_used', 'memory_available',
+            'memory_cached', 'memory_buffers', 'disk_usage', 'disk_total', 'disk_used',
+            'disk_read_bytes_per_sec', 'disk_write_bytes_per_sec', 'network_in', 'network_out',
+        ];
+        for (const field of fields) {
+            if (payload[field] !== undefined) doc[field] = payload[field];
+        }
+        Object.assign(doc.extra, payload.extra || {});
+        if (Array.isArray(payload.top_cpu_processes)) doc.extra.top_cpu_processes = payload.top_cpu_processes;
+        return true;
+    }
+    if (type === 'network') {
+        if (payload.public_ip) doc.public_ip = payload.public_ip;
+        if (payload.local_ips) doc.local_ips = payload.local_ips;
+        if (payload.ping_results) doc.extra.ping_results = payload.ping_results;
+        if (payload.port_results) doc.extra.port_results = payload.port_results;
+        if (payload.interfaces) doc.extra.interfaces = payload.interfaces;
+        return true;
+    }
+    if (type === 'docker') {
+        doc.extra.docker = payload;
+        return true;
+    }
+    if (type === 'asterisk') {
+        Object.assign(doc.extra, payload);
+        return true;
+    }
+    return false;
+};
+
+// importRecords stores a device's exported metrics as telemetry with their
+// original timestamps. Only metrics are imported. Metrics of one tick are merged into one document like
+// live ingestion does. Events, status records, metric types the backend
+// doesn't store, records for other devices and records past the telemetry
+// TTL are skipped; documents already present (same device and timestamp)
+// are counted as duplicates, so a file can be imported twice safely. No
+// alerts are raised for imported data.
+export const importRecords = async (deviceId: string, records: ExportRecord[]): Promise<ImportSummary> => {
+    const summary: ImportSummary = { records: records.length, imported: 0, duplicates: 0, skipped: 0, errors: [] };
+    const cutoff = Date.now() - TELEMETRY_TTL_MS;
+
+    const metrics = records
+        .map((rec) => ({ rec, at: new Date(rec.timestamp) }))
+        .filter(({ rec, at }) => {
+            const ok = rec.kind === 'metric' && rec.device_id === deviceId &&
+                !isNaN(at.getTime()) && at.getTime() >= cutoff &&
+                rec.payload !== null && typeof rec.payload === 'object';
+            if (!ok) summary.skipped++;
+            return ok;
+        })
+        .sort((a, b) => a.at.getTime() - b.at.getTime());
+
+    const docs: any[] = [];
+    let current: any = null;
+    for (const { rec, at } of metrics) {
+        if (!current || at.getTime() - current.timestamp.getTime() > CONSOLIDATION_WINDOW_MS) {
+            current = { device_id: deviceId, timestamp: at, extra: {} };
+            docs.push(current);
+        }
+        if (!applyMetric(current, rec.type, rec.payload)) summary.skipped++;
+    }
+
+    for (const doc of docs) {
+        if (Object.keys(doc).length === 3 && Object.keys(doc.extra).length === 0) continue;
+        try {
+            if (await Telemetry.exists({ device_id: deviceId, timestamp: doc.timestamp })) {
+                summary.duplicates++;
+                continue;
+            }
+            await new Telemetry(doc).save();
+            summary.imported++;
+        } catch (err: any) {
+            if (summary.errors.length < MAX_ERRORS) summary.errors.push(err.message);
+        }
+    }
+    return summary;
+};